@@ -0,0 +1,112 @@
+// Package cli runs the migrate CLI within other programs, i.e. an ops
+// binary that bundles its own drivers and offers migrate as a subcommand.
+// Unlike cmd/migrate, it never exits the process, so it can be unit tested.
+package cli
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+	icli "github.com/solvedata/migrate/v4/internal/cli"
+	"github.com/solvedata/migrate/v4/lock"
+	"github.com/solvedata/migrate/v4/source"
+)
+
+// Option configures Run.
+type Option func(*options)
+
+type options struct {
+	icli.Options
+}
+
+// WithVersion sets the version printed by -version.
+func WithVersion(version string) Option {
+	return func(o *options) {
+		o.Version = version
+	}
+}
+
+// WithStdin answers the confirmations of down and lock break with r.
+// Without it, they are answered with no.
+func WithStdin(r io.Reader) Option {
+	return func(o *options) {
+		o.Stdin = r
+	}
+}
+
+// WithLogger prints the messages otherwise printed to stderr with logger.
+func WithLogger(logger migrate.Logger) Option {
+	return func(o *options) {
+		o.Logger = logger
+	}
+}
+
+// WithSignals stops the migrations after the running one once a signal
+// is received, i.e. from a channel passed to signal.Notify. Without it,
+// Run doesn't handle signals, cancel its ctx instead.
+func WithSignals(signals <-chan os.Signal) Option {
+	return func(o *options) {
+		o.Signals = signals
+	}
+}
+
+// WithSourceDriver opens source URLs with scheme name with d.Open,
+// instead of the driver registered with source.Register, if any.
+func WithSourceDriver(name string, d source.Driver) Option {
+	return func(o *options) {
+		if o.SourceDrivers == nil {
+			o.SourceDrivers = make(map[string]source.Driver)
+		}
+		o.SourceDrivers[name] = d
+	}
+}
+
+// WithDatabaseDriver opens database URLs with scheme name with d.Open,
+// instead of the driver registered with database.Register, if any.
+func WithDatabaseDriver(name string, d database.Driver) Option {
+	return func(o *options) {
+		if o.DatabaseDrivers == nil {
+			o.DatabaseDrivers = make(map[string]database.Driver)
+		}
+		o.DatabaseDrivers[name] = d
+	}
+}
+
+// WithLockDriver opens -lock-url URLs with scheme name with d.Open,
+// instead of the driver registered with lock.Register, if any.
+func WithLockDriver(name string, d lock.Driver) Option {
+	return func(o *options) {
+		if o.LockDrivers == nil {
+			o.LockDrivers = make(map[string]lock.Driver)
+		}
+		o.LockDrivers[name] = d
+	}
+}
+
+// Run runs the CLI with args, i.e. []string{"-path", "migrations",
+// "-database", "postgres://localhost:5432/database", "up"}, which don't
+// include the program name. Output for humans is printed to stderr, output
+// for tools like -output json or status to stdout. Either may be nil.
+//
+// Run returns the error the command failed with, after printing it to
+// stderr. ExitCode tells its class. Once ctx is done, no further migration
+// is started. Drivers implementing database.DriverContext abort the running
+// migration too, leaving the database dirty; use WithSignals to stop after
+// the running migration instead.
+func Run(ctx context.Context, args []string, stdout, stderr io.Writer, opts ...Option) error {
+	o := options{icli.Options{Stdout: stdout, Stderr: stderr}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return icli.Run(ctx, args, o.Options)
+}
+
+// ExitCode returns the exit code of the migrate CLI for err returned
+// by Run, i.e. 2 for invalid flags or 4 for a dirty database. It is 0
+// for nil. The exit codes are listed in the usage of the CLI.
+func ExitCode(err error) int {
+	return icli.ExitCode(err)
+}
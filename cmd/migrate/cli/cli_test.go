@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/solvedata/migrate/v4/database"
+	dStub "github.com/solvedata/migrate/v4/database/stub"
+	"github.com/solvedata/migrate/v4/source"
+	sStub "github.com/solvedata/migrate/v4/source/stub"
+)
+
+// openedSource and openedDatabase are drivers whose Open returns
+// the same instance, so tests can inspect it after Run.
+type openedSource struct {
+	source.Driver
+}
+
+func (s openedSource) Open(url string) (source.Driver, error) {
+	return s.Driver, nil
+}
+
+type openedDatabase struct {
+	database.Driver
+}
+
+func (d openedDatabase) Open(url string) (database.Driver, error) {
+	return d.Driver, nil
+}
+
+func newStubs(t *testing.T) (Option, Option, *dStub.Stub) {
+	s, err := (&sStub.Stub{}).Open("stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations := s.(*sStub.Stub).Migrations
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "DROP 2"})
+
+	d, err := (&dStub.Stub{}).Open("private://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return WithSourceDriver("private", openedSource{s}), WithDatabaseDriver("private", openedDatabase{d}), d.(*dStub.Stub)
+}
+
+func TestRun(t *testing.T) {
+	withSource, withDatabase, db := newStubs(t)
+	args := []string{"-source", "private://", "-database", "private://", "-output", "json", "up"}
+
+	var stdout, stderr bytes.Buffer
+	if err := Run(context.Background(), args, &stdout, &stderr, withSource, withDatabase); err != nil {
+		t.Fatalf("expected no error, got %v, stderr: %v", err, stderr.String())
+	}
+	if db.CurrentVersion != 2 {
+		t.Errorf("expected version 2, got %v", db.CurrentVersion)
+	}
+
+	// the result is the last line after the events
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	var result struct {
+		Success  bool  `json:"success"`
+		Version  *uint `json:"version"`
+		ExitCode int   `json:"exit_code"`
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success || result.Version == nil || *result.Version != 2 {
+		t.Errorf("unexpected result %v", lines[len(lines)-1])
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	withSource, withDatabase, _ := newStubs(t)
+	dbArgs := []string{"-source", "private://", "-database", "private://"}
+
+	testCases := []struct {
+		name     string
+		args     []string
+		exitCode int
+		stderr   string
+	}{
+		{"invalid flag", []string{"-nope"}, 2, "flag provided but not defined: -nope"},
+		{"unknown command", append(dbArgs, "nope"), 2, "Usage: migrate"},
+		{"invalid argument", append(dbArgs, "goto", "nope"), 2, "can't read version argument V"},
+		{"conflicting flags", append(dbArgs, "up", "-allow-out-of-order", "1"), 2, "-allow-out-of-order can't be used with limit argument N"},
+		{"unknown driver", []string{"-source", "private://", "-database", "nope://", "up"}, 9, "unknown driver nope"},
+		{"no confirmation", append(dbArgs, "down"), 1, "Not applying all down migrations"},
+		{"no change", append(dbArgs, "-fail-on-no-change", "down", "-all"), 10, "no change"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			err := Run(context.Background(), tc.args, nil, &stderr, withSource, withDatabase)
+			if code := ExitCode(err); code != tc.exitCode {
+				t.Errorf("expected exit code %v, got %v for %v", tc.exitCode, code, err)
+			}
+			if !strings.Contains(stderr.String(), tc.stderr) {
+				t.Errorf("expected %q in stderr, got %q", tc.stderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunHelp(t *testing.T) {
+	withSource, _, _ := newStubs(t)
+
+	var stderr bytes.Buffer
+	if err := Run(context.Background(), []string{"-help"}, nil, &stderr, withSource); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "Source drivers: ") || !strings.Contains(stderr.String(), "private") {
+		t.Errorf("expected the usage to list the private driver, got %q", stderr.String())
+	}
+
+	stderr.Reset()
+	if err := Run(context.Background(), []string{"-version"}, nil, &stderr, WithVersion("v1.2.3")); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.String() != "v1.2.3\n" {
+		t.Errorf("expected v1.2.3, got %q", stderr.String())
+	}
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrVersionConflict is returned by SetVersionIf if the version stored in
+// the database isn't the expected one, i.e. since another process migrated
+// the database concurrently. Drivers that can't check an empty migrations
+// table atomically, i.e. MongoDB, may miss a conflict while no version is
+// stored yet, if both processes start at the same time.
+type ErrVersionConflict struct {
+	ExpectedVersion int
+	ExpectedDirty   bool
+
+	// Version and Dirty are stored in the database, if known.
+	Version int
+	Dirty   bool
+}
+
+// Error implements the error interface.
+func (e ErrVersionConflict) Error() string {
+	return fmt.Sprintf("version conflict: expected version %v (dirty: %v), found %v (dirty: %v); is another migration running?",
+		e.ExpectedVersion, e.ExpectedDirty, e.Version, e.Dirty)
+}
+
+// VersionCASDriver is an optional interface a Driver can implement to save
+// the version only if it hasn't changed since it was read or saved last.
+// Migrate uses it instead of SetVersion if available, so a concurrent run
+// that slipped past a lock that isn't exclusive is detected.
+type VersionCASDriver interface {
+	// SetVersionIf is like SetVersion, but fails with ErrVersionConflict
+	// unless expectedVersion and expectedDirty are stored in the database.
+	// NilVersion is expected if no version is stored.
+	// The version is saved within ctx.
+	SetVersionIf(ctx context.Context, expectedVersion int, expectedDirty bool, version int, dirty bool) error
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/gocql/gocql"
 	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/database/splitter"
 	"github.com/hashicorp/go-multierror"
 )
 
@@ -173,15 +174,13 @@ func (c *Cassandra) Run(migration io.Reader) error {
 	query := string(migr[:])
 
 	if c.config.MultiStatementEnabled {
-		// split query by semi-colon
-		queries := strings.Split(query, ";")
+		queries, err := splitter.SplitString(query, splitter.CQL)
+		if err != nil {
+			return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+		}
 
 		for _, q := range queries {
-			tq := strings.TrimSpace(q)
-			if tq == "" {
-				continue
-			}
-			if err := c.session.Query(tq).Exec(); err != nil {
+			if err := c.session.Query(q).Exec(); err != nil {
 				// TODO: cast to Cassandra error and get line number
 				return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
 			}
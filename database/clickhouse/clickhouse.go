@@ -1,16 +1,17 @@
 package clickhouse
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/solvedata/migrate/v4"
 	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/database/splitter"
 	"github.com/hashicorp/go-multierror"
 )
 
@@ -97,32 +98,56 @@ func (ch *ClickHouse) init() error {
 }
 
 func (ch *ClickHouse) Run(r io.Reader) error {
+	return ch.RunContext(context.Background(), r)
+}
+
+// RunContext is like Run, but cancels the running migration once ctx is done.
+func (ch *ClickHouse) RunContext(ctx context.Context, r io.Reader) error {
 	migration, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
 
 	if ch.config.MultiStatementEnabled {
-		// split query by semi-colon
-		queries := strings.Split(string(migration), ";")
-		for _, q := range queries {
-			tq := strings.TrimSpace(q)
-			if tq == "" {
-				continue
-			}
-			if _, err := ch.conn.Exec(q); err != nil {
-				return database.Error{OrigErr: err, Err: "migration failed", Query: []byte(q)}
-			}
-		}
-		return nil
+		return ch.runStatements(ctx, migration)
 	}
 
-	if _, err := ch.conn.Exec(string(migration)); err != nil {
+	if _, err := ch.conn.ExecContext(ctx, string(migration)); err != nil {
 		return database.Error{OrigErr: err, Err: "migration failed", Query: migration}
 	}
 
 	return nil
 }
+
+// RunDirectives implements database.DirectiveRunner. A migration with the
+// split-statements directive is run statement by statement, as if
+// x-multi-statement was set. ClickHouse has no transactions, so the
+// no-transaction directive needs nothing special.
+func (ch *ClickHouse) RunDirectives(ctx context.Context, r io.Reader, directives database.Directives) error {
+	if !directives.SplitStatements {
+		return ch.RunContext(ctx, r)
+	}
+
+	migration, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return ch.runStatements(ctx, migration)
+}
+
+// runStatements splits migration into statements and runs them one by one.
+func (ch *ClickHouse) runStatements(ctx context.Context, migration []byte) error {
+	queries, err := splitter.Split(migration, splitter.ClickHouse)
+	if err != nil {
+		return database.Error{OrigErr: err, Err: "migration failed", Query: migration}
+	}
+	for _, q := range queries {
+		if _, err := ch.conn.ExecContext(ctx, string(q)); err != nil {
+			return database.Error{OrigErr: err, Err: "migration failed", Query: q}
+		}
+	}
+	return nil
+}
 func (ch *ClickHouse) Version() (int, bool, error) {
 	var (
 		version int
@@ -139,6 +164,11 @@ func (ch *ClickHouse) Version() (int, bool, error) {
 }
 
 func (ch *ClickHouse) SetVersion(version int, dirty bool) error {
+	return ch.SetVersionContext(context.Background(), version, dirty)
+}
+
+// SetVersionContext is like SetVersion, but aborts once ctx is done.
+func (ch *ClickHouse) SetVersionContext(ctx context.Context, version int, dirty bool) error {
 	var (
 		bool = func(v bool) uint8 {
 			if v {
@@ -146,14 +176,14 @@ func (ch *ClickHouse) SetVersion(version int, dirty bool) error {
 			}
 			return 0
 		}
-		tx, err = ch.conn.Begin()
+		tx, err = ch.conn.BeginTx(ctx, nil)
 	)
 	if err != nil {
 		return err
 	}
 
 	query := "INSERT INTO " + ch.config.MigrationsTable + " (version, dirty, sequence) VALUES (?, ?, ?)"
-	if _, err := tx.Exec(query, version, bool(dirty), time.Now().UnixNano()); err != nil {
+	if _, err := tx.ExecContext(ctx, query, version, bool(dirty), time.Now().UnixNano()); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
@@ -231,6 +261,7 @@ func (ch *ClickHouse) Drop() (err error) {
 	return nil
 }
 
-func (ch *ClickHouse) Lock() error   { return nil }
-func (ch *ClickHouse) Unlock() error { return nil }
-func (ch *ClickHouse) Close() error  { return ch.conn.Close() }
+func (ch *ClickHouse) Lock() error                           { return nil }
+func (ch *ClickHouse) LockContext(ctx context.Context) error { return nil }
+func (ch *ClickHouse) Unlock() error                         { return nil }
+func (ch *ClickHouse) Close() error                          { return ch.conn.Close() }
@@ -9,6 +9,7 @@ import (
 	nurl "net/url"
 	"regexp"
 	"strconv"
+	"time"
 )
 
 import (
@@ -42,11 +43,22 @@ type Config struct {
 	LockTable       string
 	ForceLock       bool
 	DatabaseName    string
+
+	// LeaseTTL is the time after which the lock of a process that died
+	// can be taken over. It defaults to database.DefaultLeaseTTL.
+	LeaseTTL time.Duration
+
+	// HistoryTable enables the migration history if not empty.
+	HistoryTable string
 }
 
 type CockroachDb struct {
 	db       *sql.DB
 	isLocked bool
+	lease    *database.LeaseLock
+
+	// tx is the transaction started by Begin, if any
+	tx *sql.Tx
 
 	// Open and WithInstance need to guarantee that config is never nil
 	config *Config
@@ -87,6 +99,8 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		db:     instance,
 		config: config,
 	}
+	px.lease = database.NewLeaseLock(leaseStore{px})
+	px.lease.TTL = config.LeaseTTL
 
 	// ensureVersionTable is a locking operation, so we need to ensureLockTable before we ensureVersionTable.
 	if err := px.ensureLockTable(); err != nil {
@@ -97,6 +111,10 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, err
 	}
 
+	if err := px.ensureHistoryTable(); err != nil {
+		return nil, err
+	}
+
 	return px, nil
 }
 
@@ -132,11 +150,21 @@ func (c *CockroachDb) Open(url string) (database.Driver, error) {
 		forceLock = false
 	}
 
+	var leaseTTL time.Duration
+	if s := purl.Query().Get("x-lease-ttl"); s != "" {
+		leaseTTL, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	px, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
 		LockTable:       lockTable,
 		ForceLock:       forceLock,
+		LeaseTTL:        leaseTTL,
+		HistoryTable:    purl.Query().Get("x-history-table"),
 	})
 	if err != nil {
 		return nil, err
@@ -151,75 +179,199 @@ func (c *CockroachDb) Close() error {
 
 // Locking is done manually with a separate lock table.  Implementing advisory locks in CRDB is being discussed
 // See: https://github.com/cockroachdb/cockroach/issues/13546
+// Lock fails with database.ErrLocked right away if the lock is held by someone else.
 func (c *CockroachDb) Lock() error {
-	err := crdb.ExecuteTx(context.Background(), c.db, nil, func(tx *sql.Tx) (err error) {
-		aid, err := database.GenerateAdvisoryLockId(c.config.DatabaseName)
-		if err != nil {
-			return err
+	if c.isLocked {
+		return database.ErrLocked
+	}
+
+	if err := database.TryLock(0, c.tryLock); err != nil {
+		return err
+	}
+
+	c.isLocked = true
+	return nil
+}
+
+// LockContext is like Lock, but waits for the lock until ctx is done.
+// The lock is a lease which is renewed while held, so the lock of a process
+// that died expires after LeaseTTL and can be taken over.
+func (c *CockroachDb) LockContext(ctx context.Context) error {
+	if c.isLocked {
+		return database.ErrLocked
+	}
+
+	// poll until the lease of another process is released or expired
+	if err := database.PollLock(ctx, time.Second, c.tryLock); err != nil {
+		return err
+	}
+
+	c.isLocked = true
+	return nil
+}
+
+// tryLock acquires the lease, unless another process holds it.
+func (c *CockroachDb) tryLock(time.Duration) (bool, error) {
+	err := c.lease.Lock(context.Background())
+	if err == database.ErrLocked {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Locking is done manually with a separate lock table.  Implementing advisory locks in CRDB is being discussed
+// See: https://github.com/cockroachdb/cockroach/issues/13546
+func (c *CockroachDb) Unlock() error {
+	err := c.lease.Unlock()
+	c.isLocked = false
+	return err
+}
+
+// LockLost implements database.LockLossNotifier. The channel is closed
+// once the lease was taken over by another process.
+func (c *CockroachDb) LockLost() <-chan struct{} {
+	return c.lease.LockLost()
+}
+
+// LockStatus implements database.LockInspector.
+// An expired lease isn't held anymore, since it can be taken over.
+func (c *CockroachDb) LockStatus() (held bool, owner string, since time.Time, err error) {
+	aid, err := database.GenerateAdvisoryLockId(c.config.DatabaseName)
+	if err != nil {
+		return false, "", time.Time{}, err
+	}
+
+	query := `SELECT owner, hostname, acquired_at, expires_at IS NULL OR expires_at > now() FROM "` + c.config.LockTable + `" WHERE lock_id = $1`
+	var leaseOwner, hostname string
+	err = c.db.QueryRowContext(context.Background(), query, aid).Scan(&leaseOwner, &hostname, &since, &held)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, "", time.Time{}, nil
+	case err != nil:
+		if isUndefinedTable(err) {
+			return false, "", time.Time{}, nil
 		}
+		return false, "", time.Time{}, &database.Error{OrigErr: err, Query: []byte(query)}
+	case !held:
+		return false, "", time.Time{}, nil
+	}
 
-		query := "SELECT * FROM " + c.config.LockTable + " WHERE lock_id = $1"
-		rows, err := tx.Query(query, aid)
-		if err != nil {
-			return database.Error{OrigErr: err, Err: "failed to fetch migration lock", Query: []byte(query)}
+	if leaseOwner == "" {
+		// taken by an older version of migrate
+		return true, "unknown owner", since, nil
+	}
+	return true, fmt.Sprintf("%v on host %v", leaseOwner, hostname), since, nil
+}
+
+// ForceUnlock implements database.LockInspector by deleting the lease.
+// The heartbeat of its owner, if still running, fails with database.ErrLeaseLost.
+func (c *CockroachDb) ForceUnlock() error {
+	aid, err := database.GenerateAdvisoryLockId(c.config.DatabaseName)
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM "` + c.config.LockTable + `" WHERE lock_id = $1`
+	if _, err := c.db.ExecContext(context.Background(), query, aid); err != nil {
+		if isUndefinedTable(err) {
+			return nil
 		}
-		defer func() {
-			if errClose := rows.Close(); errClose != nil {
-				err = multierror.Append(err, errClose)
-			}
-		}()
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// leaseStore keeps the lease of the migration lock in the lock table.
+// Expiry times are computed by the database, so clock skew doesn't matter.
+type leaseStore struct {
+	c *CockroachDb
+}
 
-		// If row exists at all, lock is present
-		locked := rows.Next()
-		if locked && !c.config.ForceLock {
+func (s leaseStore) AcquireLease(ctx context.Context, owner, hostname string, ttl time.Duration) error {
+	aid, err := database.GenerateAdvisoryLockId(s.c.config.DatabaseName)
+	if err != nil {
+		return err
+	}
+
+	return crdb.ExecuteTx(ctx, s.c.db, nil, func(tx *sql.Tx) error {
+		// leases of older versions of migrate never expire
+		query := `SELECT expires_at IS NULL OR expires_at > now() FROM "` + s.c.config.LockTable + `" WHERE lock_id = $1`
+		var held bool
+		err := tx.QueryRowContext(ctx, query, aid).Scan(&held)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return database.Error{OrigErr: err, Err: "failed to fetch migration lock", Query: []byte(query)}
+		case held && !s.c.config.ForceLock:
 			return database.ErrLocked
+		default:
+			// take over the expired (or forced) lease
+			query = `DELETE FROM "` + s.c.config.LockTable + `" WHERE lock_id = $1`
+			if _, err := tx.ExecContext(ctx, query, aid); err != nil {
+				return database.Error{OrigErr: err, Err: "failed to take over migration lock", Query: []byte(query)}
+			}
 		}
 
-		query = "INSERT INTO " + c.config.LockTable + " (lock_id) VALUES ($1)"
-		if _, err := tx.Exec(query, aid); err != nil {
+		query = `INSERT INTO "` + s.c.config.LockTable + `" (lock_id, owner, hostname, acquired_at, expires_at) VALUES ($1, $2, $3, now(), now() + $4 * INTERVAL '1 millisecond')`
+		if _, err := tx.ExecContext(ctx, query, aid, owner, hostname, int64(ttl/time.Millisecond)); err != nil {
 			return database.Error{OrigErr: err, Err: "failed to set migration lock", Query: []byte(query)}
 		}
-
 		return nil
 	})
+}
 
+func (s leaseStore) RenewLease(ctx context.Context, owner string, ttl time.Duration) error {
+	aid, err := database.GenerateAdvisoryLockId(s.c.config.DatabaseName)
 	if err != nil {
 		return err
-	} else {
-		c.isLocked = true
-		return nil
 	}
+
+	query := `UPDATE "` + s.c.config.LockTable + `" SET expires_at = now() + $3 * INTERVAL '1 millisecond' WHERE lock_id = $1 AND owner = $2`
+	res, err := s.c.db.ExecContext(ctx, query, aid, owner, int64(ttl/time.Millisecond))
+	if err != nil {
+		if isUndefinedTable(err) {
+			// dropped while locked, there is nothing left to renew
+			return nil
+		}
+		return database.Error{OrigErr: err, Err: "failed to renew migration lock", Query: []byte(query)}
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return database.ErrLeaseLost
+	}
+	return nil
 }
 
-// Locking is done manually with a separate lock table.  Implementing advisory locks in CRDB is being discussed
-// See: https://github.com/cockroachdb/cockroach/issues/13546
-func (c *CockroachDb) Unlock() error {
-	aid, err := database.GenerateAdvisoryLockId(c.config.DatabaseName)
+func (s leaseStore) ReleaseLease(ctx context.Context, owner string) error {
+	aid, err := database.GenerateAdvisoryLockId(s.c.config.DatabaseName)
 	if err != nil {
 		return err
 	}
 
-	// In the event of an implementation (non-migration) error, it is possible for the lock to not be released.  Until
-	// a better locking mechanism is added, a manual purging of the lock table may be required in such circumstances
-	query := "DELETE FROM " + c.config.LockTable + " WHERE lock_id = $1"
-	if _, err := c.db.Exec(query, aid); err != nil {
-		if e, ok := err.(*pq.Error); ok {
-			// 42P01 is "UndefinedTableError" in CockroachDB
-			// https://github.com/cockroachdb/cockroach/blob/master/pkg/sql/pgwire/pgerror/codes.go
-			if e.Code == "42P01" {
-				// On drops, the lock table is fully removed;  This is fine, and is a valid "unlocked" state for the schema
-				c.isLocked = false
-				return nil
-			}
+	query := `DELETE FROM "` + s.c.config.LockTable + `" WHERE lock_id = $1 AND owner = $2`
+	if _, err := s.c.db.ExecContext(ctx, query, aid, owner); err != nil {
+		if isUndefinedTable(err) {
+			// On drops, the lock table is fully removed;  This is fine, and is a valid "unlocked" state for the schema
+			return nil
 		}
 		return database.Error{OrigErr: err, Err: "failed to release migration lock", Query: []byte(query)}
 	}
-
-	c.isLocked = false
 	return nil
 }
 
+// isUndefinedTable returns true for errors caused by a table that doesn't exist.
+func isUndefinedTable(err error) bool {
+	// 42P01 is "UndefinedTableError" in CockroachDB
+	// https://github.com/cockroachdb/cockroach/blob/master/pkg/sql/pgwire/pgerror/codes.go
+	e, ok := err.(*pq.Error)
+	return ok && e.Code == "42P01"
+}
+
 func (c *CockroachDb) Run(migration io.Reader) error {
+	return c.RunContext(context.Background(), migration)
+}
+
+// RunContext is like Run, but cancels the running migration once ctx is done.
+func (c *CockroachDb) RunContext(ctx context.Context, migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
@@ -227,7 +379,7 @@ func (c *CockroachDb) Run(migration io.Reader) error {
 
 	// run migration
 	query := string(migr[:])
-	if _, err := c.db.Exec(query); err != nil {
+	if _, err := c.executor().ExecContext(ctx, query); err != nil {
 		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
 	}
 
@@ -235,24 +387,88 @@ func (c *CockroachDb) Run(migration io.Reader) error {
 }
 
 func (c *CockroachDb) SetVersion(version int, dirty bool) error {
-	return crdb.ExecuteTx(context.Background(), c.db, nil, func(tx *sql.Tx) error {
-		if _, err := tx.Exec(`DELETE FROM "` + c.config.MigrationsTable + `"`); err != nil {
+	return c.SetVersionContext(context.Background(), version, dirty)
+}
+
+// SetVersionContext is like SetVersion, but rolls back once ctx is done.
+func (c *CockroachDb) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	// the transaction started by Begin already makes this atomic
+	if c.tx != nil {
+		return c.saveVersion(ctx, c.tx, version, dirty)
+	}
+
+	return crdb.ExecuteTx(ctx, c.db, nil, func(tx *sql.Tx) error {
+		return c.saveVersion(ctx, tx, version, dirty)
+	})
+}
+
+// saveVersion replaces the version in the migrations table within tx.
+func (c *CockroachDb) saveVersion(ctx context.Context, tx *sql.Tx, version int, dirty bool) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "`+c.config.MigrationsTable+`"`); err != nil {
+		return err
+	}
+
+	if version >= 0 {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO "`+c.config.MigrationsTable+`" (version, dirty) VALUES ($1, $2)`, version, dirty); err != nil {
 			return err
 		}
+	}
 
-		if version >= 0 {
-			if _, err := tx.Exec(`INSERT INTO "`+c.config.MigrationsTable+`" (version, dirty) VALUES ($1, $2)`, version, dirty); err != nil {
-				return err
-			}
-		}
+	return nil
+}
 
-		return nil
-	})
+// Begin starts a transaction which Run, SetVersion, Version and
+// the history use until Commit or Rollback is called.
+func (c *CockroachDb) Begin() error {
+	if c.tx != nil {
+		return database.ErrTxInProgress
+	}
+
+	tx, err := c.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	c.tx = tx
+	return nil
+}
+
+func (c *CockroachDb) Commit() error {
+	if c.tx == nil {
+		return database.ErrNoTx
+	}
+
+	tx := c.tx
+	c.tx = nil
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+	return nil
+}
+
+func (c *CockroachDb) Rollback() error {
+	if c.tx == nil {
+		return database.ErrNoTx
+	}
+
+	tx := c.tx
+	c.tx = nil
+	if err := tx.Rollback(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction rollback failed"}
+	}
+	return nil
+}
+
+// executor returns the transaction started by Begin, if any, or the database.
+func (c *CockroachDb) executor() database.SQLExecutor {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.db
 }
 
 func (c *CockroachDb) Version() (version int, dirty bool, err error) {
 	query := `SELECT version, dirty FROM "` + c.config.MigrationsTable + `" LIMIT 1`
-	err = c.db.QueryRow(query).Scan(&version, &dirty)
+	err = c.executor().QueryRowContext(context.Background(), query).Scan(&version, &dirty)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -273,6 +489,53 @@ func (c *CockroachDb) Version() (version int, dirty bool, err error) {
 	}
 }
 
+func (c *CockroachDb) AddHistory(entry database.HistoryEntry) error {
+	if c.config.HistoryTable == "" {
+		return nil
+	}
+
+	query := `INSERT INTO "` + c.config.HistoryTable + `" (version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	if _, err := c.executor().ExecContext(context.Background(), query,
+		entry.Version, entry.TargetVersion, entry.Direction, entry.Identifier, entry.Checksum,
+		entry.StartedAt, entry.FinishedAt, int64(entry.Duration/time.Millisecond),
+		entry.AppliedBy, entry.Hostname, entry.Success); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+func (c *CockroachDb) History() (entries []database.HistoryEntry, err error) {
+	if c.config.HistoryTable == "" {
+		return nil, database.ErrNoHistory
+	}
+
+	query := `SELECT version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success FROM "` + c.config.HistoryTable + `" ORDER BY id`
+	rows, err := c.executor().QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	for rows.Next() {
+		var e database.HistoryEntry
+		var durationMs int64
+		if err := rows.Scan(&e.Version, &e.TargetVersion, &e.Direction, &e.Identifier, &e.Checksum,
+			&e.StartedAt, &e.FinishedAt, &durationMs, &e.AppliedBy, &e.Hostname, &e.Success); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		e.Duration = time.Duration(durationMs) * time.Millisecond
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return entries, nil
+}
+
 func (c *CockroachDb) Drop() (err error) {
 	// select all tables in current schema
 	query := `SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema())`
@@ -347,6 +610,34 @@ func (c *CockroachDb) ensureVersionTable() (err error) {
 	return nil
 }
 
+// ensureHistoryTable creates the history table if the history is enabled
+// and the table doesn't exist yet. Like ensureVersionTable, it locks the database.
+func (c *CockroachDb) ensureHistoryTable() (err error) {
+	if c.config.HistoryTable == "" {
+		return nil
+	}
+
+	if err = c.Lock(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := c.Unlock(); e != nil {
+			if err == nil {
+				err = e
+			} else {
+				err = multierror.Append(err, e)
+			}
+		}
+	}()
+
+	query := `CREATE TABLE IF NOT EXISTS "` + c.config.HistoryTable + `" (id SERIAL PRIMARY KEY, version INT NOT NULL, target_version INT NOT NULL, direction STRING NOT NULL, identifier STRING NOT NULL, checksum STRING NOT NULL, started_at TIMESTAMPTZ NOT NULL, finished_at TIMESTAMPTZ NOT NULL, duration_ms INT NOT NULL, applied_by STRING NOT NULL, hostname STRING NOT NULL, success BOOL NOT NULL)`
+	if _, err := c.db.Exec(query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
 func (c *CockroachDb) ensureLockTable() error {
 	// check if lock table exists
 	var count int
@@ -355,11 +646,25 @@ func (c *CockroachDb) ensureLockTable() error {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 	if count == 1 {
+		// add the lease columns to lock tables of older versions, only if
+		// missing, so opening doesn't need the privilege to change the table
+		query = `SELECT COUNT(1) FROM information_schema.columns WHERE table_name = $1 AND table_schema = (SELECT current_schema()) AND column_name = 'expires_at'`
+		if err := c.db.QueryRow(query, c.config.LockTable).Scan(&count); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		if count == 1 {
+			return nil
+		}
+
+		query = `ALTER TABLE "` + c.config.LockTable + `" ADD COLUMN IF NOT EXISTS owner STRING NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS hostname STRING NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS acquired_at TIMESTAMPTZ NOT NULL DEFAULT now(), ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NULL`
+		if _, err := c.db.Exec(query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
 		return nil
 	}
 
 	// if not, create the empty lock table
-	query = `CREATE TABLE "` + c.config.LockTable + `" (lock_id INT NOT NULL PRIMARY KEY)`
+	query = `CREATE TABLE "` + c.config.LockTable + `" (lock_id INT NOT NULL PRIMARY KEY, owner STRING NOT NULL DEFAULT '', hostname STRING NOT NULL DEFAULT '', acquired_at TIMESTAMPTZ NOT NULL DEFAULT now(), expires_at TIMESTAMPTZ NULL)`
 	if _, err := c.db.Exec(query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"strings"
 	"testing"
+	"time"
 )
 
 import (
@@ -18,6 +19,7 @@ import (
 )
 
 import (
+	"github.com/solvedata/migrate/v4/database"
 	dt "github.com/solvedata/migrate/v4/database/testing"
 	"github.com/solvedata/migrate/v4/dktesting"
 	_ "github.com/solvedata/migrate/v4/source/file"
@@ -172,3 +174,98 @@ func TestFilterCustomQuery(t *testing.T) {
 		}
 	})
 }
+
+func TestOpenLocked(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		createDB(t, c)
+
+		ip, port, err := c.Port(defaultPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", ip, port)
+		p := &CockroachDb{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := d.Lock(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Open locks to create the migrations table,
+		// it must give up instead of waiting for the lock
+		errs := make(chan error, 1)
+		go func() {
+			d2, err := p.Open(addr)
+			if err == nil {
+				err = d2.Close()
+			}
+			errs <- err
+		}()
+		select {
+		case err := <-errs:
+			if err != database.ErrLocked {
+				t.Fatalf("expected database.ErrLocked, got %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("expected Open to return while the lock is held")
+		}
+
+		if err := d.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLockTableUpgrade(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		createDB(t, c)
+
+		ip, port, err := c.Port(defaultPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%v:%v/migrate?sslmode=disable", ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// the lock table of older versions has no lease columns
+		if _, err := db.Exec(`CREATE TABLE "` + DefaultLockTable + `" (lock_id INT NOT NULL PRIMARY KEY)`); err != nil {
+			t.Fatal(err)
+		}
+
+		addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", ip, port)
+		for i := 0; i < 2; i++ {
+			d, err := (&CockroachDb{}).Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var count int
+		query := `SELECT COUNT(1) FROM information_schema.columns WHERE table_name = $1 AND column_name = 'expires_at'`
+		if err := db.QueryRow(query, DefaultLockTable).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Error("expected the lease columns to be added to the lock table")
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package database
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Directives are options of a single migration, given in a header comment
+// of the migration like "-- migrate:no-transaction".
+type Directives struct {
+	// NoTransaction asks to run the migration outside of any transaction,
+	// i.e. for CREATE INDEX CONCURRENTLY in PostgreSQL.
+	NoTransaction bool
+
+	// Timeout limits how long the migration may run, if not zero.
+	Timeout time.Duration
+
+	// SplitStatements asks to run the statements of the migration one by one.
+	SplitStatements bool
+
+	// Env lists the environments the migration is applied in, all if empty.
+	Env []string
+}
+
+// DirectiveRunner is an optional interface a Driver can implement to honour
+// the directives of a migration. Migrate calls RunDirectives instead of Run
+// for migrations with directives. Timeout is honoured by Migrate, ctx expires
+// once it is exceeded.
+type DirectiveRunner interface {
+	RunDirectives(ctx context.Context, migration io.Reader, directives Directives) error
+}
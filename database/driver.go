@@ -5,6 +5,7 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync"
@@ -80,6 +81,23 @@ type Driver interface {
 	Drop() error
 }
 
+// DriverContext is an optional interface a Driver can implement to honour
+// cancellation and deadlines of the context passed to Migrate's *Context
+// methods. Migrate will prefer these methods over their counterparts in
+// Driver when they are available.
+type DriverContext interface {
+	// RunContext is like Run, but aborts the migration once ctx is done.
+	RunContext(ctx context.Context, migration io.Reader) error
+
+	// LockContext is like Lock, but gives up waiting for the lock once ctx is done.
+	// The lock must not be held once it returned an error, so drivers should
+	// poll a try-lock primitive, see PollLock, instead of canceling a blocking one.
+	LockContext(ctx context.Context) error
+
+	// SetVersionContext is like SetVersion, but aborts once ctx is done.
+	SetVersionContext(ctx context.Context, version int, dirty bool) error
+}
+
 // Open returns a new driver instance.
 func Open(url string) (Driver, error) {
 	scheme, err := iurl.SchemeFromURL(url)
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoHistory = fmt.Errorf("migration history not enabled")
+)
+
+// HistoryEntry describes a single run of a migration against the database.
+type HistoryEntry struct {
+	// Version is the version of the migration.
+	Version uint
+
+	// TargetVersion is the version of the database after the migration
+	// has been applied. Can be -1, implying NilVersion.
+	TargetVersion int
+
+	// Direction is either "up" or "down".
+	Direction string
+
+	// Identifier is the identifier of the migration in the source.
+	Identifier string
+
+	// Checksum is a hash of the migration body, if known.
+	Checksum string
+
+	// StartedAt and FinishedAt enclose the run of the migration.
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// Duration is the time it took to run the migration.
+	Duration time.Duration
+
+	// AppliedBy is the name of the user who ran the migration.
+	AppliedBy string
+
+	// Hostname is the name of the host the migration ran on.
+	Hostname string
+
+	// Success is false if the migration failed.
+	Success bool
+}
+
+// HistoryDriver is an optional interface a Driver can implement to keep an
+// append-only log of every migration run, next to the single row that
+// holds the current version and dirty state.
+type HistoryDriver interface {
+	// AddHistory appends entry to the history.
+	// Migrate will call this function after each call to Run.
+	// If the history is not enabled, return nil.
+	AddHistory(entry HistoryEntry) error
+
+	// History returns all entries in the order they were added.
+	// If the history is not enabled, return ErrNoHistory.
+	History() ([]HistoryEntry, error)
+}
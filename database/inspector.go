@@ -0,0 +1,20 @@
+package database
+
+import (
+	"time"
+)
+
+// LockInspector is an optional interface a Driver can implement to tell
+// who holds the migration lock, i.e. after a deploy job died mid-run,
+// and to release a lock that is held by another process.
+type LockInspector interface {
+	// LockStatus returns whether the migration lock is held, a description
+	// of the owner, i.e. its session or host, and since when it is held.
+	// since is zero if the database doesn't record it.
+	LockStatus() (held bool, owner string, since time.Time, err error)
+
+	// ForceUnlock releases the migration lock no matter who holds it,
+	// i.e. by terminating the session of the owner. It is a no-op if the
+	// lock isn't held. Use with care, the owner may still be migrating.
+	ForceUnlock() error
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+var (
+	ErrLeaseLost = fmt.Errorf("lock lease lost, another process may have taken over")
+)
+
+// DefaultLeaseTTL is the time a lease is valid without being renewed.
+var DefaultLeaseTTL = 30 * time.Second
+
+// LockLossNotifier is an optional interface a Driver or a lock driver can
+// implement if its lock can be lost while held, i.e. a lease that another
+// process took over. Migrate cancels the running migrations once it is lost,
+// which then fail with ErrLeaseLost.
+type LockLossNotifier interface {
+	// LockLost returns a channel that is closed once the lock acquired
+	// by the last call of Lock is lost. It is nil if not locked.
+	LockLost() <-chan struct{}
+}
+
+// LeaseStore is implemented by drivers keeping their lock in a table,
+// so they can use LeaseLock. Expiry times should be computed with the
+// clock of the database, so clock skew between hosts doesn't matter.
+type LeaseStore interface {
+	// AcquireLease stores a lease for owner which expires after ttl.
+	// An expired lease of another owner is taken over.
+	// Return ErrLocked if another owner holds a lease that hasn't expired.
+	AcquireLease(ctx context.Context, owner, hostname string, ttl time.Duration) error
+
+	// RenewLease sets the expiry of the lease of owner to ttl from now.
+	// Return ErrLeaseLost if owner doesn't hold the lease anymore.
+	RenewLease(ctx context.Context, owner string, ttl time.Duration) error
+
+	// ReleaseLease removes the lease of owner, if it still holds it.
+	ReleaseLease(ctx context.Context, owner string) error
+}
+
+// LeaseLock is a lock on a LeaseStore that doesn't stay held forever if
+// the process holding it dies. While locked, the lease is renewed in the
+// background every RenewInterval, so it only expires once nobody renews it.
+type LeaseLock struct {
+	store LeaseStore
+
+	// TTL defaults to DefaultLeaseTTL.
+	TTL time.Duration
+
+	// RenewInterval defaults to a third of TTL.
+	RenewInterval time.Duration
+
+	mu    sync.Mutex
+	owner string
+	stop  chan struct{}
+	done  chan struct{}
+	lost  chan struct{}
+
+	// renewErr is the error of the last renewal, if it failed.
+	// It is only read by Unlock once the heartbeat stopped.
+	renewErr error
+}
+
+// NewLeaseLock returns a LeaseLock on store.
+func NewLeaseLock(store LeaseStore) *LeaseLock {
+	return &LeaseLock{store: store}
+}
+
+// Owner returns the id of the current lease, empty if not locked.
+// It is unique per call of Lock.
+func (l *LeaseLock) Owner() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.owner
+}
+
+// Lock acquires a lease and starts renewing it.
+// It returns ErrLocked if another owner holds a lease that hasn't expired.
+func (l *LeaseLock) Lock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.owner != "" {
+		return ErrLocked
+	}
+
+	owner, err := newLeaseOwner()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+
+	ttl := l.ttl()
+	if err := l.store.AcquireLease(ctx, owner, hostname, ttl); err != nil {
+		return err
+	}
+
+	l.owner = owner
+	l.renewErr = nil
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	l.lost = make(chan struct{})
+	go l.heartbeat(owner, ttl, l.stop, l.done, l.lost)
+	return nil
+}
+
+// LockLost implements LockLossNotifier. The channel is closed
+// once renewing the lease failed with ErrLeaseLost.
+func (l *LeaseLock) LockLost() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owner == "" {
+		return nil
+	}
+	return l.lost
+}
+
+// Unlock stops renewing the lease and releases it. It returns ErrLeaseLost
+// if the lease was lost while it was held, or the error of the last renewal
+// if it failed, since the lease may have expired in the meantime.
+func (l *LeaseLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.owner == "" {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+
+	owner := l.owner
+	l.owner = ""
+
+	err := l.store.ReleaseLease(context.Background(), owner)
+	if l.renewErr != nil {
+		if err != nil {
+			return multierror.Append(l.renewErr, err)
+		}
+		return l.renewErr
+	}
+	return err
+}
+
+// heartbeat renews the lease of owner until stop is closed or the lease is
+// lost, which closes lost. Other errors are retried, since the lease may
+// still be renewed in time.
+func (l *LeaseLock) heartbeat(owner string, ttl time.Duration, stop <-chan struct{}, done, lost chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(l.renewInterval(ttl))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), ttl)
+			err := l.store.RenewLease(ctx, owner, ttl)
+			cancel()
+
+			l.renewErr = err
+			if err == ErrLeaseLost {
+				close(lost)
+				return
+			}
+		}
+	}
+}
+
+func (l *LeaseLock) ttl() time.Duration {
+	if l.TTL > 0 {
+		return l.TTL
+	}
+	return DefaultLeaseTTL
+}
+
+func (l *LeaseLock) renewInterval(ttl time.Duration) time.Duration {
+	if l.RenewInterval > 0 {
+		return l.RenewInterval
+	}
+	return ttl / 3
+}
+
+// newLeaseOwner returns a random id for a new lease.
+func newLeaseOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memLeaseStore is a LeaseStore keeping a single lease in memory.
+type memLeaseStore struct {
+	mu        sync.Mutex
+	owner     string
+	hostname  string
+	expiresAt time.Time
+	renewals  int
+	renewErr  error
+}
+
+func (s *memLeaseStore) AcquireLease(ctx context.Context, owner, hostname string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner != "" && time.Now().Before(s.expiresAt) {
+		return ErrLocked
+	}
+	s.owner, s.hostname, s.expiresAt = owner, hostname, time.Now().Add(ttl)
+	return nil
+}
+
+func (s *memLeaseStore) RenewLease(ctx context.Context, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner != owner {
+		return ErrLeaseLost
+	}
+	if s.renewErr != nil {
+		return s.renewErr
+	}
+	s.expiresAt = time.Now().Add(ttl)
+	s.renewals++
+	return nil
+}
+
+func (s *memLeaseStore) ReleaseLease(ctx context.Context, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == owner {
+		s.owner = ""
+	}
+	return nil
+}
+
+func (s *memLeaseStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiresAt = time.Now()
+}
+
+func (s *memLeaseStore) failRenewals(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renewErr = err
+}
+
+func (s *memLeaseStore) currentOwner() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owner
+}
+
+func (s *memLeaseStore) renewed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.renewals
+}
+
+func TestLeaseLock(t *testing.T) {
+	store := &memLeaseStore{}
+	l := NewLeaseLock(store)
+	l.TTL = time.Second
+	l.RenewInterval = 10 * time.Millisecond
+
+	if err := l.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Lock(context.Background()); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	other := NewLeaseLock(store)
+	if err := other.Lock(context.Background()); err != ErrLocked {
+		t.Fatalf("expected ErrLocked while the lease is held, got %v", err)
+	}
+
+	// the heartbeat keeps the lease
+	time.Sleep(50 * time.Millisecond)
+	if store.renewed() == 0 {
+		t.Error("expected the lease to be renewed")
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if l.Owner() != "" {
+		t.Error("expected no owner once unlocked")
+	}
+	if err := other.Lock(context.Background()); err != nil {
+		t.Fatalf("expected the lock to be acquired once released, got %v", err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseLockTakeover(t *testing.T) {
+	store := &memLeaseStore{}
+	l := NewLeaseLock(store)
+	l.TTL = time.Second
+	l.RenewInterval = 10 * time.Millisecond
+
+	if err := l.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lease expires, i.e. since the heartbeat was stalled, and is taken over
+	store.expire()
+	other := NewLeaseLock(store)
+	if err := other.Lock(context.Background()); err != nil {
+		t.Fatalf("expected an expired lease to be taken over, got %v", err)
+	}
+
+	select {
+	case <-l.LockLost():
+	case <-time.After(time.Second):
+		t.Fatal("expected the lock to be lost")
+	}
+	if err := l.Unlock(); err != ErrLeaseLost {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+	if store.currentOwner() != other.Owner() {
+		t.Error("expected the lease of the new owner to be kept")
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseLockRenewError(t *testing.T) {
+	store := &memLeaseStore{}
+	l := NewLeaseLock(store)
+	l.TTL = time.Second
+	l.RenewInterval = 10 * time.Millisecond
+
+	if l.LockLost() != nil {
+		t.Error("expected no channel while not locked")
+	}
+	if err := l.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed renewal doesn't lose the lock, but is reported by Unlock
+	renewErr := errors.New("connection reset")
+	store.failRenewals(renewErr)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-l.LockLost():
+		t.Fatal("expected the lock not to be lost")
+	default:
+	}
+	if err := l.Unlock(); err != renewErr {
+		t.Fatalf("expected the renew error, got %v", err)
+	}
+}
@@ -108,6 +108,42 @@ func (m *Mongo) SetVersion(version int, dirty bool) error {
 	return nil
 }
 
+// SetVersionIf saves the version unless the migrations collection was
+// changed by someone else, by replacing only the expected version document.
+// Expecting NilVersion inserts the document only if none exists, with an
+// upsert matching any document, or replaces the NilVersion document left by
+// a full down migration. Without a unique index, two upserts at the very
+// same time may still both insert.
+func (m *Mongo) SetVersionIf(ctx context.Context, expectedVersion int, expectedDirty bool, version int, dirty bool) error {
+	migrationsCollection := m.db.Collection(m.config.MigrationsCollection)
+
+	if expectedVersion == database.NilVersion {
+		res, err := migrationsCollection.UpdateOne(ctx, bson.M{},
+			bson.M{"$setOnInsert": bson.M{"version": version, "dirty": dirty}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return &database.Error{OrigErr: err, Err: "save version failed"}
+		}
+		if res.MatchedCount == 0 {
+			return nil
+		}
+		// a document exists, which may be the NilVersion one of SetVersion
+	}
+
+	res, err := migrationsCollection.ReplaceOne(ctx,
+		bson.M{"version": expectedVersion, "dirty": expectedDirty},
+		bson.M{"version": version, "dirty": dirty})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "save version failed"}
+	}
+	if res.MatchedCount == 0 {
+		e := database.ErrVersionConflict{ExpectedVersion: expectedVersion, ExpectedDirty: expectedDirty}
+		e.Version, e.Dirty, _ = m.Version()
+		return e
+	}
+	return nil
+}
+
 func (m *Mongo) Version() (version int, dirty bool, err error) {
 	var versionInfo versionInfo
 	err = m.db.Collection(m.config.MigrationsCollection).FindOne(context.TODO(), bson.M{}).Decode(&versionInfo)
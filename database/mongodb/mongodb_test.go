@@ -95,6 +95,7 @@ func Test(t *testing.T) {
 		//TestLockAndUnlock(t, d) driver doesn't support lock on database level
 		dt.TestRun(t, d, bytes.NewReader([]byte(`[{"insert":"hello","documents":[{"wild":"world"}]}]`)))
 		dt.TestSetVersion(t, d)
+		dt.TestSetVersionIf(t, d)
 		dt.TestDrop(t, d)
 	})
 }
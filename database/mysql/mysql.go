@@ -13,6 +13,7 @@ import (
 	nurl "net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 import (
@@ -22,6 +23,7 @@ import (
 
 import (
 	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/database/splitter"
 )
 
 func init() {
@@ -38,9 +40,15 @@ var (
 	ErrTLSCertKeyConfig = fmt.Errorf("To use TLS client authentication, both x-tls-cert and x-tls-key must not be empty")
 )
 
+// errBadField is the MySQL error number of a query on an unknown column.
+const errBadField = 1054
+
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+
+	// HistoryTable enables the migration history if not empty.
+	HistoryTable string
 }
 
 type Mysql struct {
@@ -50,6 +58,10 @@ type Mysql struct {
 	db       *sql.DB
 	isLocked bool
 
+	// hasProgressColumns is set once the migrations table is known
+	// to have the columns recording the statement progress
+	hasProgressColumns bool
+
 	config *Config
 }
 
@@ -96,6 +108,10 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, err
 	}
 
+	if err := mx.ensureHistoryTable(); err != nil {
+		return nil, err
+	}
+
 	return mx, nil
 }
 
@@ -207,6 +223,7 @@ func (m *Mysql) Open(url string) (database.Driver, error) {
 	mx, err := WithInstance(db, &Config{
 		DatabaseName:    config.DBName,
 		MigrationsTable: customParams["x-migrations-table"],
+		HistoryTable:    customParams["x-history-table"],
 	})
 	if err != nil {
 		return nil, err
@@ -224,29 +241,49 @@ func (m *Mysql) Close() error {
 	return nil
 }
 
+// Lock waits for the lock at most 10 seconds, then it fails with database.ErrLocked.
 func (m *Mysql) Lock() error {
 	if m.isLocked {
 		return database.ErrLocked
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(
-		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
-	if err != nil {
+	if err := database.TryLock(10*time.Second, m.tryLock); err != nil {
 		return err
 	}
 
-	query := "SELECT GET_LOCK(?, 10)"
-	var success bool
-	if err := m.conn.QueryRowContext(context.Background(), query, aid).Scan(&success); err != nil {
-		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	m.isLocked = true
+	return nil
+}
+
+// LockContext is like Lock, but waits for the lock until ctx is done.
+func (m *Mysql) LockContext(ctx context.Context) error {
+	if m.isLocked {
+		return database.ErrLocked
 	}
 
-	if success {
-		m.isLocked = true
-		return nil
+	if err := database.PollLock(ctx, time.Second, m.tryLock); err != nil {
+		return err
 	}
 
-	return database.ErrLocked
+	m.isLocked = true
+	return nil
+}
+
+// tryLock waits for the lock at most wait. GET_LOCK bounds the wait itself,
+// so it isn't canceled with a ctx, which could acquire the lock anyway.
+func (m *Mysql) tryLock(wait time.Duration) (bool, error) {
+	aid, err := database.GenerateAdvisoryLockId(
+		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
+	if err != nil {
+		return false, err
+	}
+
+	query := "SELECT GET_LOCK(?, ?)"
+	var success sql.NullBool
+	if err := m.conn.QueryRowContext(context.Background(), query, aid, wait.Seconds()).Scan(&success); err != nil {
+		return false, &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	}
+	return success.Valid && success.Bool, nil
 }
 
 func (m *Mysql) Unlock() error {
@@ -273,28 +310,125 @@ func (m *Mysql) Unlock() error {
 	return nil
 }
 
+// lockHolder returns the id of the connection holding the lock and a
+// description of it. id is 0 if the lock isn't held.
+func (m *Mysql) lockHolder() (id int64, owner string, err error) {
+	aid, err := database.GenerateAdvisoryLockId(
+		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
+	if err != nil {
+		return 0, "", err
+	}
+
+	query := "SELECT IS_USED_LOCK(?)"
+	var connID sql.NullInt64
+	if err := m.conn.QueryRowContext(context.Background(), query, aid).Scan(&connID); err != nil {
+		return 0, "", &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if !connID.Valid {
+		return 0, "", nil
+	}
+
+	owner = fmt.Sprintf("connection %v", connID.Int64)
+	query = "SELECT USER, HOST FROM information_schema.PROCESSLIST WHERE ID = ?"
+	var user, host string
+	err = m.conn.QueryRowContext(context.Background(), query, connID.Int64).Scan(&user, &host)
+	switch {
+	case err == sql.ErrNoRows:
+		// the connection ended in the meantime, or isn't visible without the PROCESS privilege
+	case err != nil:
+		return 0, "", &database.Error{OrigErr: err, Query: []byte(query)}
+	default:
+		owner += fmt.Sprintf(", user %v, host %v", user, host)
+	}
+	return connID.Int64, owner, nil
+}
+
+// LockStatus implements database.LockInspector.
+// MySQL doesn't record since when a lock is held, so since is always zero.
+func (m *Mysql) LockStatus() (held bool, owner string, since time.Time, err error) {
+	id, owner, err := m.lockHolder()
+	if err != nil {
+		return false, "", time.Time{}, err
+	}
+	return id != 0, owner, time.Time{}, nil
+}
+
+// ForceUnlock implements database.LockInspector. Named locks can only be
+// released by the connection holding them, so that connection is killed.
+func (m *Mysql) ForceUnlock() error {
+	if m.isLocked {
+		return m.Unlock()
+	}
+
+	id, _, err := m.lockHolder()
+	if err != nil || id == 0 {
+		return err
+	}
+
+	query := fmt.Sprintf("KILL CONNECTION %d", id)
+	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
 func (m *Mysql) Run(migration io.Reader) error {
+	return m.RunContext(context.Background(), migration)
+}
+
+// RunContext is like Run, but cancels the running migration once ctx is done.
+func (m *Mysql) RunContext(ctx context.Context, migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 
 	query := string(migr[:])
-	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+	if _, err := m.conn.ExecContext(ctx, query); err != nil {
 		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
 	}
 
 	return nil
 }
 
+// RunDirectives implements database.DirectiveRunner. A migration with the
+// split-statements directive is run statement by statement, which doesn't
+// need multiStatements=true. MySQL commits DDL implicitly, so the
+// no-transaction directive needs nothing special.
+func (m *Mysql) RunDirectives(ctx context.Context, migration io.Reader, directives database.Directives) error {
+	if !directives.SplitStatements {
+		return m.RunContext(ctx, migration)
+	}
+
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	stmts, err := m.SplitStatements(migr)
+	if err != nil {
+		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+	}
+	for _, stmt := range stmts {
+		if _, err := m.conn.ExecContext(ctx, string(stmt)); err != nil {
+			return database.Error{OrigErr: err, Err: "migration failed", Query: stmt}
+		}
+	}
+	return nil
+}
+
 func (m *Mysql) SetVersion(version int, dirty bool) error {
-	tx, err := m.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	return m.SetVersionContext(context.Background(), version, dirty)
+}
+
+// SetVersionContext is like SetVersion, but rolls back once ctx is done.
+func (m *Mysql) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	tx, err := m.conn.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
 	query := "TRUNCATE `" + m.config.MigrationsTable + "`"
-	if _, err := tx.ExecContext(context.Background(), query); err != nil {
+	if _, err := tx.ExecContext(ctx, query); err != nil {
 		if errRollback := tx.Rollback(); errRollback != nil {
 			err = multierror.Append(err, errRollback)
 		}
@@ -303,7 +437,7 @@ func (m *Mysql) SetVersion(version int, dirty bool) error {
 
 	if version >= 0 {
 		query := "INSERT INTO `" + m.config.MigrationsTable + "` (version, dirty) VALUES (?, ?)"
-		if _, err := tx.ExecContext(context.Background(), query, version, dirty); err != nil {
+		if _, err := tx.ExecContext(ctx, query, version, dirty); err != nil {
 			if errRollback := tx.Rollback(); errRollback != nil {
 				err = multierror.Append(err, errRollback)
 			}
@@ -318,6 +452,44 @@ func (m *Mysql) SetVersion(version int, dirty bool) error {
 	return nil
 }
 
+// SplitStatements implements database.ProgressDriver.
+func (m *Mysql) SplitStatements(migration []byte) ([][]byte, error) {
+	return splitter.Split(migration, splitter.MySQL)
+}
+
+// SetProgress implements database.ProgressDriver. The progress columns
+// are added to a migrations table of an older version on first use,
+// so the table is only altered if statements are tracked.
+func (m *Mysql) SetProgress(done, total int) error {
+	if err := m.ensureProgressColumns(); err != nil {
+		return err
+	}
+
+	query := "UPDATE `" + m.config.MigrationsTable + "` SET statements_done = ?, statements_total = ?"
+	if _, err := m.conn.ExecContext(context.Background(), query, done, total); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// Progress implements database.ProgressDriver.
+func (m *Mysql) Progress() (done, total int, err error) {
+	query := "SELECT statements_done, statements_total FROM `" + m.config.MigrationsTable + "` LIMIT 1"
+	err = m.conn.QueryRowContext(context.Background(), query).Scan(&done, &total)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, 0, nil
+	case err != nil:
+		// no progress columns yet, nothing was recorded
+		if e, ok := err.(*mysql.MySQLError); ok && e.Number == errBadField {
+			return 0, 0, nil
+		}
+		return 0, 0, &database.Error{OrigErr: err, Query: []byte(query)}
+	default:
+		return done, total, nil
+	}
+}
+
 func (m *Mysql) Version() (version int, dirty bool, err error) {
 	query := "SELECT version, dirty FROM `" + m.config.MigrationsTable + "` LIMIT 1"
 	err = m.conn.QueryRowContext(context.Background(), query).Scan(&version, &dirty)
@@ -338,6 +510,64 @@ func (m *Mysql) Version() (version int, dirty bool, err error) {
 	}
 }
 
+// historyTimeFormat is the layout used to read back DATETIME(6) columns
+// of the history table without relying on the parseTime DSN parameter.
+const historyTimeFormat = "2006-01-02 15:04:05.000000"
+
+func (m *Mysql) AddHistory(entry database.HistoryEntry) error {
+	if m.config.HistoryTable == "" {
+		return nil
+	}
+
+	query := "INSERT INTO `" + m.config.HistoryTable + "` (version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err := m.conn.ExecContext(context.Background(), query,
+		entry.Version, entry.TargetVersion, entry.Direction, entry.Identifier, entry.Checksum,
+		entry.StartedAt.UTC().Format(historyTimeFormat), entry.FinishedAt.UTC().Format(historyTimeFormat),
+		int64(entry.Duration/time.Millisecond), entry.AppliedBy, entry.Hostname, entry.Success); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+func (m *Mysql) History() (entries []database.HistoryEntry, err error) {
+	if m.config.HistoryTable == "" {
+		return nil, database.ErrNoHistory
+	}
+
+	query := "SELECT version, target_version, direction, identifier, checksum, DATE_FORMAT(started_at, '%Y-%m-%d %H:%i:%s.%f'), DATE_FORMAT(finished_at, '%Y-%m-%d %H:%i:%s.%f'), duration_ms, applied_by, hostname, success FROM `" + m.config.HistoryTable + "` ORDER BY id"
+	rows, err := m.conn.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	for rows.Next() {
+		var e database.HistoryEntry
+		var startedAt, finishedAt string
+		var durationMs int64
+		if err := rows.Scan(&e.Version, &e.TargetVersion, &e.Direction, &e.Identifier, &e.Checksum,
+			&startedAt, &finishedAt, &durationMs, &e.AppliedBy, &e.Hostname, &e.Success); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		if e.StartedAt, err = time.Parse(historyTimeFormat, startedAt); err != nil {
+			return nil, err
+		}
+		if e.FinishedAt, err = time.Parse(historyTimeFormat, finishedAt); err != nil {
+			return nil, err
+		}
+		e.Duration = time.Duration(durationMs) * time.Millisecond
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return entries, nil
+}
+
 func (m *Mysql) Drop() (err error) {
 	// select all tables
 	query := `SHOW TABLES LIKE '%'`
@@ -417,7 +647,62 @@ func (m *Mysql) ensureVersionTable() (err error) {
 	}
 
 	// if not, create the empty migration table
-	query = "CREATE TABLE `" + m.config.MigrationsTable + "` (version bigint not null primary key, dirty boolean not null)"
+	query = "CREATE TABLE `" + m.config.MigrationsTable + "` (version bigint not null primary key, dirty boolean not null, statements_done int not null default 0, statements_total int not null default 0)"
+	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	m.hasProgressColumns = true
+	return nil
+}
+
+// ensureProgressColumns adds the columns recording the statement
+// progress to a migrations table created by an older version.
+func (m *Mysql) ensureProgressColumns() error {
+	if m.hasProgressColumns {
+		return nil
+	}
+
+	var field, typ, null, key, extra string
+	var def sql.NullString
+	query := "SHOW COLUMNS FROM `" + m.config.MigrationsTable + "` LIKE 'statements_done'"
+	if err := m.conn.QueryRowContext(context.Background(), query).Scan(&field, &typ, &null, &key, &def, &extra); err != sql.ErrNoRows {
+		if err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		m.hasProgressColumns = true
+		return nil
+	}
+
+	query = "ALTER TABLE `" + m.config.MigrationsTable + "` ADD COLUMN statements_done int not null default 0, ADD COLUMN statements_total int not null default 0"
+	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	m.hasProgressColumns = true
+	return nil
+}
+
+// ensureHistoryTable creates the history table if the history is enabled
+// and the table doesn't exist yet. Like ensureVersionTable, it locks the database.
+func (m *Mysql) ensureHistoryTable() (err error) {
+	if m.config.HistoryTable == "" {
+		return nil
+	}
+
+	if err = m.Lock(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := m.Unlock(); e != nil {
+			if err == nil {
+				err = e
+			} else {
+				err = multierror.Append(err, e)
+			}
+		}
+	}()
+
+	query := "CREATE TABLE IF NOT EXISTS `" + m.config.HistoryTable + "` (id bigint not null auto_increment primary key, version bigint not null, target_version bigint not null, direction varchar(4) not null, identifier text not null, checksum varchar(255) not null, started_at datetime(6) not null, finished_at datetime(6) not null, duration_ms bigint not null, applied_by varchar(255) not null, hostname varchar(255) not null, success boolean not null)"
 	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
@@ -3,6 +3,7 @@
 package postgres
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
@@ -11,9 +12,11 @@ import (
 	nurl "net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/solvedata/migrate/v4"
 	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/database/splitter"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/lib/pq"
 )
@@ -37,6 +40,9 @@ type Config struct {
 	MigrationsTable string
 	DatabaseName    string
 	SchemaName      string
+
+	// HistoryTable enables the migration history if not empty.
+	HistoryTable string
 }
 
 type Postgres struct {
@@ -45,6 +51,9 @@ type Postgres struct {
 	db       *sql.DB
 	isLocked bool
 
+	// tx is the transaction started by Begin, if any
+	tx *sql.Tx
+
 	// Open and WithInstance need to guarantee that config is never nil
 	config *Config
 }
@@ -106,6 +115,10 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, err
 	}
 
+	if err := px.ensureHistoryTable(); err != nil {
+		return nil, err
+	}
+
 	return px, nil
 }
 
@@ -121,10 +134,12 @@ func (p *Postgres) Open(url string) (database.Driver, error) {
 	}
 
 	migrationsTable := purl.Query().Get("x-migrations-table")
+	historyTable := purl.Query().Get("x-history-table")
 
 	px, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		HistoryTable:    historyTable,
 	})
 
 	if err != nil {
@@ -145,6 +160,11 @@ func (p *Postgres) Close() error {
 
 // https://www.postgresql.org/docs/9.6/static/explicit-locking.html#ADVISORY-LOCKS
 func (p *Postgres) Lock() error {
+	return p.LockContext(context.Background())
+}
+
+// LockContext is like Lock, but waits for the advisory lock only until ctx is done.
+func (p *Postgres) LockContext(ctx context.Context) error {
 	if p.isLocked {
 		return database.ErrLocked
 	}
@@ -154,10 +174,18 @@ func (p *Postgres) Lock() error {
 		return err
 	}
 
-	// This will wait indefinitely until the lock can be acquired.
-	query := `SELECT pg_advisory_lock($1)`
-	if _, err := p.conn.ExecContext(context.Background(), query, aid); err != nil {
-		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	// pg_advisory_lock can't be canceled without the risk of acquiring the
+	// lock anyway, so poll until the lock is acquired or ctx is done
+	query := `SELECT pg_try_advisory_lock($1)`
+	err = database.PollLock(ctx, database.DefaultLockPollInterval, func(time.Duration) (bool, error) {
+		var locked bool
+		if err := p.conn.QueryRowContext(context.Background(), query, aid).Scan(&locked); err != nil {
+			return false, &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+		}
+		return locked, nil
+	})
+	if err != nil {
+		return err
 	}
 
 	p.isLocked = true
@@ -182,7 +210,80 @@ func (p *Postgres) Unlock() error {
 	return nil
 }
 
+// lockHolder returns the pid of the session holding the advisory lock,
+// a description of it and since when the session exists, or sql.ErrNoRows.
+func (p *Postgres) lockHolder() (pid int, owner string, since time.Time, err error) {
+	aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName, p.config.SchemaName)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+
+	// advisory locks on a bigint key are stored as classid (high bits), objid (low bits) and objsubid 1
+	query := `SELECT a.pid, COALESCE(a.usename, ''), COALESCE(host(a.client_addr), ''), a.application_name, a.backend_start
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.classid = 0 AND l.objid = $1 AND l.objsubid = 1
+		AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+		LIMIT 1`
+	var user, addr, application string
+	err = p.conn.QueryRowContext(context.Background(), query, aid).Scan(&pid, &user, &addr, &application, &since)
+	if err == sql.ErrNoRows {
+		return 0, "", time.Time{}, err
+	}
+	if err != nil {
+		return 0, "", time.Time{}, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	owner = fmt.Sprintf("pid %v, user %v", pid, user)
+	if addr != "" {
+		owner += ", client " + addr
+	}
+	if application != "" {
+		owner += ", application " + application
+	}
+	return pid, owner, since, nil
+}
+
+// LockStatus implements database.LockInspector. since is the time the
+// session holding the lock was started, the lock itself has no timestamp.
+func (p *Postgres) LockStatus() (held bool, owner string, since time.Time, err error) {
+	_, owner, since, err = p.lockHolder()
+	if err == sql.ErrNoRows {
+		return false, "", time.Time{}, nil
+	}
+	if err != nil {
+		return false, "", time.Time{}, err
+	}
+	return true, owner, since, nil
+}
+
+// ForceUnlock implements database.LockInspector. Advisory locks can only be
+// released by the session holding them, so that session is terminated.
+func (p *Postgres) ForceUnlock() error {
+	if p.isLocked {
+		return p.Unlock()
+	}
+
+	pid, _, _, err := p.lockHolder()
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT pg_terminate_backend($1)`
+	if _, err := p.conn.ExecContext(context.Background(), query, pid); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
 func (p *Postgres) Run(migration io.Reader) error {
+	return p.RunContext(context.Background(), migration)
+}
+
+// RunContext is like Run, but cancels the running migration once ctx is done.
+func (p *Postgres) RunContext(ctx context.Context, migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
@@ -190,7 +291,7 @@ func (p *Postgres) Run(migration io.Reader) error {
 
 	// run migration
 	query := string(migr[:])
-	if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
+	if _, err := p.executor().ExecContext(ctx, query); err != nil {
 		if pgErr, ok := err.(*pq.Error); ok {
 			var line uint
 			var col uint
@@ -215,6 +316,34 @@ func (p *Postgres) Run(migration io.Reader) error {
 	return nil
 }
 
+// RunDirectives implements database.DirectiveRunner. A migration with the
+// no-transaction or split-statements directive is run statement by
+// statement, as PostgreSQL runs a multi-statement query in an implicit
+// transaction, which rules out i.e. CREATE INDEX CONCURRENTLY.
+func (p *Postgres) RunDirectives(ctx context.Context, migration io.Reader, directives database.Directives) error {
+	if !directives.NoTransaction && !directives.SplitStatements {
+		return p.RunContext(ctx, migration)
+	}
+	if directives.NoTransaction && p.tx != nil {
+		return database.ErrTxInProgress
+	}
+
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	stmts, err := splitter.Split(migr, splitter.PostgreSQL)
+	if err != nil {
+		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+	}
+	for _, stmt := range stmts {
+		if err := p.RunContext(ctx, bytes.NewReader(stmt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func computeLineFromPos(s string, pos int) (line uint, col uint, ok bool) {
 	// replace crlf with lf
 	s = strings.Replace(s, "\r\n", "\n", -1)
@@ -251,39 +380,143 @@ func runesLastIndex(input []rune, target rune) int {
 }
 
 func (p *Postgres) SetVersion(version int, dirty bool) error {
-	tx, err := p.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	return p.SetVersionContext(context.Background(), version, dirty)
+}
+
+// SetVersionContext is like SetVersion, but rolls back once ctx is done.
+func (p *Postgres) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		return p.saveVersion(ctx, tx, version, dirty)
+	})
+}
+
+// SetVersionIf saves the version unless the migrations table was changed by
+// someone else. The table is locked against concurrent writes meanwhile.
+func (p *Postgres) SetVersionIf(ctx context.Context, expectedVersion int, expectedDirty bool, version int, dirty bool) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		query := `LOCK TABLE ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` IN EXCLUSIVE MODE`
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+
+		var curVersion int
+		var curDirty bool
+		query = `SELECT version, dirty FROM ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` LIMIT 1`
+		err := tx.QueryRowContext(ctx, query).Scan(&curVersion, &curDirty)
+		switch {
+		case err == sql.ErrNoRows:
+			curVersion, curDirty = database.NilVersion, false
+		case err != nil:
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+
+		if curVersion != expectedVersion || curDirty != expectedDirty {
+			return database.ErrVersionConflict{
+				ExpectedVersion: expectedVersion,
+				ExpectedDirty:   expectedDirty,
+				Version:         curVersion,
+				Dirty:           curDirty,
+			}
+		}
+		return p.saveVersion(ctx, tx, version, dirty)
+	})
+}
+
+// inTx calls f with the transaction started by Begin, which
+// already makes it atomic, or else within a new transaction.
+func (p *Postgres) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	if p.tx != nil {
+		return f(p.tx)
+	}
+
+	tx, err := p.conn.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
-	query := `TRUNCATE ` + pq.QuoteIdentifier(p.config.MigrationsTable)
-	if _, err := tx.Exec(query); err != nil {
+	if err := f(tx); err != nil {
 		if errRollback := tx.Rollback(); errRollback != nil {
 			err = multierror.Append(err, errRollback)
 		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+
+	return nil
+}
+
+// saveVersion replaces the version in the migrations table within tx.
+func (p *Postgres) saveVersion(ctx context.Context, tx *sql.Tx, version int, dirty bool) error {
+	query := `TRUNCATE ` + pq.QuoteIdentifier(p.config.MigrationsTable)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
 	if version >= 0 {
 		query = `INSERT INTO ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` (version, dirty) VALUES ($1, $2)`
-		if _, err := tx.Exec(query, version, dirty); err != nil {
-			if errRollback := tx.Rollback(); errRollback != nil {
-				err = multierror.Append(err, errRollback)
-			}
+		if _, err := tx.ExecContext(ctx, query, version, dirty); err != nil {
 			return &database.Error{OrigErr: err, Query: []byte(query)}
 		}
 	}
 
+	return nil
+}
+
+// Begin starts a transaction which Run, SetVersion, Version and
+// the history use until Commit or Rollback is called.
+func (p *Postgres) Begin() error {
+	if p.tx != nil {
+		return database.ErrTxInProgress
+	}
+
+	tx, err := p.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	p.tx = tx
+	return nil
+}
+
+func (p *Postgres) Commit() error {
+	if p.tx == nil {
+		return database.ErrNoTx
+	}
+
+	tx := p.tx
+	p.tx = nil
 	if err := tx.Commit(); err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
 	}
+	return nil
+}
 
+func (p *Postgres) Rollback() error {
+	if p.tx == nil {
+		return database.ErrNoTx
+	}
+
+	tx := p.tx
+	p.tx = nil
+	if err := tx.Rollback(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction rollback failed"}
+	}
 	return nil
 }
 
+// executor returns the transaction started by Begin, if any, or the connection.
+func (p *Postgres) executor() database.SQLExecutor {
+	if p.tx != nil {
+		return p.tx
+	}
+	return p.conn
+}
+
 func (p *Postgres) Version() (version int, dirty bool, err error) {
 	query := `SELECT version, dirty FROM ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` LIMIT 1`
-	err = p.conn.QueryRowContext(context.Background(), query).Scan(&version, &dirty)
+	err = p.executor().QueryRowContext(context.Background(), query).Scan(&version, &dirty)
 	switch {
 	case err == sql.ErrNoRows:
 		return database.NilVersion, false, nil
@@ -301,6 +534,53 @@ func (p *Postgres) Version() (version int, dirty bool, err error) {
 	}
 }
 
+func (p *Postgres) AddHistory(entry database.HistoryEntry) error {
+	if p.config.HistoryTable == "" {
+		return nil
+	}
+
+	query := `INSERT INTO ` + pq.QuoteIdentifier(p.config.HistoryTable) + ` (version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	if _, err := p.executor().ExecContext(context.Background(), query,
+		entry.Version, entry.TargetVersion, entry.Direction, entry.Identifier, entry.Checksum,
+		entry.StartedAt, entry.FinishedAt, int64(entry.Duration/time.Millisecond),
+		entry.AppliedBy, entry.Hostname, entry.Success); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+func (p *Postgres) History() (entries []database.HistoryEntry, err error) {
+	if p.config.HistoryTable == "" {
+		return nil, database.ErrNoHistory
+	}
+
+	query := `SELECT version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success FROM ` + pq.QuoteIdentifier(p.config.HistoryTable) + ` ORDER BY id`
+	rows, err := p.executor().QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	for rows.Next() {
+		var e database.HistoryEntry
+		var durationMs int64
+		if err := rows.Scan(&e.Version, &e.TargetVersion, &e.Direction, &e.Identifier, &e.Checksum,
+			&e.StartedAt, &e.FinishedAt, &durationMs, &e.AppliedBy, &e.Hostname, &e.Success); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		e.Duration = time.Duration(durationMs) * time.Millisecond
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return entries, nil
+}
+
 func (p *Postgres) Drop() (err error) {
 	// select all tables in current schema
 	query := `SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema()) AND table_type='BASE TABLE'`
@@ -364,3 +644,32 @@ func (p *Postgres) ensureVersionTable() (err error) {
 
 	return nil
 }
+
+// ensureHistoryTable creates the history table if the history is enabled
+// and the table doesn't exist yet. Like ensureVersionTable, it locks the database.
+func (p *Postgres) ensureHistoryTable() (err error) {
+	if p.config.HistoryTable == "" {
+		return nil
+	}
+
+	if err = p.Lock(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := p.Unlock(); e != nil {
+			if err == nil {
+				err = e
+			} else {
+				err = multierror.Append(err, e)
+			}
+		}
+	}()
+
+	query := `CREATE TABLE IF NOT EXISTS ` + pq.QuoteIdentifier(p.config.HistoryTable) + ` (id bigserial primary key, version bigint not null, target_version bigint not null, direction varchar(4) not null, identifier text not null, checksum text not null, started_at timestamp with time zone not null, finished_at timestamp with time zone not null, duration_ms bigint not null, applied_by text not null, hostname text not null, success boolean not null)`
+	if _, err = p.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package database
+
+// ProgressDriver is an optional interface a Driver can implement to run
+// migrations statement by statement and record how many statements of the
+// migration to the dirty version succeeded, so that a migration that failed
+// halfway can be resumed instead of being fixed by hand. It is most useful
+// for databases like MySQL that commit DDL statements implicitly.
+type ProgressDriver interface {
+	// SplitStatements splits a migration into statements
+	// that Run can run one at a time.
+	SplitStatements(migration []byte) ([][]byte, error)
+
+	// SetProgress records that the first done of total statements of
+	// the migration to the current version succeeded. SetVersion must
+	// reset the progress.
+	SetProgress(done, total int) error
+
+	// Progress returns what SetProgress recorded since the
+	// version was set last. total is 0 if nothing was recorded.
+	Progress() (done, total int, err error)
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/solvedata/migrate/v4"
 	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/database/splitter"
 
 	"github.com/hashicorp/go-multierror"
 	"google.golang.org/api/iterator"
@@ -142,7 +143,10 @@ func (s *Spanner) Run(migration io.Reader) error {
 	}
 
 	// run migration
-	stmts := migrationStatements(migr)
+	stmts, err := migrationStatements(migr)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+	}
 	ctx := context.Background()
 
 	op, err := s.db.admin.UpdateDatabaseDdl(ctx, &adminpb.UpdateDatabaseDdlRequest{
@@ -302,17 +306,6 @@ func (s *Spanner) ensureVersionTable() (err error) {
 	return nil
 }
 
-func migrationStatements(migration []byte) []string {
-	migrationString := string(migration[:])
-	migrationString = strings.TrimSpace(migrationString)
-
-	allStatements := strings.Split(migrationString, ";")
-	nonEmptyStatements := allStatements[:0]
-	for _, s := range allStatements {
-		s = strings.TrimSpace(s)
-		if s != "" {
-			nonEmptyStatements = append(nonEmptyStatements, s)
-		}
-	}
-	return nonEmptyStatements
+func migrationStatements(migration []byte) ([]string, error) {
+	return splitter.SplitString(string(migration), splitter.GoogleSQL)
 }
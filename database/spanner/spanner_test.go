@@ -120,7 +120,11 @@ CREATE INDEX table_name_id_idx ON table_name (id)`,
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			if stmts := migrationStatements([]byte(tc.multiStatement)); !assert.Equal(t, stmts, tc.expected) {
+			stmts, err := migrationStatements([]byte(tc.multiStatement))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !assert.Equal(t, stmts, tc.expected) {
 				t.Error()
 			}
 		})
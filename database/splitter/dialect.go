@@ -0,0 +1,117 @@
+package splitter
+
+// Dialect describes the lexical rules of a SQL dialect
+// that matter for finding the end of a statement.
+type Dialect struct {
+	// BackslashEscapes makes a backslash escape the next character
+	// in quoted strings and identifiers, except in backtick quotes.
+	BackslashEscapes bool
+
+	// EscapeStrings makes a backslash escape the next character
+	// in E'...' strings only (PostgreSQL).
+	EscapeStrings bool
+
+	// TripleQuotes enables '''...''' and """...""" strings (GoogleSQL).
+	TripleQuotes bool
+
+	// BacktickQuotes enables `...` quoted identifiers.
+	BacktickQuotes bool
+
+	// BracketQuotes enables [...] quoted identifiers (T-SQL).
+	BracketQuotes bool
+
+	// DollarQuotes enables $tag$...$tag$ and $$...$$ strings.
+	DollarQuotes bool
+
+	// HashComments enables # line comments.
+	HashComments bool
+
+	// SlashComments enables // line comments (CQL).
+	SlashComments bool
+
+	// DashCommentsNeedSpace only starts a -- comment if it is followed
+	// by whitespace, so 1--1 is an expression (MySQL).
+	DashCommentsNeedSpace bool
+
+	// NestedComments makes /* */ comments nest.
+	NestedComments bool
+
+	// Blocks keeps BEGIN ... END and CASE ... END blocks, like the body of a
+	// trigger, in one statement. BEGIN starting a transaction isn't a block,
+	// nor is BEGIN used as an identifier: it only opens a block if it starts
+	// the statement, is part of CREATE PROCEDURE, FUNCTION, TRIGGER or EVENT,
+	// is nested in a block or followed by ATOMIC.
+	// Blocks aren't tracked while the terminator isn't a semicolon.
+	Blocks bool
+
+	// Batches keeps BEGIN BATCH ... APPLY BATCH in one statement (CQL).
+	Batches bool
+
+	// DelimiterCommand enables the DELIMITER command of the mysql
+	// client, which changes the terminator up to the end of the line.
+	DelimiterCommand bool
+
+	// SetTerm enables the SET TERM command of Firebird's isql,
+	// which changes the terminator, i.e. SET TERM ^ ;
+	SetTerm bool
+
+	// BatchSeparator splits at lines consisting of only this word,
+	// optionally followed by a count, instead of at semicolons (T-SQL GO).
+	// A batch followed by a count is repeated count times.
+	BatchSeparator string
+}
+
+var (
+	// Standard is standard SQL, also fine for SQLite.
+	Standard = Dialect{Blocks: true}
+
+	// PostgreSQL also skips dollar quoted strings, i.e. function bodies.
+	PostgreSQL = Dialect{
+		EscapeStrings:  true,
+		DollarQuotes:   true,
+		NestedComments: true,
+		Blocks:         true,
+	}
+
+	// MySQL also supports the DELIMITER command.
+	MySQL = Dialect{
+		BackslashEscapes:      true,
+		BacktickQuotes:        true,
+		HashComments:          true,
+		DashCommentsNeedSpace: true,
+		DelimiterCommand:      true,
+		Blocks:                true,
+	}
+
+	// TSQL splits into batches at GO lines, like sqlcmd.
+	TSQL = Dialect{
+		BracketQuotes:  true,
+		NestedComments: true,
+		BatchSeparator: "GO",
+	}
+
+	// Firebird supports the SET TERM command.
+	Firebird = Dialect{SetTerm: true}
+
+	// CQL is the Cassandra Query Language.
+	CQL = Dialect{
+		DollarQuotes:  true,
+		SlashComments: true,
+		Batches:       true,
+	}
+
+	// ClickHouse is the SQL dialect of ClickHouse.
+	ClickHouse = Dialect{
+		BackslashEscapes: true,
+		BacktickQuotes:   true,
+		HashComments:     true,
+	}
+
+	// GoogleSQL is the SQL dialect of Cloud Spanner.
+	GoogleSQL = Dialect{
+		BackslashEscapes: true,
+		TripleQuotes:     true,
+		BacktickQuotes:   true,
+		HashComments:     true,
+	}
+)
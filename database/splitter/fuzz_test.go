@@ -0,0 +1,64 @@
+//go:build go1.18
+// +build go1.18
+
+package splitter
+
+import (
+	"bytes"
+	"testing"
+)
+
+var fuzzDialects = map[string]Dialect{
+	"standard":   Standard,
+	"postgres":   PostgreSQL,
+	"mysql":      MySQL,
+	"tsql":       TSQL,
+	"firebird":   Firebird,
+	"cql":        CQL,
+	"clickhouse": ClickHouse,
+	"googlesql":  GoogleSQL,
+}
+
+func FuzzSplit(f *testing.F) {
+	f.Add([]byte("CREATE TABLE a (id int);\nINSERT INTO a VALUES ('x;y');"))
+	f.Add([]byte("CREATE TRIGGER t AFTER INSERT ON a BEGIN SELECT 1; END; -- done"))
+	f.Add([]byte("DO $tag$ BEGIN RETURN; END $tag$; /* a /* b */ */ SELECT E'\\''"))
+	f.Add([]byte("DELIMITER //\nSELECT 1; END//\nDELIMITER ;\nSELECT `a;b` # c"))
+	f.Add([]byte("SELECT [a;b]\nGO 2\nSET TERM ^ ;\nSELECT 1^\nSET TERM ; ^"))
+	f.Add([]byte("BEGIN BATCH INSERT INTO a (id) VALUES (1); APPLY BATCH; // x"))
+
+	f.Fuzz(func(t *testing.T, migration []byte) {
+		for name, d := range fuzzDialects {
+			stmts, err := Split(migration, d)
+			if err != nil {
+				if _, ok := err.(*Error); !ok {
+					t.Fatalf("%v: expected an *Error, got %T: %v", name, err, err)
+				}
+				continue
+			}
+			for _, stmt := range stmts {
+				if len(stmt) == 0 || !bytes.Equal(stmt, bytes.TrimSpace(stmt)) {
+					t.Fatalf("%v: expected trimmed statements, got %q", name, stmt)
+				}
+				if !bytes.Contains(migration, stmt) {
+					t.Fatalf("%v: statement %q isn't part of the migration", name, stmt)
+				}
+			}
+		}
+
+		// splitting the statements again doesn't split them any further
+		stmts, err := Split(migration, Standard)
+		if err != nil {
+			return
+		}
+		for _, stmt := range stmts {
+			again, err := Split(stmt, Standard)
+			if err != nil {
+				t.Fatalf("statement %q can't be split again: %v", stmt, err)
+			}
+			if len(again) != 1 || !bytes.Equal(again[0], stmt) {
+				t.Fatalf("statement %q was split again into %q", stmt, again)
+			}
+		}
+	})
+}
@@ -0,0 +1,499 @@
+// Package splitter splits migrations into statements, for database drivers
+// that can only run one statement at a time or run them one by one.
+// Terminators inside strings, quoted identifiers, comments and blocks like
+// trigger bodies don't split, according to the Dialect of the database.
+package splitter
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Error is returned for a migration that can't be split,
+// i.e. since a string or comment isn't terminated.
+type Error struct {
+	// Line is the 1-based line number where the problem starts.
+	Line int
+	Err  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %v: %v", e.Line, e.Err)
+}
+
+// Split splits migration into statements according to d. Statements are
+// returned without their terminator and surrounding whitespace. Statements
+// that consist of comments only are dropped, as are the commands changing
+// the terminator.
+func Split(migration []byte, d Dialect) ([][]byte, error) {
+	s := &splitter{src: migration, d: d, term: []byte(";"), stmts: make([][]byte, 0)}
+	if err := s.split(); err != nil {
+		return nil, err
+	}
+	return s.stmts, nil
+}
+
+// SplitString is like Split for strings.
+func SplitString(migration string, d Dialect) ([]string, error) {
+	stmts, err := Split([]byte(migration), d)
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		strs = append(strs, string(stmt))
+	}
+	return strs, nil
+}
+
+var (
+	delimiterRe = regexp.MustCompile(`^(?i:DELIMITER)[ \t]+(\S+)[^\n]*`)
+	setTermRe   = regexp.MustCompile(`^(?i:SET\s+TERM)\s+(\S+)`)
+	batchSepRe  = regexp.MustCompile(`^[ \t]*(\w+)(?:[ \t]+(\d+))?[ \t]*(?:--[^\n]*)?(?:\r?\n|$)`)
+)
+
+// words after BEGIN that start a transaction rather than a block
+var beginTxWords = map[string]bool{
+	"TRANSACTION": true, "TRAN": true, "WORK": true, "DEFERRED": true,
+	"IMMEDIATE": true, "EXCLUSIVE": true, "ISOLATION": true, "READ": true,
+	"DISTRIBUTED": true,
+}
+
+// words after CREATE or ALTER that define a routine, whose body may be a
+// BEGIN ... END block anywhere in the statement, i.e. after AS or FOR EACH ROW
+var routineWords = map[string]bool{
+	"PROCEDURE": true, "FUNCTION": true, "TRIGGER": true, "EVENT": true,
+}
+
+// words after END that close a statement which isn't counted as a block
+var endStmtWords = map[string]bool{
+	"IF": true, "LOOP": true, "WHILE": true, "REPEAT": true, "FOR": true,
+}
+
+// words after BEGIN that start a CQL batch
+var beginBatchWords = map[string]bool{
+	"BATCH": true, "UNLOGGED": true, "COUNTER": true,
+}
+
+type splitter struct {
+	src []byte
+	d   Dialect
+
+	// term is the current terminator
+	term []byte
+
+	pos   int
+	stmts [][]byte
+
+	// start is the position of the current statement, which contains
+	// more than whitespace and comments if hasCode is set
+	start   int
+	hasCode bool
+
+	// first is the first word of the current statement in upper case,
+	// routine is set once it turned out to define a routine
+	first   string
+	routine bool
+
+	// last is the last byte of code before pos
+	last byte
+
+	// parens is the number of parentheses open at pos
+	parens int
+
+	// depth is the number of blocks open at pos, the outermost one
+	// starting at blockStart
+	depth      int
+	blockStart int
+}
+
+func (s *splitter) split() error {
+	for s.pos < len(s.src) {
+		if s.d.BatchSeparator != "" && s.atLineStart() {
+			if s.batchSeparator() {
+				continue
+			}
+		}
+
+		c := s.src[s.pos]
+		switch {
+		case isSpace(c):
+			s.pos++
+
+		case s.lineCommentAt(s.pos):
+			s.pos = lineEnd(s.src, s.pos)
+
+		case bytes.HasPrefix(s.src[s.pos:], []byte("/*")):
+			// MySQL executable comments and optimizer hints are code
+			if bytes.HasPrefix(s.src[s.pos:], []byte("/*!")) || bytes.HasPrefix(s.src[s.pos:], []byte("/*+")) {
+				s.hasCode = true
+			}
+			end, ok := s.blockCommentEnd(s.pos)
+			if !ok {
+				return s.errorf(s.pos, "unterminated comment")
+			}
+			s.pos = end
+
+		case s.d.BatchSeparator == "" && bytes.HasPrefix(s.src[s.pos:], s.term) &&
+			(s.depth == 0 || !s.tracksBlocks()):
+			s.emit(s.pos, 1)
+			s.pos += len(s.term)
+			s.start = s.pos
+
+		case s.quoteAt(s.pos):
+			end, ok := s.quoteEnd(s.pos)
+			if !ok {
+				return s.errorf(s.pos, "unterminated quote")
+			}
+			s.hasCode = true
+			s.last = c
+			s.pos = end
+
+		case isWordStart(c):
+			if !s.hasCode && s.terminatorCommand() {
+				continue
+			}
+			s.word()
+
+		default:
+			switch {
+			case c == '(':
+				s.parens++
+			case c == ')' && s.parens > 0:
+				s.parens--
+			}
+			s.hasCode = true
+			s.last = c
+			s.pos++
+		}
+	}
+
+	if s.depth > 0 && s.hasCode {
+		return s.errorf(s.blockStart, "unterminated block")
+	}
+	s.emit(len(s.src), 1)
+	return nil
+}
+
+// emit appends the current statement up to end n times, if it has code.
+func (s *splitter) emit(end int, n int) {
+	if s.hasCode {
+		stmt := bytes.TrimSpace(s.src[s.start:end])
+		for i := 0; i < n; i++ {
+			s.stmts = append(s.stmts, stmt)
+		}
+	}
+	s.hasCode = false
+	s.first, s.routine = "", false
+	s.last = 0
+	s.parens = 0
+	s.depth = 0
+}
+
+func (s *splitter) errorf(pos int, format string, v ...interface{}) error {
+	return &Error{Line: bytes.Count(s.src[:pos], []byte("\n")) + 1, Err: fmt.Sprintf(format, v...)}
+}
+
+func (s *splitter) atLineStart() bool {
+	return s.pos == 0 || s.src[s.pos-1] == '\n'
+}
+
+// batchSeparator emits the current batch if a separator line starts at pos.
+func (s *splitter) batchSeparator() bool {
+	m := batchSepRe.FindSubmatchIndex(s.src[s.pos:])
+	if m == nil || !strings.EqualFold(string(s.src[s.pos+m[2]:s.pos+m[3]]), s.d.BatchSeparator) {
+		return false
+	}
+
+	n := 1
+	if m[4] >= 0 {
+		count, err := strconv.Atoi(string(s.src[s.pos+m[4] : s.pos+m[5]]))
+		if err != nil || count < 1 {
+			return false
+		}
+		n = count
+	}
+
+	s.emit(s.pos, n)
+	s.pos += m[1]
+	s.start = s.pos
+	return true
+}
+
+// terminatorCommand changes the terminator if a command doing so starts at pos.
+// The command isn't part of any statement.
+func (s *splitter) terminatorCommand() bool {
+	var term []byte
+	end := -1
+
+	if s.d.DelimiterCommand {
+		if m := delimiterRe.FindSubmatchIndex(s.src[s.pos:]); m != nil {
+			term = s.src[s.pos+m[2] : s.pos+m[3]]
+			end = s.pos + m[1]
+		}
+	}
+	if s.d.SetTerm {
+		if m := setTermRe.FindSubmatchIndex(s.src[s.pos:]); m != nil {
+			// the command itself ends with the current terminator,
+			// which may follow the new one without whitespace
+			term = bytes.TrimSuffix(s.src[s.pos+m[2]:s.pos+m[3]], s.term)
+			rest := bytes.TrimLeft(s.src[s.pos+m[2]+len(term):], " \t\r\n")
+			if len(term) > 0 && bytes.HasPrefix(rest, s.term) {
+				end = len(s.src) - len(rest) + len(s.term)
+			}
+		}
+	}
+	if end < 0 {
+		return false
+	}
+
+	s.term = append([]byte(nil), term...)
+	s.pos = end
+	s.start = end
+	return true
+}
+
+func (s *splitter) tracksBlocks() bool {
+	return (s.d.Blocks || s.d.Batches) && bytes.Equal(s.term, []byte(";"))
+}
+
+// word skips the word at pos, tracking the blocks it opens or closes.
+func (s *splitter) word() {
+	start := s.pos
+	end := wordEnd(s.src, s.pos)
+	w := strings.ToUpper(string(s.src[s.pos:end]))
+	first := !s.hasCode
+	qualified := s.last == '.'
+	s.hasCode = true
+	s.last = s.src[end-1]
+	s.pos = end
+
+	if first {
+		s.first = w
+	}
+	if (s.first == "CREATE" || s.first == "ALTER") && routineWords[w] && s.parens == 0 {
+		s.routine = true
+	}
+
+	if !s.tracksBlocks() {
+		return
+	}
+
+	switch {
+	case s.d.Blocks && w == "CASE":
+		s.open(start)
+
+	case s.d.Blocks && w == "BEGIN":
+		// BEGIN may be an identifier, i.e. a column name, unless
+		// it starts the statement or the body of a routine or block
+		next, _ := s.nextWord()
+		if next != "" && !beginTxWords[next] && !qualified && s.parens == 0 &&
+			(first || s.routine || s.depth > 0 || next == "ATOMIC") {
+			s.open(start)
+		}
+
+	case s.d.Blocks && w == "END" && s.depth > 0:
+		next, nextEnd := s.nextWord()
+		if endStmtWords[next] {
+			return
+		}
+		if next == "CASE" {
+			s.pos = nextEnd
+		}
+		s.depth--
+
+	case s.d.Batches && w == "BEGIN":
+		if next, _ := s.nextWord(); beginBatchWords[next] {
+			s.open(start)
+		}
+
+	case s.d.Batches && w == "APPLY" && s.depth > 0:
+		if next, nextEnd := s.nextWord(); next == "BATCH" {
+			s.pos = nextEnd
+			s.depth--
+		}
+	}
+}
+
+// open opens a block starting at pos.
+func (s *splitter) open(pos int) {
+	if s.depth == 0 {
+		s.blockStart = pos
+	}
+	s.depth++
+}
+
+// nextWord returns the next word after pos in upper case and its end,
+// skipping whitespace and comments. It is empty if something else follows.
+func (s *splitter) nextWord() (string, int) {
+	pos := s.pos
+	for pos < len(s.src) {
+		switch {
+		case isSpace(s.src[pos]):
+			pos++
+		case s.lineCommentAt(pos):
+			pos = lineEnd(s.src, pos)
+		case bytes.HasPrefix(s.src[pos:], []byte("/*")):
+			end, ok := s.blockCommentEnd(pos)
+			if !ok {
+				return "", pos
+			}
+			pos = end
+		case isWordStart(s.src[pos]):
+			end := wordEnd(s.src, pos)
+			return strings.ToUpper(string(s.src[pos:end])), end
+		default:
+			return "", pos
+		}
+	}
+	return "", pos
+}
+
+func (s *splitter) lineCommentAt(pos int) bool {
+	rest := s.src[pos:]
+	switch {
+	case bytes.HasPrefix(rest, []byte("--")):
+		return !s.d.DashCommentsNeedSpace || len(rest) == 2 || isSpace(rest[2])
+	case s.d.HashComments && rest[0] == '#':
+		return true
+	case s.d.SlashComments && bytes.HasPrefix(rest, []byte("//")):
+		return true
+	}
+	return false
+}
+
+// blockCommentEnd returns the position after the /* */ comment at pos.
+func (s *splitter) blockCommentEnd(pos int) (int, bool) {
+	depth := 0
+	for pos < len(s.src) {
+		switch {
+		case bytes.HasPrefix(s.src[pos:], []byte("/*")):
+			if depth == 0 || s.d.NestedComments {
+				depth++
+			}
+			pos += 2
+		case bytes.HasPrefix(s.src[pos:], []byte("*/")):
+			depth--
+			pos += 2
+			if depth == 0 {
+				return pos, true
+			}
+		default:
+			pos++
+		}
+	}
+	return pos, false
+}
+
+func (s *splitter) quoteAt(pos int) bool {
+	switch s.src[pos] {
+	case '\'', '"':
+		return true
+	case '`':
+		return s.d.BacktickQuotes
+	case '[':
+		return s.d.BracketQuotes
+	case '$':
+		_, ok := s.dollarTag(pos)
+		return ok
+	}
+	return false
+}
+
+// quoteEnd returns the position after the string or quoted identifier at pos.
+func (s *splitter) quoteEnd(pos int) (int, bool) {
+	open := s.src[pos]
+	switch {
+	case open == '$':
+		tag, _ := s.dollarTag(pos)
+		end := bytes.Index(s.src[pos+len(tag):], tag)
+		if end < 0 {
+			return len(s.src), false
+		}
+		return pos + len(tag) + end + len(tag), true
+
+	case open == '[':
+		end := bytes.IndexByte(s.src[pos+1:], ']')
+		if end < 0 {
+			return len(s.src), false
+		}
+		return pos + 1 + end + 1, true
+	}
+
+	quote := s.src[pos : pos+1]
+	if s.d.TripleQuotes && open != '`' && bytes.HasPrefix(s.src[pos:], bytes.Repeat(quote, 3)) {
+		quote = s.src[pos : pos+3]
+	}
+
+	escapes := open != '`' && (s.d.BackslashEscapes || s.d.EscapeStrings && s.escapeString(pos))
+	for i := pos + len(quote); i < len(s.src); i++ {
+		switch {
+		case escapes && s.src[i] == '\\':
+			i++
+		case bytes.HasPrefix(s.src[i:], quote):
+			return i + len(quote), true
+		}
+	}
+	return len(s.src), false
+}
+
+// escapeString returns whether the quote at pos starts an E'...' string.
+func (s *splitter) escapeString(pos int) bool {
+	if s.src[pos] != '\'' || pos == 0 || (s.src[pos-1] != 'E' && s.src[pos-1] != 'e') {
+		return false
+	}
+	return pos == 1 || !isWordByte(s.src[pos-2])
+}
+
+// dollarTag returns the $tag$ starting at pos, if any. Tags can't start
+// with a digit, so positional parameters like $1 aren't dollar quotes.
+func (s *splitter) dollarTag(pos int) ([]byte, bool) {
+	if !s.d.DollarQuotes || s.src[pos] != '$' {
+		return nil, false
+	}
+	for i := pos + 1; i < len(s.src); i++ {
+		c := s.src[i]
+		switch {
+		case c == '$':
+			return s.src[pos : i+1], true
+		case c >= '0' && c <= '9':
+			if i == pos+1 {
+				return nil, false
+			}
+		case !isWordByte(c):
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isWordStart(c byte) bool {
+	return isWordByte(c) && c != '$'
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '$' || c >= 0x80
+}
+
+func wordEnd(src []byte, pos int) int {
+	for pos < len(src) && isWordByte(src[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// lineEnd returns the position of the newline ending the line at pos.
+func lineEnd(src []byte, pos int) int {
+	if i := bytes.IndexByte(src[pos:], '\n'); i >= 0 {
+		return pos + i
+	}
+	return len(src)
+}
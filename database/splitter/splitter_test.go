@@ -0,0 +1,200 @@
+package splitter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	testCases := []struct {
+		name      string
+		dialect   Dialect
+		migration string
+		expected  []string
+	}{
+		{name: "empty", dialect: Standard, migration: "", expected: []string{}},
+		{name: "whitespace only", dialect: Standard, migration: " \n\t;\n;", expected: []string{}},
+		{name: "no terminator", dialect: Standard, migration: "SELECT 1", expected: []string{"SELECT 1"}},
+		{
+			name:      "multiple statements",
+			dialect:   Standard,
+			migration: "CREATE TABLE a (id int);\n\nCREATE TABLE b (id int);\n",
+			expected:  []string{"CREATE TABLE a (id int)", "CREATE TABLE b (id int)"},
+		},
+		{
+			name:      "semicolons in strings and identifiers",
+			dialect:   Standard,
+			migration: `INSERT INTO "a;b" VALUES ('x;y', 'it''s;');SELECT 2`,
+			expected:  []string{`INSERT INTO "a;b" VALUES ('x;y', 'it''s;')`, "SELECT 2"},
+		},
+		{
+			name:      "semicolons in comments",
+			dialect:   Standard,
+			migration: "-- first; statement\nSELECT 1; /* second; */ SELECT 2;",
+			expected:  []string{"-- first; statement\nSELECT 1", "/* second; */ SELECT 2"},
+		},
+		{
+			name:      "comment only statements are dropped",
+			dialect:   Standard,
+			migration: "SELECT 1;\n-- the end\n/* really */",
+			expected:  []string{"SELECT 1"},
+		},
+		{
+			name:      "standard strings have no backslash escapes",
+			dialect:   Standard,
+			migration: `SELECT 'C:\'; SELECT 2`,
+			expected:  []string{`SELECT 'C:\'`, "SELECT 2"},
+		},
+		{
+			name:      "trigger body",
+			dialect:   Standard,
+			migration: "CREATE TRIGGER t AFTER INSERT ON a BEGIN\n  INSERT INTO b VALUES (1);\n  UPDATE c SET n = CASE WHEN n > 0 THEN n ELSE 0 END;\nEND;\nSELECT 1;",
+			expected:  []string{"CREATE TRIGGER t AFTER INSERT ON a BEGIN\n  INSERT INTO b VALUES (1);\n  UPDATE c SET n = CASE WHEN n > 0 THEN n ELSE 0 END;\nEND", "SELECT 1"},
+		},
+		{
+			name:      "transactions aren't blocks",
+			dialect:   Standard,
+			migration: "BEGIN; CREATE TABLE a (id int); COMMIT; BEGIN TRANSACTION; SELECT 1; END;",
+			expected:  []string{"BEGIN", "CREATE TABLE a (id int)", "COMMIT", "BEGIN TRANSACTION", "SELECT 1", "END"},
+		},
+		{
+			name:      "begin as a column name",
+			dialect:   Standard,
+			migration: "CREATE TABLE t (begin int, x int);\nINSERT INTO t (begin, x) VALUES (1, 2);",
+			expected:  []string{"CREATE TABLE t (begin int, x int)", "INSERT INTO t (begin, x) VALUES (1, 2)"},
+		},
+		{
+			name:      "begin as a selected column",
+			dialect:   Standard,
+			migration: "SELECT begin FROM t;\nSELECT 1;",
+			expected:  []string{"SELECT begin FROM t", "SELECT 1"},
+		},
+		{
+			name:      "begin in a trigger condition",
+			dialect:   Standard,
+			migration: "CREATE TRIGGER t AFTER INSERT ON a FOR EACH ROW WHEN NEW.begin > 0 BEGIN\n  SELECT 1;\nEND;\nSELECT 2;",
+			expected:  []string{"CREATE TRIGGER t AFTER INSERT ON a FOR EACH ROW WHEN NEW.begin > 0 BEGIN\n  SELECT 1;\nEND", "SELECT 2"},
+		},
+		{
+			name:      "unterminated block",
+			dialect:   Standard,
+			migration: "SELECT 1;\nCREATE TRIGGER t AFTER INSERT ON a BEGIN\n  SELECT 1;",
+		},
+		{
+			name:      "unterminated string",
+			dialect:   Standard,
+			migration: "SELECT 1;\nSELECT 'oops;",
+		},
+		{
+			name:      "unterminated comment",
+			dialect:   Standard,
+			migration: "SELECT 1 /* oops;",
+		},
+		{
+			name:      "postgres dollar quotes",
+			dialect:   PostgreSQL,
+			migration: "CREATE FUNCTION f() RETURNS int AS $body$\nBEGIN\n  RETURN 1;\nEND;\n$body$ LANGUAGE plpgsql;\nDO $$ BEGIN PERFORM f(); END $$;",
+			expected:  []string{"CREATE FUNCTION f() RETURNS int AS $body$\nBEGIN\n  RETURN 1;\nEND;\n$body$ LANGUAGE plpgsql", "DO $$ BEGIN PERFORM f(); END $$"},
+		},
+		{
+			name:      "postgres positional parameters and identifiers with dollars",
+			dialect:   PostgreSQL,
+			migration: "PREPARE p AS SELECT $1; SELECT a$b$ FROM t;",
+			expected:  []string{"PREPARE p AS SELECT $1", "SELECT a$b$ FROM t"},
+		},
+		{
+			name:      "postgres escape strings and nested comments",
+			dialect:   PostgreSQL,
+			migration: `SELECT E'it\'s;', 'C:\'; /* a /* b; */ c; */ SELECT 2`,
+			expected:  []string{`SELECT E'it\'s;', 'C:\'`, "/* a /* b; */ c; */ SELECT 2"},
+		},
+		{
+			name:      "postgres begin atomic",
+			dialect:   PostgreSQL,
+			migration: "CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT 1; END; SELECT 2",
+			expected:  []string{"CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT 1; END", "SELECT 2"},
+		},
+		{
+			name:      "mysql quotes and comments",
+			dialect:   MySQL,
+			migration: "INSERT INTO `a;b` VALUES ('x;y', \"it\\\";s\", 'it''s;');SELECT 2; # third;\nSELECT 1--1",
+			expected:  []string{"INSERT INTO `a;b` VALUES ('x;y', \"it\\\";s\", 'it''s;')", "SELECT 2", "# third;\nSELECT 1--1"},
+		},
+		{
+			name:      "mysql executable comments are code",
+			dialect:   MySQL,
+			migration: "/*!40101 SET NAMES utf8 */;\nSELECT 1",
+			expected:  []string{"/*!40101 SET NAMES utf8 */", "SELECT 1"},
+		},
+		{
+			name:      "mysql delimiter",
+			dialect:   MySQL,
+			migration: "DELIMITER //\nCREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\nEND//\nDELIMITER ;\nCALL p();",
+			expected:  []string{"CREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\nEND", "CALL p()"},
+		},
+		{
+			name:      "mysql procedure without delimiter",
+			dialect:   MySQL,
+			migration: "CREATE PROCEDURE p() BEGIN IF 1 THEN SELECT 1; END IF; CASE 1 WHEN 1 THEN SELECT 2; END CASE; END; CALL p()",
+			expected:  []string{"CREATE PROCEDURE p() BEGIN IF 1 THEN SELECT 1; END IF; CASE 1 WHEN 1 THEN SELECT 2; END CASE; END", "CALL p()"},
+		},
+		{
+			name:      "t-sql batches",
+			dialect:   TSQL,
+			migration: "CREATE TABLE a (id int);\nINSERT INTO a VALUES (1);\nGO\nCREATE PROCEDURE p AS SELECT 'GO'\n/*\nGO\n*/\ngo -- done\nSELECT [x;\nGO] FROM a\nGO 2\n",
+			expected:  []string{"CREATE TABLE a (id int);\nINSERT INTO a VALUES (1);", "CREATE PROCEDURE p AS SELECT 'GO'\n/*\nGO\n*/", "SELECT [x;\nGO] FROM a", "SELECT [x;\nGO] FROM a"},
+		},
+		{
+			name:      "firebird set term",
+			dialect:   Firebird,
+			migration: "SET TERM ^ ;\nCREATE PROCEDURE p AS BEGIN\n  EXIT;\nEND^\nSET TERM ; ^\nSELECT 1 FROM rdb$database;",
+			expected:  []string{"CREATE PROCEDURE p AS BEGIN\n  EXIT;\nEND", "SELECT 1 FROM rdb$database"},
+		},
+		{
+			name:      "cql batches and comments",
+			dialect:   CQL,
+			migration: "// create it;\nCREATE TABLE a (id int PRIMARY KEY);\nBEGIN UNLOGGED BATCH\n  INSERT INTO a (id) VALUES (1);\n  INSERT INTO a (id) VALUES (2);\nAPPLY BATCH;\nCREATE FUNCTION f() RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE java AS $$ return 1; $$;",
+			expected: []string{
+				"// create it;\nCREATE TABLE a (id int PRIMARY KEY)",
+				"BEGIN UNLOGGED BATCH\n  INSERT INTO a (id) VALUES (1);\n  INSERT INTO a (id) VALUES (2);\nAPPLY BATCH",
+				"CREATE FUNCTION f() RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE java AS $$ return 1; $$",
+			},
+		},
+		{
+			name:      "googlesql triple quotes",
+			dialect:   GoogleSQL,
+			migration: "CREATE TABLE a (s STRING(MAX) DEFAULT ('''x;'y''')) PRIMARY KEY (s); # done;\nCREATE INDEX i ON a (s)",
+			expected:  []string{"CREATE TABLE a (s STRING(MAX) DEFAULT ('''x;'y''')) PRIMARY KEY (s)", "# done;\nCREATE INDEX i ON a (s)"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts, err := SplitString(tc.migration, tc.dialect)
+			if tc.expected == nil {
+				if _, ok := err.(*Error); !ok {
+					t.Fatalf("expected an *Error, got %v: %q", err, stmts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.expected, stmts) {
+				t.Errorf("expected %q, got %q", tc.expected, stmts)
+			}
+		})
+	}
+}
+
+func TestErrorLine(t *testing.T) {
+	_, err := Split([]byte("SELECT 1;\n\nSELECT 'oops;"), Standard)
+	if e, ok := err.(*Error); !ok || e.Line != 3 {
+		t.Fatalf("expected an error on line 3, got %v", err)
+	}
+
+	_, err = Split([]byte("SELECT 1;\nCREATE PROCEDURE p() BEGIN\n  SELECT 1;\n"), MySQL)
+	if e, ok := err.(*Error); !ok || e.Line != 2 {
+		t.Fatalf("expected an unterminated block on line 2, got %v", err)
+	}
+}
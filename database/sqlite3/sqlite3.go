@@ -1,12 +1,14 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
 	"io/ioutil"
 	nurl "net/url"
 	"strings"
+	"time"
 
 	"github.com/solvedata/migrate/v4"
 	"github.com/solvedata/migrate/v4/database"
@@ -28,12 +30,18 @@ var (
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+
+	// HistoryTable enables the migration history if not empty.
+	HistoryTable string
 }
 
 type Sqlite struct {
 	db       *sql.DB
 	isLocked bool
 
+	// tx is the transaction started by Begin, if any
+	tx *sql.Tx
+
 	config *Config
 }
 
@@ -57,6 +65,9 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 	if err := mx.ensureVersionTable(); err != nil {
 		return nil, err
 	}
+	if err := mx.ensureHistoryTable(); err != nil {
+		return nil, err
+	}
 	return mx, nil
 }
 
@@ -89,6 +100,36 @@ func (m *Sqlite) ensureVersionTable() (err error) {
 	return nil
 }
 
+// ensureHistoryTable creates the history table if the history is enabled
+// and the table doesn't exist yet. Like ensureVersionTable, it locks the database.
+func (m *Sqlite) ensureHistoryTable() (err error) {
+	if m.config.HistoryTable == "" {
+		return nil
+	}
+
+	if err = m.Lock(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := m.Unlock(); e != nil {
+			if err == nil {
+				err = e
+			} else {
+				err = multierror.Append(err, e)
+			}
+		}
+	}()
+
+	// id is an alias for the rowid, AUTOINCREMENT is left out so Drop
+	// doesn't stumble over the internal sqlite_sequence table.
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id integer primary key, version uint64, target_version integer, direction text, identifier text, checksum text, started_at datetime, finished_at datetime, duration_ms integer, applied_by text, hostname text, success bool)`, m.config.HistoryTable)
+	if _, err := m.db.Exec(query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
 func (m *Sqlite) Open(url string) (database.Driver, error) {
 	purl, err := nurl.Parse(url)
 	if err != nil {
@@ -107,6 +148,7 @@ func (m *Sqlite) Open(url string) (database.Driver, error) {
 	mx, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		HistoryTable:    purl.Query().Get("x-history-table"),
 	})
 	if err != nil {
 		return nil, err
@@ -142,7 +184,7 @@ func (m *Sqlite) Drop() (err error) {
 	if len(tableNames) > 0 {
 		for _, t := range tableNames {
 			query := "DROP TABLE " + t
-			err = m.executeQuery(query)
+			err = m.executeQuery(context.Background(), query)
 			if err != nil {
 				return &database.Error{OrigErr: err, Query: []byte(query)}
 			}
@@ -158,6 +200,11 @@ func (m *Sqlite) Drop() (err error) {
 }
 
 func (m *Sqlite) Lock() error {
+	return m.LockContext(context.Background())
+}
+
+// LockContext is like Lock. The lock is held in-process, so it never waits on ctx.
+func (m *Sqlite) LockContext(ctx context.Context) error {
 	if m.isLocked {
 		return database.ErrLocked
 	}
@@ -174,21 +221,33 @@ func (m *Sqlite) Unlock() error {
 }
 
 func (m *Sqlite) Run(migration io.Reader) error {
+	return m.RunContext(context.Background(), migration)
+}
+
+// RunContext is like Run, but rolls back the running migration once ctx is done.
+func (m *Sqlite) RunContext(ctx context.Context, migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 	query := string(migr[:])
 
-	return m.executeQuery(query)
+	return m.executeQuery(ctx, query)
 }
 
-func (m *Sqlite) executeQuery(query string) error {
-	tx, err := m.db.Begin()
+func (m *Sqlite) executeQuery(ctx context.Context, query string) error {
+	if m.tx != nil {
+		if _, err := m.tx.ExecContext(ctx, query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		return nil
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
-	if _, err := tx.Exec(query); err != nil {
+	if _, err := tx.ExecContext(ctx, query); err != nil {
 		if errRollback := tx.Rollback(); errRollback != nil {
 			err = multierror.Append(err, errRollback)
 		}
@@ -201,38 +260,188 @@ func (m *Sqlite) executeQuery(query string) error {
 }
 
 func (m *Sqlite) SetVersion(version int, dirty bool) error {
-	tx, err := m.db.Begin()
+	return m.SetVersionContext(context.Background(), version, dirty)
+}
+
+// SetVersionContext is like SetVersion, but rolls back once ctx is done.
+func (m *Sqlite) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		return m.saveVersion(ctx, tx, version, dirty)
+	})
+}
+
+// SetVersionIf saves the version unless the migrations table was changed by
+// someone else. SQLite serializes the writing transactions.
+func (m *Sqlite) SetVersionIf(ctx context.Context, expectedVersion int, expectedDirty bool, version int, dirty bool) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		var curVersion int
+		var curDirty bool
+		query := "SELECT version, dirty FROM " + m.config.MigrationsTable + " LIMIT 1"
+		err := tx.QueryRowContext(ctx, query).Scan(&curVersion, &curDirty)
+		switch {
+		case err == sql.ErrNoRows:
+			curVersion, curDirty = database.NilVersion, false
+		case err != nil:
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+
+		if curVersion != expectedVersion || curDirty != expectedDirty {
+			return database.ErrVersionConflict{
+				ExpectedVersion: expectedVersion,
+				ExpectedDirty:   expectedDirty,
+				Version:         curVersion,
+				Dirty:           curDirty,
+			}
+		}
+		return m.saveVersion(ctx, tx, version, dirty)
+	})
+}
+
+// inTx calls f with the transaction started by Begin, which
+// already makes it atomic, or else within a new transaction.
+func (m *Sqlite) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	if m.tx != nil {
+		return f(m.tx)
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
+	if err := f(tx); err != nil {
+		if errRollback := tx.Rollback(); errRollback != nil {
+			err = multierror.Append(err, errRollback)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+
+	return nil
+}
+
+// saveVersion replaces the version in the migrations table within tx.
+func (m *Sqlite) saveVersion(ctx context.Context, tx *sql.Tx, version int, dirty bool) error {
 	query := "DELETE FROM " + m.config.MigrationsTable
-	if _, err := tx.Exec(query); err != nil {
+	if _, err := tx.ExecContext(ctx, query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
 	if version >= 0 {
 		query := fmt.Sprintf(`INSERT INTO %s (version, dirty) VALUES (%d, '%t')`, m.config.MigrationsTable, version, dirty)
-		if _, err := tx.Exec(query); err != nil {
-			if errRollback := tx.Rollback(); errRollback != nil {
-				err = multierror.Append(err, errRollback)
-			}
+		if _, err := tx.ExecContext(ctx, query); err != nil {
 			return &database.Error{OrigErr: err, Query: []byte(query)}
 		}
 	}
 
+	return nil
+}
+
+// Begin starts a transaction which Run, SetVersion, Version and
+// the history use until Commit or Rollback is called.
+func (m *Sqlite) Begin() error {
+	if m.tx != nil {
+		return database.ErrTxInProgress
+	}
+
+	tx, err := m.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	m.tx = tx
+	return nil
+}
+
+func (m *Sqlite) Commit() error {
+	if m.tx == nil {
+		return database.ErrNoTx
+	}
+
+	tx := m.tx
+	m.tx = nil
 	if err := tx.Commit(); err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
 	}
+	return nil
+}
+
+func (m *Sqlite) Rollback() error {
+	if m.tx == nil {
+		return database.ErrNoTx
+	}
 
+	tx := m.tx
+	m.tx = nil
+	if err := tx.Rollback(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction rollback failed"}
+	}
 	return nil
 }
 
+// executor returns the transaction started by Begin, if any, or the database.
+// Queries must not bypass the transaction, they would wait for it to finish.
+func (m *Sqlite) executor() database.SQLExecutor {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.db
+}
+
 func (m *Sqlite) Version() (version int, dirty bool, err error) {
 	query := "SELECT version, dirty FROM " + m.config.MigrationsTable + " LIMIT 1"
-	err = m.db.QueryRow(query).Scan(&version, &dirty)
+	err = m.executor().QueryRowContext(context.Background(), query).Scan(&version, &dirty)
 	if err != nil {
 		return database.NilVersion, false, nil
 	}
 	return version, dirty, nil
 }
+
+func (m *Sqlite) AddHistory(entry database.HistoryEntry) error {
+	if m.config.HistoryTable == "" {
+		return nil
+	}
+
+	query := "INSERT INTO " + m.config.HistoryTable + " (version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err := m.executor().ExecContext(context.Background(), query,
+		entry.Version, entry.TargetVersion, entry.Direction, entry.Identifier, entry.Checksum,
+		entry.StartedAt, entry.FinishedAt, int64(entry.Duration/time.Millisecond),
+		entry.AppliedBy, entry.Hostname, entry.Success); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+func (m *Sqlite) History() (entries []database.HistoryEntry, err error) {
+	if m.config.HistoryTable == "" {
+		return nil, database.ErrNoHistory
+	}
+
+	query := "SELECT version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success FROM " + m.config.HistoryTable + " ORDER BY id"
+	rows, err := m.executor().QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	for rows.Next() {
+		var e database.HistoryEntry
+		var durationMs int64
+		if err := rows.Scan(&e.Version, &e.TargetVersion, &e.Direction, &e.Identifier, &e.Checksum,
+			&e.StartedAt, &e.FinishedAt, &durationMs, &e.AppliedBy, &e.Hostname, &e.Success); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		e.Duration = time.Duration(durationMs) * time.Millisecond
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return entries, nil
+}
@@ -6,9 +6,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
 	dt "github.com/solvedata/migrate/v4/database/testing"
 	_ "github.com/solvedata/migrate/v4/source/file"
 	_ "github.com/mattn/go-sqlite3"
@@ -34,6 +36,29 @@ func Test(t *testing.T) {
 	dt.Test(t, d, []byte("CREATE TABLE t (Qty int, Name string);"))
 }
 
+func TestSetVersionIf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	p := &Sqlite{}
+	d, err := p.Open(fmt.Sprintf("sqlite3://%s", filepath.Join(dir, "sqlite3.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	dt.TestSetVersionIf(t, d)
+}
+
 func TestMigrate(t *testing.T) {
 	dir, err := ioutil.TempDir("", "sqlite3-driver-test")
 	if err != nil {
@@ -116,3 +141,116 @@ func TestMigrationTable(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHistoryTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test-history-table")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	t.Logf("DB path : %s\n", filepath.Join(dir, "sqlite3.db"))
+
+	p := &Sqlite{}
+	addr := fmt.Sprintf("sqlite3://%s?x-history-table=my_history_table", filepath.Join(dir, "sqlite3.db"))
+	driver, err := p.Open(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := driver.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	m, err := migrate.NewWithDatabaseInstance(
+		"file://./examples/migrations",
+		"ql", driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := driver.(*Sqlite).History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("expected at least 2 history entries, got %v", len(entries))
+	}
+	last := entries[len(entries)-1]
+	if last.Direction != "down" || !last.Success {
+		t.Errorf("expected a successful down migration as last entry, got %+v", last)
+	}
+	if last.StartedAt.IsZero() || last.FinishedAt.Before(last.StartedAt) {
+		t.Errorf("unexpected timestamps in %+v", last)
+	}
+}
+
+func TestTransactor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test-transactor")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	p := &Sqlite{}
+	driver, err := p.Open(fmt.Sprintf("sqlite3://%s", filepath.Join(dir, "sqlite3.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := driver.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	d := driver.(*Sqlite)
+
+	if err := d.Commit(); err != database.ErrNoTx {
+		t.Fatalf("expected ErrNoTx, got %v", err)
+	}
+
+	if err := d.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Begin(); err != database.ErrTxInProgress {
+		t.Fatalf("expected ErrTxInProgress, got %v", err)
+	}
+	if err := d.Run(strings.NewReader("CREATE TABLE t (id INTEGER PRIMARY KEY)")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetVersion(1, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := d.Version(); err != nil || v != 1 {
+		t.Fatalf("expected version 1 within the transaction, got %v (%v)", v, err)
+	}
+	if err := d.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _, err := d.Version(); err != nil || v != database.NilVersion {
+		t.Fatalf("expected no version after rollback, got %v (%v)", v, err)
+	}
+	var count int
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 't'"
+	if err := d.db.QueryRow(query).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("expected the table to be rolled back")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	nurl "net/url"
+	"time"
 
 	mssql "github.com/denisenkom/go-mssqldb" // mssql support
 	"github.com/solvedata/migrate/v4"
@@ -40,6 +41,9 @@ type Config struct {
 	MigrationsTable string
 	DatabaseName    string
 	SchemaName      string
+
+	// HistoryTable enables the migration history if not empty.
+	HistoryTable string
 }
 
 // SQL Server connection
@@ -49,6 +53,9 @@ type SQLServer struct {
 	db       *sql.DB
 	isLocked bool
 
+	// tx is the transaction started by Begin, if any
+	tx *sql.Tx
+
 	// Open and WithInstance need to garantuee that config is never nil
 	config *Config
 }
@@ -113,6 +120,10 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, err
 	}
 
+	if err := ss.ensureHistoryTable(); err != nil {
+		return nil, err
+	}
+
 	return ss, nil
 }
 
@@ -129,10 +140,12 @@ func (ss *SQLServer) Open(url string) (database.Driver, error) {
 	}
 
 	migrationsTable := purl.Query().Get("x-migrations-table")
+	historyTable := purl.Query().Get("x-history-table")
 
 	px, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		HistoryTable:    historyTable,
 	})
 
 	if err != nil {
@@ -153,29 +166,59 @@ func (ss *SQLServer) Close() error {
 }
 
 // Lock creates an advisory local on the database to prevent multiple migrations from running at the same time.
+// It fails with database.ErrLocked right away if the lock is held by someone else.
 func (ss *SQLServer) Lock() error {
 	if ss.isLocked {
 		return database.ErrLocked
 	}
 
+	if err := database.TryLock(0, ss.tryLock); err != nil {
+		return err
+	}
+
+	ss.isLocked = true
+	return nil
+}
+
+// LockContext is like Lock, but waits for the application lock until ctx is done.
+func (ss *SQLServer) LockContext(ctx context.Context) error {
+	if ss.isLocked {
+		return database.ErrLocked
+	}
+
+	if err := database.PollLock(ctx, time.Second, ss.tryLock); err != nil {
+		return err
+	}
+
+	ss.isLocked = true
+	return nil
+}
+
+// tryLock waits for the application lock at most wait. @LockTimeout bounds
+// the wait on the server, so the request isn't canceled with a ctx, which
+// could acquire the lock anyway.
+func (ss *SQLServer) tryLock(wait time.Duration) (bool, error) {
 	aid, err := database.GenerateAdvisoryLockId(ss.config.DatabaseName, ss.config.SchemaName)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	// This will either obtain the lock immediately and return true,
-	// or return false if the lock cannot be acquired immediately.
+	// This will obtain the lock within @LockTimeout milliseconds, or return -1.
 	// MS Docs: sp_getapplock: https://docs.microsoft.com/en-us/sql/relational-databases/system-stored-procedures/sp-getapplock-transact-sql?view=sql-server-2017
-	query := `EXEC sp_getapplock @Resource = @p1, @LockMode = 'Update', @LockOwner = 'Session', @LockTimeout = 0`
+	query := `EXEC sp_getapplock @Resource = @p1, @LockMode = 'Update', @LockOwner = 'Session', @LockTimeout = @p2`
 
 	var status mssql.ReturnStatus
-	if _, err = ss.conn.ExecContext(context.Background(), query, aid, &status); err == nil && status > -1 {
-		ss.isLocked = true
-		return nil
-	} else if err != nil {
-		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
-	} else {
-		return &database.Error{Err: fmt.Sprintf("try lock failed with error %v: %v", status, lockErrorMap[status]), Query: []byte(query)}
+	if _, err := ss.conn.ExecContext(context.Background(), query, aid, int64(wait/time.Millisecond), &status); err != nil {
+		return false, &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	}
+	switch {
+	case status > -1:
+		return true, nil
+	case status == -1:
+		// timed out
+		return false, nil
+	default:
+		return false, &database.Error{Err: fmt.Sprintf("try lock failed with error %v: %v", status, lockErrorMap[status]), Query: []byte(query)}
 	}
 }
 
@@ -200,8 +243,87 @@ func (ss *SQLServer) Unlock() error {
 	return nil
 }
 
+// lockHolder returns the id of the session holding the application lock,
+// a description of it and its login time. sessionID is 0 if the lock isn't
+// held, and -1 if it is held but the session isn't visible, which requires
+// the VIEW SERVER STATE permission.
+func (ss *SQLServer) lockHolder() (sessionID int, owner string, since time.Time, err error) {
+	aid, err := database.GenerateAdvisoryLockId(ss.config.DatabaseName, ss.config.SchemaName)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+
+	// APPLOCK_MODE tells about the lock of this session, APPLOCK_TEST about the others
+	query := `SELECT APPLOCK_MODE('public', @p1, 'Session'), APPLOCK_TEST('public', @p1, 'Update', 'Session')`
+	var mode string
+	var grantable int
+	if err := ss.conn.QueryRowContext(context.Background(), query, aid).Scan(&mode, &grantable); err != nil {
+		return 0, "", time.Time{}, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if mode == "NoLock" && grantable == 1 {
+		return 0, "", time.Time{}, nil
+	}
+
+	// the resource description of application locks is 0:[resource]:(hash)
+	query = `SELECT TOP 1 l.request_session_id, s.login_name, s.host_name, s.program_name, s.login_time
+		FROM sys.dm_tran_locks l JOIN sys.dm_exec_sessions s ON s.session_id = l.request_session_id
+		WHERE l.resource_type = 'APPLICATION' AND l.request_status = 'GRANT' AND l.resource_database_id = DB_ID()
+		AND CHARINDEX('[' + @p1 + ']', l.resource_description) > 0`
+	var login, host, program string
+	err = ss.conn.QueryRowContext(context.Background(), query, aid).Scan(&sessionID, &login, &host, &program, &since)
+	switch {
+	case err == sql.ErrNoRows:
+		return -1, "unknown session", time.Time{}, nil
+	case err != nil:
+		return 0, "", time.Time{}, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	owner = fmt.Sprintf("session %v, login %v, host %v", sessionID, login, host)
+	if program != "" {
+		owner += ", program " + program
+	}
+	return sessionID, owner, since, nil
+}
+
+// LockStatus implements database.LockInspector. since is the login time of
+// the session holding the lock, the lock itself has no timestamp.
+func (ss *SQLServer) LockStatus() (held bool, owner string, since time.Time, err error) {
+	sessionID, owner, since, err := ss.lockHolder()
+	if err != nil {
+		return false, "", time.Time{}, err
+	}
+	return sessionID != 0, owner, since, nil
+}
+
+// ForceUnlock implements database.LockInspector. Application locks can only be
+// released by the session holding them, so that session is killed.
+func (ss *SQLServer) ForceUnlock() error {
+	if ss.isLocked {
+		return ss.Unlock()
+	}
+
+	sessionID, _, _, err := ss.lockHolder()
+	if err != nil || sessionID == 0 {
+		return err
+	}
+	if sessionID < 0 {
+		return &database.Error{Err: "can't find the session holding the lock, VIEW SERVER STATE permission required"}
+	}
+
+	query := fmt.Sprintf("KILL %d", sessionID)
+	if _, err := ss.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
 // Run the migrations for the database
 func (ss *SQLServer) Run(migration io.Reader) error {
+	return ss.RunContext(context.Background(), migration)
+}
+
+// RunContext is like Run, but cancels the running migration once ctx is done.
+func (ss *SQLServer) RunContext(ctx context.Context, migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
@@ -209,7 +331,7 @@ func (ss *SQLServer) Run(migration io.Reader) error {
 
 	// run migration
 	query := string(migr[:])
-	if _, err := ss.conn.ExecContext(context.Background(), query); err != nil {
+	if _, err := ss.executor().ExecContext(ctx, query); err != nil {
 		if msErr, ok := err.(mssql.Error); ok {
 			message := fmt.Sprintf("migration failed: %s", msErr.Message)
 			if msErr.ProcName != "" {
@@ -225,17 +347,73 @@ func (ss *SQLServer) Run(migration io.Reader) error {
 
 // SetVersion for the current database
 func (ss *SQLServer) SetVersion(version int, dirty bool) error {
+	return ss.SetVersionContext(context.Background(), version, dirty)
+}
 
-	tx, err := ss.conn.BeginTx(context.Background(), &sql.TxOptions{})
+// SetVersionContext is like SetVersion, but rolls back once ctx is done.
+func (ss *SQLServer) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	return ss.inTx(ctx, func(tx *sql.Tx) error {
+		return ss.saveVersion(ctx, tx, version, dirty)
+	})
+}
+
+// SetVersionIf saves the version unless the migrations table was changed by
+// someone else. The table is locked exclusively until the transaction ends.
+func (ss *SQLServer) SetVersionIf(ctx context.Context, expectedVersion int, expectedDirty bool, version int, dirty bool) error {
+	return ss.inTx(ctx, func(tx *sql.Tx) error {
+		var curVersion int
+		var curDirty bool
+		query := `SELECT TOP 1 version, dirty FROM "` + ss.config.MigrationsTable + `" WITH (TABLOCKX, HOLDLOCK)`
+		err := tx.QueryRowContext(ctx, query).Scan(&curVersion, &curDirty)
+		switch {
+		case err == sql.ErrNoRows:
+			curVersion, curDirty = database.NilVersion, false
+		case err != nil:
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+
+		if curVersion != expectedVersion || curDirty != expectedDirty {
+			return database.ErrVersionConflict{
+				ExpectedVersion: expectedVersion,
+				ExpectedDirty:   expectedDirty,
+				Version:         curVersion,
+				Dirty:           curDirty,
+			}
+		}
+		return ss.saveVersion(ctx, tx, version, dirty)
+	})
+}
+
+// inTx calls f with the transaction started by Begin, which
+// already makes it atomic, or else within a new transaction.
+func (ss *SQLServer) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	if ss.tx != nil {
+		return f(ss.tx)
+	}
+
+	tx, err := ss.conn.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
-	query := `TRUNCATE TABLE "` + ss.config.MigrationsTable + `"`
-	if _, err := tx.Exec(query); err != nil {
+	if err := f(tx); err != nil {
 		if errRollback := tx.Rollback(); errRollback != nil {
 			err = multierror.Append(err, errRollback)
 		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+
+	return nil
+}
+
+// saveVersion replaces the version in the migrations table within tx.
+func (ss *SQLServer) saveVersion(ctx context.Context, tx *sql.Tx, version int, dirty bool) error {
+	query := `TRUNCATE TABLE "` + ss.config.MigrationsTable + `"`
+	if _, err := tx.ExecContext(ctx, query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
@@ -245,25 +423,69 @@ func (ss *SQLServer) SetVersion(version int, dirty bool) error {
 			dirtyBit = 1
 		}
 		query = `INSERT INTO "` + ss.config.MigrationsTable + `" (version, dirty) VALUES (@p1, @p2)`
-		if _, err := tx.Exec(query, version, dirtyBit); err != nil {
-			if errRollback := tx.Rollback(); errRollback != nil {
-				err = multierror.Append(err, errRollback)
-			}
+		if _, err := tx.ExecContext(ctx, query, version, dirtyBit); err != nil {
 			return &database.Error{OrigErr: err, Query: []byte(query)}
 		}
 	}
 
+	return nil
+}
+
+// Begin starts a transaction which Run, SetVersion, Version and
+// the history use until Commit or Rollback is called.
+func (ss *SQLServer) Begin() error {
+	if ss.tx != nil {
+		return database.ErrTxInProgress
+	}
+
+	tx, err := ss.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	ss.tx = tx
+	return nil
+}
+
+// Commit commits the transaction started by Begin
+func (ss *SQLServer) Commit() error {
+	if ss.tx == nil {
+		return database.ErrNoTx
+	}
+
+	tx := ss.tx
+	ss.tx = nil
 	if err := tx.Commit(); err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
 	}
+	return nil
+}
 
+// Rollback rolls back the transaction started by Begin
+func (ss *SQLServer) Rollback() error {
+	if ss.tx == nil {
+		return database.ErrNoTx
+	}
+
+	tx := ss.tx
+	ss.tx = nil
+	if err := tx.Rollback(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction rollback failed"}
+	}
 	return nil
 }
 
+// executor returns the transaction started by Begin, if any, or the connection.
+func (ss *SQLServer) executor() database.SQLExecutor {
+	if ss.tx != nil {
+		return ss.tx
+	}
+	return ss.conn
+}
+
 // Version of the current database state
 func (ss *SQLServer) Version() (version int, dirty bool, err error) {
 	query := `SELECT TOP 1 version, dirty FROM "` + ss.config.MigrationsTable + `"`
-	err = ss.conn.QueryRowContext(context.Background(), query).Scan(&version, &dirty)
+	err = ss.executor().QueryRowContext(context.Background(), query).Scan(&version, &dirty)
 	switch {
 	case err == sql.ErrNoRows:
 		return database.NilVersion, false, nil
@@ -277,6 +499,60 @@ func (ss *SQLServer) Version() (version int, dirty bool, err error) {
 	}
 }
 
+// AddHistory appends entry to the history table, if enabled.
+func (ss *SQLServer) AddHistory(entry database.HistoryEntry) error {
+	if ss.config.HistoryTable == "" {
+		return nil
+	}
+
+	var successBit int
+	if entry.Success {
+		successBit = 1
+	}
+	query := `INSERT INTO "` + ss.config.HistoryTable + `" (version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9, @p10, @p11)`
+	if _, err := ss.executor().ExecContext(context.Background(), query,
+		int64(entry.Version), entry.TargetVersion, entry.Direction, entry.Identifier, entry.Checksum,
+		entry.StartedAt, entry.FinishedAt, int64(entry.Duration/time.Millisecond),
+		entry.AppliedBy, entry.Hostname, successBit); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// History returns all entries of the history table in the order they were added.
+func (ss *SQLServer) History() (entries []database.HistoryEntry, err error) {
+	if ss.config.HistoryTable == "" {
+		return nil, database.ErrNoHistory
+	}
+
+	query := `SELECT version, target_version, direction, identifier, checksum, started_at, finished_at, duration_ms, applied_by, hostname, success FROM "` + ss.config.HistoryTable + `" ORDER BY id`
+	rows, err := ss.executor().QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	for rows.Next() {
+		var e database.HistoryEntry
+		var version, durationMs int64
+		if err := rows.Scan(&version, &e.TargetVersion, &e.Direction, &e.Identifier, &e.Checksum,
+			&e.StartedAt, &e.FinishedAt, &durationMs, &e.AppliedBy, &e.Hostname, &e.Success); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		e.Version = uint(version)
+		e.Duration = time.Duration(durationMs) * time.Millisecond
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return entries, nil
+}
+
 // Drop all tables from the database.
 func (ss *SQLServer) Drop() error {
 
@@ -341,3 +617,37 @@ func (ss *SQLServer) ensureVersionTable() (err error) {
 
 	return nil
 }
+
+func (ss *SQLServer) ensureHistoryTable() (err error) {
+	if ss.config.HistoryTable == "" {
+		return nil
+	}
+
+	if err = ss.Lock(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := ss.Unlock(); e != nil {
+			if err == nil {
+				err = e
+			} else {
+				err = multierror.Append(err, e)
+			}
+		}
+	}()
+
+	query := `IF NOT EXISTS
+	(SELECT *
+		 FROM sysobjects
+		WHERE id = object_id(N'[dbo].[` + ss.config.HistoryTable + `]')
+			AND OBJECTPROPERTY(id, N'IsUserTable') = 1
+	)
+	CREATE TABLE ` + ss.config.HistoryTable + ` ( id BIGINT IDENTITY(1,1) PRIMARY KEY, version BIGINT NOT NULL, target_version BIGINT NOT NULL, direction NVARCHAR(4) NOT NULL, identifier NVARCHAR(MAX) NOT NULL, checksum NVARCHAR(255) NOT NULL, started_at DATETIMEOFFSET NOT NULL, finished_at DATETIMEOFFSET NOT NULL, duration_ms BIGINT NOT NULL, applied_by NVARCHAR(255) NOT NULL, hostname NVARCHAR(255) NOT NULL, success BIT NOT NULL );`
+
+	if _, err = ss.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	return nil
+}
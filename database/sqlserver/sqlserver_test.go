@@ -12,6 +12,7 @@ import (
 
 	"github.com/dhui/dktest"
 	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
 
 	dt "github.com/solvedata/migrate/v4/database/testing"
 	"github.com/solvedata/migrate/v4/dktesting"
@@ -218,3 +219,50 @@ func TestLockWorks(t *testing.T) {
 		}
 	})
 }
+
+func TestOpenLocked(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.Port(defaultPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := msConnectionString(ip, port)
+		p := &SQLServer{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := d.Lock(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Open locks to create the migrations table,
+		// it must give up instead of waiting for the lock
+		errs := make(chan error, 1)
+		go func() {
+			d2, err := p.Open(addr)
+			if err == nil {
+				err = d2.Close()
+			}
+			errs <- err
+		}()
+		select {
+		case err := <-errs:
+			if err != database.ErrLocked {
+				t.Fatalf("expected database.ErrLocked, got %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("expected Open to return while the lock is held")
+		}
+
+		if err := d.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
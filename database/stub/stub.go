@@ -1,9 +1,12 @@
 package stub
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"reflect"
+	"time"
 
 	"github.com/solvedata/migrate/v4/database"
 )
@@ -20,6 +23,12 @@ type Stub struct {
 	LastRunMigration  []byte // todo: make []string
 	IsDirty           bool
 	IsLocked          bool
+	StatementsDone    int
+	StatementsTotal   int
+	HistoryEntries    []database.HistoryEntry
+
+	// snapshot is the state restored by Rollback, if a transaction is in progress
+	snapshot *Stub
 
 	Config *Config
 }
@@ -61,6 +70,18 @@ func (s *Stub) Unlock() error {
 	return nil
 }
 
+func (s *Stub) LockStatus() (held bool, owner string, since time.Time, err error) {
+	if !s.IsLocked {
+		return false, "", time.Time{}, nil
+	}
+	return true, "stub", time.Time{}, nil
+}
+
+func (s *Stub) ForceUnlock() error {
+	s.IsLocked = false
+	return nil
+}
+
 func (s *Stub) Run(migration io.Reader) error {
 	m, err := ioutil.ReadAll(migration)
 	if err != nil {
@@ -74,13 +95,84 @@ func (s *Stub) Run(migration io.Reader) error {
 func (s *Stub) SetVersion(version int, state bool) error {
 	s.CurrentVersion = version
 	s.IsDirty = state
+	s.StatementsDone, s.StatementsTotal = 0, 0
+	return nil
+}
+
+// SplitStatements splits at every semicolon.
+func (s *Stub) SplitStatements(migration []byte) ([][]byte, error) {
+	stmts := make([][]byte, 0)
+	for _, stmt := range bytes.Split(migration, []byte(";")) {
+		if stmt = bytes.TrimSpace(stmt); len(stmt) > 0 {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts, nil
+}
+
+func (s *Stub) SetProgress(done, total int) error {
+	s.StatementsDone, s.StatementsTotal = done, total
 	return nil
 }
 
+func (s *Stub) Progress() (done, total int, err error) {
+	return s.StatementsDone, s.StatementsTotal, nil
+}
+
+func (s *Stub) SetVersionIf(ctx context.Context, expectedVersion int, expectedDirty bool, version int, dirty bool) error {
+	if s.CurrentVersion != expectedVersion || s.IsDirty != expectedDirty {
+		return database.ErrVersionConflict{
+			ExpectedVersion: expectedVersion,
+			ExpectedDirty:   expectedDirty,
+			Version:         s.CurrentVersion,
+			Dirty:           s.IsDirty,
+		}
+	}
+	return s.SetVersion(version, dirty)
+}
+
 func (s *Stub) Version() (version int, dirty bool, err error) {
 	return s.CurrentVersion, s.IsDirty, nil
 }
 
+func (s *Stub) AddHistory(entry database.HistoryEntry) error {
+	s.HistoryEntries = append(s.HistoryEntries, entry)
+	return nil
+}
+
+func (s *Stub) History() ([]database.HistoryEntry, error) {
+	return s.HistoryEntries, nil
+}
+
+func (s *Stub) Begin() error {
+	if s.snapshot != nil {
+		return database.ErrTxInProgress
+	}
+	snapshot := *s
+	snapshot.MigrationSequence = append(make([]string, 0, len(s.MigrationSequence)), s.MigrationSequence...)
+	snapshot.HistoryEntries = append([]database.HistoryEntry(nil), s.HistoryEntries...)
+	s.snapshot = &snapshot
+	return nil
+}
+
+func (s *Stub) Commit() error {
+	if s.snapshot == nil {
+		return database.ErrNoTx
+	}
+	s.snapshot = nil
+	return nil
+}
+
+func (s *Stub) Rollback() error {
+	if s.snapshot == nil {
+		return database.ErrNoTx
+	}
+	isLocked := s.IsLocked
+	*s = *s.snapshot
+	s.IsLocked = isLocked
+	return nil
+}
+
 const DROP = "DROP"
 
 func (s *Stub) Drop() error {
@@ -5,6 +5,7 @@ package testing
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -156,3 +157,45 @@ func TestSetVersion(t *testing.T, d database.Driver) {
 		t.Fatal("expected version to be 2")
 	}
 }
+
+// TestSetVersionIf tests drivers implementing database.VersionCASDriver,
+// starting from the NilVersion that a full down migration leaves behind.
+func TestSetVersionIf(t *testing.T, d database.Driver) {
+	cas, ok := d.(database.VersionCASDriver)
+	if !ok {
+		t.Fatal("expected the driver to implement database.VersionCASDriver")
+	}
+
+	ctx := context.Background()
+	if err := d.SetVersion(database.NilVersion, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cas.SetVersionIf(ctx, database.NilVersion, false, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := cas.SetVersionIf(ctx, 1, true, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cas.SetVersionIf(ctx, 1, false, 2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process migrated since version 1 was read
+	err := cas.SetVersionIf(ctx, 1, false, 2, false)
+	if _, ok := err.(database.ErrVersionConflict); !ok {
+		t.Fatalf("expected database.ErrVersionConflict, got %v", err)
+	}
+	err = cas.SetVersionIf(ctx, database.NilVersion, false, 1, true)
+	if _, ok := err.(database.ErrVersionConflict); !ok {
+		t.Fatalf("expected database.ErrVersionConflict, got %v", err)
+	}
+
+	v, dirty, err := d.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 || !dirty {
+		t.Fatalf("expected dirty version 2, got %v (dirty: %v)", v, dirty)
+	}
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+var (
+	ErrTxInProgress = fmt.Errorf("transaction already in progress")
+	ErrNoTx         = fmt.Errorf("no transaction in progress")
+)
+
+// Transactor is an optional interface a Driver can implement to run several
+// migrations and their version bookkeeping atomically, on databases with
+// transactional DDL. Between Begin and Commit or Rollback, Run, SetVersion,
+// Version and the history (see HistoryDriver) must use the transaction.
+type Transactor interface {
+	// Begin starts a transaction.
+	// Return ErrTxInProgress if a transaction has already been started.
+	Begin() error
+
+	// Commit commits the transaction started by Begin.
+	// Return ErrNoTx if there is none.
+	Commit() error
+
+	// Rollback rolls back the transaction started by Begin.
+	// Return ErrNoTx if there is none.
+	Rollback() error
+}
+
+// SQLExecutor is implemented by *sql.DB, *sql.Conn and *sql.Tx, so SQL
+// drivers can run their queries inside or outside of a transaction alike.
+type SQLExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
@@ -1,9 +1,11 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"hash/crc32"
 	"strings"
+	"time"
 )
 
 const advisoryLockIDSalt uint = 1486364155
@@ -17,3 +19,69 @@ func GenerateAdvisoryLockId(databaseName string, additionalNames ...string) (str
 	sum = sum * uint32(advisoryLockIDSalt)
 	return fmt.Sprint(sum), nil
 }
+
+// DefaultLockPollInterval is the time drivers wait between attempts to acquire a lock.
+var DefaultLockPollInterval = 100 * time.Millisecond
+
+// PollLock calls tryLock until it acquired the lock, returned an error or ctx
+// is done, starting an attempt every interval. tryLock may wait for the lock up
+// to wait, i.e. with a timeout on the database side, which is never longer than
+// interval or the time left until the deadline of ctx, nor negative.
+//
+// tryLock must not use ctx to cancel its query: a lock acquired right when ctx is
+// done would be held without anybody knowing. PollLock returns ctx.Err() once ctx
+// is done, so drivers can use it to honour the lock timeout without blocking forever.
+//
+// Lock of drivers doesn't poll: it is called by WithInstance to create the
+// migrations table, which must not wait forever for a lock held elsewhere.
+// See TryLock.
+func PollLock(ctx context.Context, interval time.Duration, tryLock func(wait time.Duration) (bool, error)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		wait := interval
+		if deadline, ok := ctx.Deadline(); ok {
+			if left := time.Until(deadline); left < wait {
+				wait = left
+			}
+		}
+		// the deadline may have passed since ctx.Err() was checked
+		if wait < 0 {
+			wait = 0
+		}
+
+		start := time.Now()
+		locked, err := tryLock(wait)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		// sleep for the rest of the interval, if tryLock didn't wait itself
+		timer := time.NewTimer(interval - time.Since(start))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// TryLock calls tryLock once, waiting up to wait, and returns ErrLocked
+// if it didn't acquire the lock. Drivers use it to implement Lock, which
+// gives up instead of polling like LockContext.
+func TryLock(wait time.Duration, tryLock func(wait time.Duration) (bool, error)) error {
+	locked, err := tryLock(wait)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrLocked
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package database
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestGenerateAdvisoryLockId(t *testing.T) {
@@ -45,3 +48,61 @@ func TestGenerateAdvisoryLockId(t *testing.T) {
 		})
 	}
 }
+
+func TestPollLock(t *testing.T) {
+	attempts := 0
+	err := PollLock(context.Background(), time.Millisecond, func(wait time.Duration) (bool, error) {
+		attempts++
+		return attempts == 3, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %v", attempts)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = PollLock(ctx, 5*time.Millisecond, func(wait time.Duration) (bool, error) {
+		if wait > 5*time.Millisecond {
+			t.Errorf("expected to wait at most the interval, got %v", wait)
+		}
+		if wait < 0 {
+			t.Errorf("expected not to wait a negative time, got %v", wait)
+		}
+		return false, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	errTry := fmt.Errorf("try lock failed")
+	err = PollLock(context.Background(), time.Millisecond, func(wait time.Duration) (bool, error) {
+		return false, errTry
+	})
+	if err != errTry {
+		t.Fatalf("expected %v, got %v", errTry, err)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	attempts := 0
+	err := TryLock(10*time.Second, func(wait time.Duration) (bool, error) {
+		attempts++
+		if wait != 10*time.Second {
+			t.Errorf("expected to wait 10s, got %v", wait)
+		}
+		return false, nil
+	})
+	if err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected a single attempt, got %v", attempts)
+	}
+
+	if err := TryLock(0, func(time.Duration) (bool, error) { return true, nil }); err != nil {
+		t.Fatal(err)
+	}
+}
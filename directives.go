@@ -0,0 +1,137 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/solvedata/migrate/v4/database"
+)
+
+// directivePrefix starts a directive in the header of a migration.
+const directivePrefix = "-- migrate:"
+
+// readDirectives parses the directives in the leading comment lines of the
+// body and sets Directives. BufferedBody still yields the entire body.
+// Calling this function blocks until the header has been buffered.
+func (m *Migration) readDirectives() error {
+	if m.BufferedBody == nil {
+		return nil
+	}
+
+	r := bufio.NewReader(m.BufferedBody)
+	header := make([]byte, 0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			header = append(header, line...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && !bytes.HasPrefix(trimmed, []byte("--")) {
+			break
+		}
+	}
+	m.BufferedBody = io.MultiReader(bytes.NewReader(header), r)
+
+	directives, err := parseDirectives(header)
+	if err != nil {
+		return fmt.Errorf("%v: %v", m.LogString(), err)
+	}
+	m.Directives = directives
+	return nil
+}
+
+// parseDirectives parses the directives in the comment lines of header,
+// which ends with the first line that isn't a comment, if any.
+func parseDirectives(header []byte) (database.Directives, error) {
+	var d database.Directives
+	for _, line := range strings.Split(string(header), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			break
+		}
+		if !strings.HasPrefix(line, directivePrefix) {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, directivePrefix))
+		if len(fields) == 0 {
+			return d, fmt.Errorf("empty directive %q", line)
+		}
+		name, args := fields[0], fields[1:]
+
+		switch name {
+		case "no-transaction":
+			d.NoTransaction = true
+
+		case "split-statements":
+			d.SplitStatements = true
+
+		case "timeout":
+			if len(args) != 1 {
+				return d, fmt.Errorf("directive %q expects a duration, i.e. 30m", name)
+			}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil || timeout <= 0 {
+				return d, fmt.Errorf("directive %q has an invalid duration %q", name, args[0])
+			}
+			d.Timeout = timeout
+			continue
+
+		case "env":
+			if len(args) == 0 {
+				return d, fmt.Errorf("directive %q expects a list of environments, i.e. prod,staging", name)
+			}
+			for _, env := range strings.Split(strings.Join(args, ""), ",") {
+				if env != "" {
+					d.Env = append(d.Env, env)
+				}
+			}
+			continue
+
+		default:
+			return d, fmt.Errorf("unknown directive %q", name)
+		}
+
+		if len(args) > 0 {
+			return d, fmt.Errorf("directive %q doesn't take arguments", name)
+		}
+	}
+	return d, nil
+}
+
+// appliesIn returns whether a migration with directives d is applied in env.
+func appliesIn(d database.Directives, env string) bool {
+	if len(d.Env) == 0 {
+		return true
+	}
+	for _, e := range d.Env {
+		if e == env {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDirectives returns whether d differs from the defaults.
+func hasDirectives(d database.Directives) bool {
+	return d.NoTransaction || d.Timeout > 0 || d.SplitStatements || len(d.Env) > 0
+}
+
+// runDirectives is like runDriver, but passes the directives down if there
+// are any and the database driver implements database.DirectiveRunner.
+func (m *Migrate) runDirectives(ctx context.Context, migration io.Reader, directives database.Directives) error {
+	if d, ok := m.databaseDrv.(database.DirectiveRunner); ok && hasDirectives(directives) {
+		return d.RunDirectives(ctx, migration, directives)
+	}
+	return m.runDriver(ctx, migration)
+}
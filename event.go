@@ -0,0 +1,205 @@
+package migrate
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	// EventLockAcquired is emitted once the database is locked.
+	// Duration is the time spent waiting for the lock.
+	EventLockAcquired EventType = "lock_acquired"
+
+	// EventLockReleased is emitted once the database is unlocked.
+	// Duration is the time the lock was held.
+	EventLockReleased EventType = "lock_released"
+
+	// EventMigrationScheduled is emitted when a migration is read from the source.
+	EventMigrationScheduled EventType = "migration_scheduled"
+
+	// EventBufferingStarted is emitted when a migration body starts streaming
+	// from the source.
+	EventBufferingStarted EventType = "buffering_started"
+
+	// EventBufferingFinished is emitted once a migration body is fully read.
+	// Duration is the time it took to read it.
+	EventBufferingFinished EventType = "buffering_finished"
+
+	// EventRunStarted is emitted right before a migration runs against the database.
+	EventRunStarted EventType = "run_started"
+
+	// EventRunFinished is emitted after a migration ran against the database,
+	// with Err set if it failed. Duration is the time it took to run it.
+	EventRunFinished EventType = "run_finished"
+
+	// EventVersionDirty is emitted once the version is saved with dirty state.
+	EventVersionDirty EventType = "version_dirty"
+
+	// EventVersionClean is emitted once the version is saved with clean state.
+	EventVersionClean EventType = "version_clean"
+
+	// EventError is emitted for errors that can't be returned to the caller,
+	// i.e. errors while buffering a migration in the background.
+	EventError EventType = "error"
+)
+
+// Event describes a single step while migrating. Fields that don't apply
+// to the type of the event are left empty.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Version, TargetVersion and Identifier describe the migration
+	// the event belongs to.
+	Version       uint
+	TargetVersion int
+	Identifier    string
+
+	Duration time.Duration
+	Err      error
+
+	// Migration is the migration the event belongs to, if any.
+	// It must not be modified and its body must not be read.
+	Migration *Migration
+}
+
+// Observer is an interface so you can receive typed events
+// instead of parsing log lines. Observe is called from multiple
+// goroutines and should return quickly.
+type Observer interface {
+	Observe(e Event)
+}
+
+// MultiObserver returns an Observer that passes
+// each event on to all of the given observers.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+type multiObserver []Observer
+
+func (mo multiObserver) Observe(e Event) {
+	for _, o := range mo {
+		o.Observe(e)
+	}
+}
+
+// NewLoggerObserver returns an Observer that writes events to l,
+// in the format Migrate has always used for its Log.
+func NewLoggerObserver(l Logger) Observer {
+	return &loggerObserver{l: l}
+}
+
+type loggerObserver struct {
+	l Logger
+}
+
+func (o *loggerObserver) Observe(e Event) {
+	switch e.Type {
+	case EventMigrationScheduled:
+		if !o.l.Verbose() {
+			return
+		}
+		if e.Migration.Body != nil {
+			o.l.Printf("Start buffering %v\n", e.Migration.LogString())
+		} else {
+			o.l.Printf("Scheduled %v\n", e.Migration.LogString())
+		}
+
+	case EventRunStarted:
+		if o.l.Verbose() && e.Migration.Body != nil {
+			o.l.Printf("Read and execute %v\n", e.Migration.LogString())
+		}
+
+	case EventRunFinished:
+		if e.Err != nil {
+			return
+		}
+
+		// keep the numbers of the log lines as they have always been
+		readTime := e.Migration.FinishedReading.Sub(e.Migration.StartedBuffering)
+		runTime := e.Time.Sub(e.Migration.FinishedReading)
+		if o.l.Verbose() {
+			o.l.Printf("Finished %v (read %v, ran %v)\n", e.Migration.LogString(), readTime, runTime)
+		} else {
+			o.l.Printf("%v (%v)\n", e.Migration.LogString(), readTime+runTime)
+		}
+
+	case EventError:
+		o.l.Printf("error: %v", e.Err)
+	}
+}
+
+// NewJSONObserver returns an Observer that writes each event
+// as a single line of JSON to w.
+func NewJSONObserver(w io.Writer) Observer {
+	return &jsonObserver{enc: json.NewEncoder(w)}
+}
+
+type jsonObserver struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+type jsonEvent struct {
+	Type          EventType `json:"type"`
+	Time          time.Time `json:"time"`
+	Version       *uint     `json:"version,omitempty"`
+	TargetVersion *int      `json:"target_version,omitempty"`
+	Identifier    string    `json:"identifier,omitempty"`
+	DurationMs    float64   `json:"duration_ms,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func (o *jsonObserver) Observe(e Event) {
+	je := jsonEvent{
+		Type:       e.Type,
+		Time:       e.Time,
+		Identifier: e.Identifier,
+		DurationMs: float64(e.Duration) / float64(time.Millisecond),
+	}
+	if e.Migration != nil {
+		je.Version = &e.Version
+		je.TargetVersion = &e.TargetVersion
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// there is nobody to report a failed write to
+	_ = o.enc.Encode(je)
+}
+
+// emit sends e to the Observer and the Log, if set.
+func (m *Migrate) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if m.Observer != nil {
+		m.Observer.Observe(e)
+	}
+	if m.Log != nil {
+		NewLoggerObserver(m.Log).Observe(e)
+	}
+}
+
+// emitMigration emits an event of type t for migr.
+func (m *Migrate) emitMigration(t EventType, migr *Migration, duration time.Duration, err error) {
+	m.emit(Event{
+		Type:          t,
+		Version:       migr.Version,
+		TargetVersion: migr.TargetVersion,
+		Identifier:    migr.Identifier,
+		Duration:      duration,
+		Err:           err,
+		Migration:     migr,
+	})
+}
@@ -2,6 +2,7 @@ module github.com/solvedata/migrate/v4
 
 require (
 	cloud.google.com/go v0.37.4
+	github.com/BurntSushi/toml v0.3.1
 	github.com/ClickHouse/clickhouse-go v1.3.12
 	github.com/aws/aws-sdk-go v1.17.7
 	github.com/cockroachdb/cockroach-go v0.0.0-20181001143604-e0a95dfd547c
@@ -25,6 +26,7 @@ require (
 	golang.org/x/tools v0.0.0-20190425222832-ad9eeb80039a
 	google.golang.org/api v0.4.0
 	google.golang.org/genproto v0.0.0-20190425155659-357c62f0e4bb
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 go 1.12
@@ -0,0 +1,71 @@
+package migrate
+
+import (
+	"github.com/hashicorp/go-multierror"
+)
+
+// Hooks is an interface so you can run your own code around
+// migrations, i.e. to refresh a materialized view or to check
+// a precondition. Returning an error aborts the run.
+type Hooks interface {
+
+	// BeforeRun is called once before the first migration of a run.
+	// It is not called if there is nothing to migrate.
+	BeforeRun() error
+
+	// BeforeMigration is called before the version is set to dirty,
+	// so an error leaves the database untouched.
+	BeforeMigration(migr *Migration) error
+
+	// AfterMigration is called after the migration body ran, with the
+	// error returned by the database driver, if any. The version is still
+	// dirty at this point and stays dirty if an error is returned.
+	AfterMigration(migr *Migration, err error) error
+
+	// AfterRun is called at the end of every run that called BeforeRun,
+	// with the error the run is about to return, if any.
+	AfterRun(err error) error
+}
+
+func (m *Migrate) beforeRun() error {
+	if m.Hooks == nil {
+		return nil
+	}
+	return m.Hooks.BeforeRun()
+}
+
+func (m *Migrate) beforeMigration(migr *Migration) error {
+	if m.Hooks == nil {
+		return nil
+	}
+	return m.Hooks.BeforeMigration(migr)
+}
+
+// afterMigration calls the AfterMigration hook and returns
+// err combined with the error returned by the hook.
+func (m *Migrate) afterMigration(migr *Migration, err error) error {
+	if m.Hooks == nil {
+		return err
+	}
+	return appendErr(err, m.Hooks.AfterMigration(migr, err))
+}
+
+// afterRun calls the AfterRun hook and returns err
+// combined with the error returned by the hook.
+func (m *Migrate) afterRun(err error) error {
+	if m.Hooks == nil {
+		return err
+	}
+	return appendErr(err, m.Hooks.AfterRun(err))
+}
+
+// appendErr combines err and other, keeping err as is if other is nil.
+func appendErr(err, other error) error {
+	if other == nil {
+		return err
+	}
+	if err == nil {
+		return other
+	}
+	return multierror.Append(err, other)
+}
@@ -1,15 +1,19 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/solvedata/migrate/v4"
 	_ "github.com/solvedata/migrate/v4/database/stub" // TODO remove again
 	_ "github.com/solvedata/migrate/v4/source/file"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -63,29 +67,29 @@ func cleanDir(dir string) string {
 }
 
 // createCmd (meant to be called via a CLI command) creates a new migration
-func createCmd(dir string, startTime time.Time, format string, name string, ext string, seq bool, seqDigits int) {
+func createCmd(log *Log, dir string, startTime time.Time, format string, name string, ext string, seq bool, seqDigits int) error {
 	dir = cleanDir(dir)
 	var base string
 	if seq && format != defaultTimeFormat {
-		log.fatalErr(errors.New("The seq and format options are mutually exclusive"))
+		return log.fatalErr(errors.New("The seq and format options are mutually exclusive"))
 	}
 	if seq {
 		if seqDigits <= 0 {
-			log.fatalErr(errors.New("Digits must be positive"))
+			return log.fatalErr(errors.New("Digits must be positive"))
 		}
 		matches, err := filepath.Glob(dir + "*" + ext)
 		if err != nil {
-			log.fatalErr(err)
+			return log.fatalErr(err)
 		}
 		nextSeqStr, err := nextSeq(matches, dir, seqDigits)
 		if err != nil {
-			log.fatalErr(err)
+			return log.fatalErr(err)
 		}
 		base = fmt.Sprintf("%v%v_%v.", dir, nextSeqStr, name)
 	} else {
 		switch format {
 		case "":
-			log.fatal("Time format may not be empty")
+			return log.usage("time format may not be empty")
 		case "unix":
 			base = fmt.Sprintf("%v%v_%v.", dir, startTime.Unix(), name)
 		case "unixNano":
@@ -96,91 +100,248 @@ func createCmd(dir string, startTime time.Time, format string, name string, ext
 	}
 
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		log.fatalErr(err)
+		return log.fatalErr(err)
 	}
 
-	createFile(base + "up" + ext)
-	createFile(base + "down" + ext)
+	if err := createFile(log, base+"up"+ext); err != nil {
+		return err
+	}
+	return createFile(log, base+"down"+ext)
 }
 
-func createFile(fname string) {
-	if _, err := os.Create(fname); err != nil {
-		log.fatalErr(err)
+func createFile(log *Log, fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return log.fatalErr(err)
+	}
+	if err := f.Close(); err != nil {
+		return log.fatalErr(err)
 	}
+	log.output.addFile(fname)
+	return nil
 }
 
-func gotoCmd(m *migrate.Migrate, v uint) {
-	if err := m.Migrate(v); err != nil {
-		if err != migrate.ErrNoChange {
-			log.fatalErr(err)
-		} else {
-			log.Println(err)
-		}
+// migrateErr prints err of a command that migrates, if any. Nothing to
+// apply is only an error if -fail-on-no-change is set.
+func migrateErr(log *Log, err error) error {
+	switch err {
+	case nil:
+		return nil
+	case migrate.ErrNoChange:
+		return log.noChange(err)
 	}
+	return log.fatalErr(err)
 }
 
-func upCmd(m *migrate.Migrate, limit int) {
-	if limit >= 0 {
-		if err := m.Steps(limit); err != nil {
-			if err != migrate.ErrNoChange {
-				log.fatalErr(err)
-			} else {
-				log.Println(err)
-			}
-		}
-	} else {
-		if err := m.Up(); err != nil {
-			if err != migrate.ErrNoChange {
-				log.fatalErr(err)
-			} else {
-				log.Println(err)
-			}
-		}
+func gotoCmd(ctx context.Context, log *Log, m *migrate.Migrate, v uint, dryRun bool) error {
+	if dryRun {
+		plan, err := m.PlanMigrate(v)
+		return planCmd(log, plan, err)
 	}
+	return migrateErr(log, m.MigrateContext(ctx, v))
 }
 
-func downCmd(m *migrate.Migrate, limit int) {
-	if limit >= 0 {
-		if err := m.Steps(-limit); err != nil {
-			if err != migrate.ErrNoChange {
-				log.fatalErr(err)
-			} else {
-				log.Println(err)
-			}
+func upCmd(ctx context.Context, log *Log, m *migrate.Migrate, limit int, dryRun bool, resume bool) error {
+	if dryRun {
+		if limit >= 0 {
+			plan, err := m.PlanSteps(limit)
+			return planCmd(log, plan, err)
 		}
-	} else {
-		if err := m.Down(); err != nil {
-			if err != migrate.ErrNoChange {
-				log.fatalErr(err)
-			} else {
-				log.Println(err)
-			}
+		plan, err := m.PlanUp()
+		return planCmd(log, plan, err)
+	}
+
+	switch {
+	case limit >= 0:
+		return migrateErr(log, m.StepsContext(ctx, limit))
+	case resume:
+		return migrateErr(log, m.ResumeContext(ctx))
+	}
+	return migrateErr(log, m.UpContext(ctx))
+}
+
+func downCmd(ctx context.Context, log *Log, m *migrate.Migrate, limit int, dryRun bool) error {
+	if dryRun {
+		if limit >= 0 {
+			plan, err := m.PlanSteps(-limit)
+			return planCmd(log, plan, err)
 		}
+		plan, err := m.PlanDown()
+		return planCmd(log, plan, err)
+	}
+
+	if limit >= 0 {
+		return migrateErr(log, m.StepsContext(ctx, -limit))
 	}
+	return migrateErr(log, m.DownContext(ctx))
 }
 
-func dropCmd(m *migrate.Migrate) {
-	if err := m.Drop(); err != nil {
-		log.fatalErr(err)
+// planCmd prints the migrations returned by one of the migrate.Plan* methods
+func planCmd(log *Log, plan []*migrate.Migration, err error) error {
+	if err != nil {
+		return migrateErr(log, err)
+	}
+
+	for _, migr := range plan {
+		log.Printf("%v (version %v => %v, %v bytes)\n", migr.LogString(), migr.Version, migr.TargetVersion, migr.BytesRead)
 	}
+	return nil
 }
 
-func forceCmd(m *migrate.Migrate, v int) {
-	if err := m.Force(v); err != nil {
-		log.fatalErr(err)
+func dropCmd(ctx context.Context, log *Log, m *migrate.Migrate) error {
+	if err := m.DropContext(ctx); err != nil {
+		return log.fatalErr(err)
 	}
+	return nil
 }
 
-func versionCmd(m *migrate.Migrate) {
+func forceCmd(ctx context.Context, log *Log, m *migrate.Migrate, v int) error {
+	if err := m.ForceContext(ctx, v); err != nil {
+		return log.fatalErr(err)
+	}
+	return nil
+}
+
+func versionCmd(log *Log, m *migrate.Migrate) error {
 	v, dirty, err := m.Version()
 	if err != nil {
-		log.fatalErr(err)
+		return log.fatalErr(err)
 	}
-	if dirty {
-		log.Printf("%v (dirty)\n", v)
-	} else {
+	if !dirty {
 		log.Println(v)
+		return nil
+	}
+
+	done, total, err := m.Progress()
+	if err != nil {
+		return log.fatalErr(err)
+	}
+	if total > 0 {
+		log.Printf("%v (dirty at statement %v of %v)\n", v, failedStatement(done, total), total)
+	} else {
+		log.Printf("%v (dirty)\n", v)
+	}
+	return nil
+}
+
+// failedStatement returns the 1-based index of the statement that
+// failed after done of total statements succeeded.
+func failedStatement(done, total int) int {
+	if done < total {
+		return done + 1
+	}
+	return total
+}
+
+// statusCmd prints the state of every migration version
+// to w, as a table or as JSON if format is json.
+func statusCmd(log *Log, w io.Writer, m *migrate.Migrate, format string) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return log.fatalErr(err)
+	}
+	if err := printStatus(w, statuses, format); err != nil {
+		return log.fatalErr(err)
+	}
+	return nil
+}
+
+func printStatus(w io.Writer, statuses []migrate.MigrationStatus, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tSTATE\tUP\tDOWN\tIDENTIFIER")
+		for _, s := range statuses {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", s.Version, statusState(s), yesNo(s.Up), yesNo(s.Down), s.Identifier)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown format %q, expected text or json", format)
+}
+
+// statusState describes the state of s for the status table.
+func statusState(s migrate.MigrationStatus) string {
+	state := string(s.State)
+	switch {
+	case s.State == migrate.StateMissing:
+		state = "missing from source"
+	case s.State == migrate.StateCurrent && !s.Up && !s.Down:
+		state += ", missing from source"
+	}
+	if s.Dirty {
+		state += " (dirty)"
+	}
+	return state
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// verifyCmd prints every applied migration that changed in the source
+// and fails if there is any.
+func verifyCmd(log *Log, m *migrate.Migrate) error {
+	mismatches, err := m.Verify()
+	if err != nil {
+		return log.fatalErr(err)
+	}
+	for _, c := range mismatches {
+		log.Println(c)
+	}
+	if len(mismatches) > 0 {
+		return log.fatalErr(mismatchError{fmt.Errorf("%v applied migration(s) changed in source", len(mismatches))})
+	}
+	return nil
+}
+
+// lockStatusCmd prints who holds the migration lock and since when.
+func lockStatusCmd(log *Log, m *migrate.Migrate) error {
+	held, owner, since, err := m.LockStatus()
+	if err != nil {
+		return log.fatalErr(err)
+	}
+	switch {
+	case !held:
+		log.Println("not locked")
+	case since.IsZero():
+		log.Printf("locked by %v\n", owner)
+	default:
+		log.Printf("locked by %v since %v (%v)\n", owner, since.Format(time.RFC3339), time.Since(since).Round(time.Second))
+	}
+	return nil
+}
+
+// lockBreakCmd releases the migration lock no matter who holds it.
+func lockBreakCmd(log *Log, m *migrate.Migrate) error {
+	held, owner, _, err := m.LockStatus()
+	if err != nil {
+		return log.fatalErr(err)
 	}
+	if !held {
+		log.Println("not locked")
+		return nil
+	}
+	if err := m.ForceUnlock(); err != nil {
+		return log.fatalErr(err)
+	}
+	log.Printf("broke lock held by %v\n", owner)
+	return nil
+}
+
+// confirm asks the question and returns true if the answer read from r is y.
+func confirm(log *Log, r io.Reader, question string) bool {
+	log.Println(question + " [y/N]")
+	var response string
+	fmt.Fscanln(r, &response)
+	return strings.ToLower(strings.TrimSpace(response)) == "y"
 }
 
 // numDownMigrationsFromArgs returns an int for number of migrations to apply
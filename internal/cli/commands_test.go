@@ -1,7 +1,11 @@
 package cli
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
+
+	"github.com/solvedata/migrate/v4"
 )
 
 func TestCleanDir(t *testing.T) {
@@ -116,3 +120,42 @@ func TestNumDownFromArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestPrintStatus(t *testing.T) {
+	statuses := []migrate.MigrationStatus{
+		{Version: 1, Identifier: "create_users", State: migrate.StateApplied, Up: true, Down: true},
+		{Version: 2, Identifier: "dropped", State: migrate.StateMissing},
+		{Version: 3, Identifier: "add_index", State: migrate.StateCurrent, Dirty: true, Up: true},
+		{Version: 4, Identifier: "backfill", State: migrate.StatePending, Up: true, Down: true},
+	}
+
+	var buf bytes.Buffer
+	if err := printStatus(&buf, statuses, "text"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `VERSION  STATE                UP   DOWN  IDENTIFIER
+1        applied              yes  yes   create_users
+2        missing from source  no   no    dropped
+3        current (dirty)      yes  no    add_index
+4        pending              yes  yes   backfill
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%v\ngot\n%v", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := printStatus(&buf, statuses[:1], "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []migrate.MigrationStatus
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0] != statuses[0] {
+		t.Errorf("expected %v, got %v", statuses[:1], decoded)
+	}
+
+	if err := printStatus(&buf, statuses, "yaml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
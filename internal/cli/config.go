@@ -0,0 +1,233 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// configFiles are looked up in the working directory, in this order,
+// unless the config file is given with -config.
+var configFiles = []string{"migrate.yml", "migrate.yaml", "migrate.toml", "migrate.json"}
+
+// envVarPattern matches ${NAME} in URLs of the config file.
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// config is the content of a config file. The settings at the top
+// apply to all environments, which can override them.
+type config struct {
+	settings `yaml:",inline"`
+
+	Environments map[string]settings `yaml:"environments" toml:"environments" json:"environments"`
+}
+
+// settings are the flags a config file can set. Zero values are unset,
+// bools are pointers so an environment can switch them off.
+type settings struct {
+	Source   string `yaml:"source" toml:"source" json:"source"`
+	Database string `yaml:"database" toml:"database" json:"database"`
+	Prefetch uint   `yaml:"prefetch" toml:"prefetch" json:"prefetch"`
+
+	LockTimeout       uint   `yaml:"lock-timeout" toml:"lock-timeout" json:"lock-timeout"`
+	LockURL           string `yaml:"lock-url" toml:"lock-url" json:"lock-url"`
+	AutoRollback      *bool  `yaml:"auto-rollback" toml:"auto-rollback" json:"auto-rollback"`
+	SingleTransaction *bool  `yaml:"single-transaction" toml:"single-transaction" json:"single-transaction"`
+	TrackStatements   *bool  `yaml:"track-statements" toml:"track-statements" json:"track-statements"`
+	FailOnNoChange    *bool  `yaml:"fail-on-no-change" toml:"fail-on-no-change" json:"fail-on-no-change"`
+
+	Create createSettings `yaml:"create" toml:"create" json:"create"`
+}
+
+// createSettings are the defaults for the flags of the create command.
+type createSettings struct {
+	Ext    string `yaml:"ext" toml:"ext" json:"ext"`
+	Dir    string `yaml:"dir" toml:"dir" json:"dir"`
+	Seq    *bool  `yaml:"seq" toml:"seq" json:"seq"`
+	Digits int    `yaml:"digits" toml:"digits" json:"digits"`
+}
+
+// loadConfig reads the config file at path or, if path is empty, the first
+// of configFiles in the working directory. It returns nil if there is none.
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		for _, name := range configFiles {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+		if path == "" {
+			return nil, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// unknown keys are rejected, they are most likely typos
+	c := &config{}
+	switch ext := filepath.Ext(path); ext {
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, key := range undecoded {
+				keys = append(keys, key.String())
+			}
+			err = fmt.Errorf("unknown keys %v", strings.Join(keys, ", "))
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return nil, fmt.Errorf("%v: unknown config format %q, expected .yml, .toml or .json", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return c, nil
+}
+
+// environment returns the settings for the environment env, if not
+// empty, on top of the settings for all environments, with ${NAME}
+// in URLs expanded from the environment variables. env must be defined,
+// unless the config has no environments and env only selects directives.
+func (c *config) environment(env string) (settings, error) {
+	s := c.settings
+	if env != "" && len(c.Environments) > 0 {
+		e, ok := c.Environments[env]
+		if !ok {
+			return s, fmt.Errorf("environment %q is not defined in the config file", env)
+		}
+		s = s.override(e)
+	}
+
+	for _, url := range []*string{&s.Source, &s.Database, &s.LockURL} {
+		expanded, err := expandEnv(*url)
+		if err != nil {
+			return s, err
+		}
+		*url = expanded
+	}
+	return s, nil
+}
+
+// override returns s with the fields that are set in o replaced.
+func (s settings) override(o settings) settings {
+	if o.Source != "" {
+		s.Source = o.Source
+	}
+	if o.Database != "" {
+		s.Database = o.Database
+	}
+	if o.Prefetch != 0 {
+		s.Prefetch = o.Prefetch
+	}
+	if o.LockTimeout != 0 {
+		s.LockTimeout = o.LockTimeout
+	}
+	if o.LockURL != "" {
+		s.LockURL = o.LockURL
+	}
+	if o.AutoRollback != nil {
+		s.AutoRollback = o.AutoRollback
+	}
+	if o.SingleTransaction != nil {
+		s.SingleTransaction = o.SingleTransaction
+	}
+	if o.TrackStatements != nil {
+		s.TrackStatements = o.TrackStatements
+	}
+	if o.FailOnNoChange != nil {
+		s.FailOnNoChange = o.FailOnNoChange
+	}
+
+	if o.Create.Ext != "" {
+		s.Create.Ext = o.Create.Ext
+	}
+	if o.Create.Dir != "" {
+		s.Create.Dir = o.Create.Dir
+	}
+	if o.Create.Seq != nil {
+		s.Create.Seq = o.Create.Seq
+	}
+	if o.Create.Digits != 0 {
+		s.Create.Digits = o.Create.Digits
+	}
+	return s
+}
+
+// apply sets the flags of fs that are set in s, but weren't given on
+// the command line. -path counts as -source.
+func (s settings) apply(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if given["path"] {
+		given["source"] = true
+	}
+
+	values := map[string]string{
+		"source":   s.Source,
+		"database": s.Database,
+		"lock-url": s.LockURL,
+	}
+	if s.Prefetch != 0 {
+		values["prefetch"] = strconv.FormatUint(uint64(s.Prefetch), 10)
+	}
+	if s.LockTimeout != 0 {
+		values["lock-timeout"] = strconv.FormatUint(uint64(s.LockTimeout), 10)
+	}
+	for name, value := range map[string]*bool{
+		"auto-rollback":      s.AutoRollback,
+		"single-transaction": s.SingleTransaction,
+		"track-statements":   s.TrackStatements,
+		"fail-on-no-change":  s.FailOnNoChange,
+	} {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+
+	for name, value := range values {
+		if value == "" || given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces ${NAME} in s with the environment variable NAME,
+// which must be set.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envVarPattern.ReplaceAllStringFunc(s, func(match string) string {
+		name := envVarPattern.FindStringSubmatch(match)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %v is not set", name)
+		}
+		return value
+	})
+	return expanded, err
+}
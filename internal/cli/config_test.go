@@ -0,0 +1,196 @@
+package cli
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testConfigs = map[string]string{
+	"migrate.yml": `
+source: file://migrations
+lock-timeout: 30
+auto-rollback: true
+create:
+  ext: sql
+  dir: migrations
+  seq: true
+environments:
+  prod:
+    database: postgres://app:${MIGRATE_TEST_PASSWORD}@db/app
+    auto-rollback: false
+    create:
+      digits: 4
+`,
+	"migrate.toml": `
+source = "file://migrations"
+lock-timeout = 30
+auto-rollback = true
+
+[create]
+ext = "sql"
+dir = "migrations"
+seq = true
+
+[environments.prod]
+database = "postgres://app:${MIGRATE_TEST_PASSWORD}@db/app"
+auto-rollback = false
+
+[environments.prod.create]
+digits = 4
+`,
+	"migrate.json": `{
+	"source": "file://migrations",
+	"lock-timeout": 30,
+	"auto-rollback": true,
+	"create": {"ext": "sql", "dir": "migrations", "seq": true},
+	"environments": {
+		"prod": {
+			"database": "postgres://app:${MIGRATE_TEST_PASSWORD}@db/app",
+			"auto-rollback": false,
+			"create": {"digits": 4}
+		}
+	}
+}`,
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Setenv("MIGRATE_TEST_PASSWORD", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("MIGRATE_TEST_PASSWORD")
+
+	expected := settings{
+		Source:       "file://migrations",
+		Database:     "postgres://app:secret@db/app",
+		LockTimeout:  30,
+		AutoRollback: boolPtr(false),
+		Create:       createSettings{Ext: "sql", Dir: "migrations", Seq: boolPtr(true), Digits: 4},
+	}
+
+	for name, content := range testConfigs {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := c.environment("prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, s) {
+				t.Errorf("expected %+v, got %+v", expected, s)
+			}
+
+			if _, err := c.environment("staging"); err == nil {
+				t.Error("expected an error for an undefined environment")
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != nil {
+		t.Errorf("expected no config without a config file, got %+v", c)
+	}
+
+	if _, err := loadConfig("nope.yml"); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"migrate.yml":  "auto-rollbak: true\n",
+		"migrate.toml": "auto-rollbak = true\n",
+		"migrate.json": `{"auto-rollbak": true}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadConfig(path); err == nil {
+				t.Error("expected an error for an unknown key")
+			}
+		})
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	if err := os.Setenv("MIGRATE_TEST_HOST", "db"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("MIGRATE_TEST_HOST")
+
+	s, err := expandEnv("postgres://${MIGRATE_TEST_HOST}/app?search_path=$user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "postgres://db/app?search_path=$user" {
+		t.Errorf("expected postgres://db/app?search_path=$user, got %v", s)
+	}
+
+	if _, err := expandEnv("postgres://${MIGRATE_TEST_UNSET}/app"); err == nil {
+		t.Error("expected an error for an unset variable")
+	}
+}
+
+func TestSettingsApply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	source := fs.String("source", "", "")
+	path := fs.String("path", "", "")
+	database := fs.String("database", "", "")
+	lockTimeout := fs.Uint("lock-timeout", 15, "")
+	fs.String("lock-url", "", "")
+	fs.Uint("prefetch", 10, "")
+	fs.Bool("auto-rollback", false, "")
+	fs.Bool("single-transaction", false, "")
+	fs.Bool("track-statements", false, "")
+	fs.Bool("fail-on-no-change", false, "")
+	if err := fs.Parse([]string{"-path", "migrations", "-database", "sqlite3://cli.db"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := settings{Source: "file://config", Database: "sqlite3://config.db", LockTimeout: 30}
+	if err := s.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *source != "" || *path != "migrations" {
+		t.Errorf("expected -path to take precedence over the source of the config, got %q", *source)
+	}
+	if *database != "sqlite3://cli.db" {
+		t.Errorf("expected -database to take precedence over the config, got %q", *database)
+	}
+	if *lockTimeout != 30 {
+		t.Errorf("expected lock timeout 30 from the config, got %v", *lockTimeout)
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"sort"
+
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+	iurl "github.com/solvedata/migrate/v4/internal/url"
+	"github.com/solvedata/migrate/v4/lock"
+	"github.com/solvedata/migrate/v4/source"
+)
+
+// newMigrate returns a new Migrate instance like migrate.New,
+// but opens the URLs with the drivers of o for their scheme, if any.
+func (o *Options) newMigrate(sourceURL, databaseURL string) (*migrate.Migrate, error) {
+	sourceName, err := iurl.SchemeFromURL(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	databaseName, err := iurl.SchemeFromURL(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var sourceDrv source.Driver
+	if d, ok := o.SourceDrivers[sourceName]; ok {
+		sourceDrv, err = d.Open(sourceURL)
+	} else {
+		sourceDrv, err = source.Open(sourceURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var databaseDrv database.Driver
+	if d, ok := o.DatabaseDrivers[databaseName]; ok {
+		databaseDrv, err = d.Open(databaseURL)
+	} else {
+		databaseDrv, err = database.Open(databaseURL)
+	}
+	if err != nil {
+		sourceDrv.Close()
+		return nil, err
+	}
+
+	m, err := migrate.NewWithInstance(sourceName, sourceDrv, databaseName, databaseDrv)
+	if err == nil {
+		m.Vars, err = migrate.VarsFromURL(databaseURL)
+	}
+	if err != nil {
+		sourceDrv.Close()
+		databaseDrv.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// openLock is like lock.Open, but opens url with
+// the lock driver of o for its scheme, if any.
+func (o *Options) openLock(url string) (lock.Driver, error) {
+	scheme, err := iurl.SchemeFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := o.LockDrivers[scheme]; ok {
+		return d.Open(url)
+	}
+	return lock.Open(url)
+}
+
+// sourceDrivers, databaseDrivers and lockDrivers return the sorted
+// names of the registered drivers and those of o.
+func (o *Options) sourceDrivers() []string {
+	names := source.List()
+	for name := range o.SourceDrivers {
+		names = append(names, name)
+	}
+	return sortedNames(names)
+}
+
+func (o *Options) databaseDrivers() []string {
+	names := database.List()
+	for name := range o.DatabaseDrivers {
+		names = append(names, name)
+	}
+	return sortedNames(names)
+}
+
+func (o *Options) lockDrivers() []string {
+	names := lock.List()
+	for name := range o.LockDrivers {
+		names = append(names, name)
+	}
+	return sortedNames(names)
+}
+
+// sortedNames sorts names and removes duplicates.
+func sortedNames(names []string) []string {
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
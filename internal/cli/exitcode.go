@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+)
+
+// Exit codes of the CLI, documented in the usage.
+const (
+	exitError           = 1
+	exitUsage           = 2
+	exitDatabaseError   = 3
+	exitDirty           = 4
+	exitLocked          = 5
+	exitLockTimeout     = 6
+	exitNotExist        = 7
+	exitShortLimit      = 8
+	exitOpen            = 9
+	exitNoChange        = 10
+	exitVersionConflict = 11
+	exitOutOfOrder      = 12
+	exitLeaseLost       = 13
+	exitMismatch        = 14
+)
+
+// openError is an error opening the source or the database,
+// i.e. an invalid URL or an unknown driver.
+type openError struct {
+	error
+}
+
+// usageError is an invalid command or invalid flags.
+type usageError struct {
+	error
+}
+
+// mismatchError is returned by verify if applied migrations changed in the source.
+type mismatchError struct {
+	error
+}
+
+// ExitCode returns the exit code of Main for err returned by Run,
+// which is 0 for nil.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCode(err)
+}
+
+// exitCode returns the exit code for the class of err.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case *multierror.Error:
+		// a lost lock explains the errors of the run it cancelled,
+		// otherwise the first error is the one of the run and the
+		// others are of releasing the lock
+		for _, wrapped := range e.WrappedErrors() {
+			if wrapped == database.ErrLeaseLost {
+				return exitLeaseLost
+			}
+		}
+		if len(e.WrappedErrors()) > 0 {
+			return exitCode(e.WrappedErrors()[0])
+		}
+	case usageError:
+		return exitUsage
+	case mismatchError:
+		return exitMismatch
+	case openError:
+		if code := exitCode(e.error); code != exitError {
+			return code
+		}
+		return exitOpen
+	case migrate.RollbackError:
+		return exitCode(e.Err)
+	case migrate.ErrDirty:
+		return exitDirty
+	case migrate.ErrShortLimit:
+		return exitShortLimit
+	case migrate.ErrOutOfOrder:
+		return exitOutOfOrder
+	case database.ErrVersionConflict:
+		return exitVersionConflict
+	case database.Error, *database.Error:
+		return exitDatabaseError
+	}
+
+	switch {
+	case err == migrate.ErrLocked || err == database.ErrLocked:
+		return exitLocked
+	case err == migrate.ErrLockTimeout:
+		return exitLockTimeout
+	case err == database.ErrLeaseLost:
+		return exitLeaseLost
+	case err == migrate.ErrNoChange:
+		return exitNoChange
+	case os.IsNotExist(err):
+		return exitNotExist
+	}
+	return exitError
+}
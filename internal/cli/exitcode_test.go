@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+)
+
+func TestExitCode(t *testing.T) {
+	dbErr := database.Error{OrigErr: errors.New("syntax error")}
+	cases := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "other", err: errors.New("oops"), expected: exitError},
+		{name: "database error", err: dbErr, expected: exitDatabaseError},
+		{name: "database error pointer", err: &dbErr, expected: exitDatabaseError},
+		{name: "rolled back", err: migrate.RollbackError{Version: 1, Err: dbErr}, expected: exitDatabaseError},
+		{name: "dirty", err: migrate.ErrDirty{Version: 1}, expected: exitDirty},
+		{name: "locked", err: migrate.ErrLocked, expected: exitLocked},
+		{name: "driver locked", err: database.ErrLocked, expected: exitLocked},
+		{name: "lock timeout", err: migrate.ErrLockTimeout, expected: exitLockTimeout},
+		{name: "not found", err: &os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, expected: exitNotExist},
+		{name: "short limit", err: migrate.ErrShortLimit{Short: 1}, expected: exitShortLimit},
+		{name: "no change", err: migrate.ErrNoChange, expected: exitNoChange},
+		{name: "version conflict", err: database.ErrVersionConflict{}, expected: exitVersionConflict},
+		{name: "open", err: openError{errors.New("unknown driver")}, expected: exitOpen},
+		{name: "open not found", err: openError{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}}, expected: exitNotExist},
+		{name: "out of order", err: migrate.ErrOutOfOrder{Versions: []uint{1}}, expected: exitOutOfOrder},
+		{name: "lease lost", err: database.ErrLeaseLost, expected: exitLeaseLost},
+		{name: "mismatch", err: mismatchError{errors.New("changed")}, expected: exitMismatch},
+		{name: "usage", err: usageError{errors.New("please specify name")}, expected: exitUsage},
+		{name: "unlock failed", err: multierror.Append(migrate.ErrDirty{Version: 1}, errors.New("unlock failed")), expected: exitDirty},
+		{name: "run cancelled by lease lost", err: multierror.Append(context.Canceled, database.ErrLeaseLost), expected: exitLeaseLost},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if code := exitCode(c.err); code != c.expected {
+				t.Errorf("expected exit code %v, got %v", c.expected, code)
+			}
+		})
+	}
+}
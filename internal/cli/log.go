@@ -1,28 +1,60 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	logpkg "log"
-	"os"
+	"strings"
+
+	"github.com/solvedata/migrate/v4"
 )
 
 type Log struct {
 	verbose bool
+
+	// w receives the messages, with timestamps if verbose
+	w      io.Writer
+	stdlog *logpkg.Logger
+
+	// logger receives the messages instead of w, if set
+	logger migrate.Logger
+
+	// output prints the result of the command for -output json, if set
+	output *jsonOutput
+
+	// failOnNoChange makes commands that change nothing fail
+	failOnNoChange bool
+}
+
+// newLog returns a Log printing to w, or to logger if not nil.
+func newLog(w io.Writer, logger migrate.Logger) *Log {
+	return &Log{
+		w:      w,
+		stdlog: logpkg.New(w, "", logpkg.LstdFlags),
+		logger: logger,
+	}
 }
 
 func (l *Log) Printf(format string, v ...interface{}) {
-	if l.verbose {
-		logpkg.Printf(format, v...)
-	} else {
-		fmt.Fprintf(os.Stderr, format, v...)
+	switch {
+	case l.logger != nil:
+		l.logger.Printf(format, v...)
+	case l.verbose:
+		l.stdlog.Printf(format, v...)
+	default:
+		fmt.Fprintf(l.w, format, v...)
 	}
 }
 
 func (l *Log) Println(args ...interface{}) {
-	if l.verbose {
-		logpkg.Println(args...)
-	} else {
-		fmt.Fprintln(os.Stderr, args...)
+	switch {
+	case l.logger != nil:
+		l.logger.Printf("%s", fmt.Sprintln(args...))
+	case l.verbose:
+		l.stdlog.Println(args...)
+	default:
+		fmt.Fprintln(l.w, args...)
 	}
 }
 
@@ -30,11 +62,31 @@ func (l *Log) Verbose() bool {
 	return l.verbose
 }
 
-func (l *Log) fatal(args ...interface{}) {
+// fatal prints args and returns them as an error.
+func (l *Log) fatal(args ...interface{}) error {
 	l.Println(args...)
-	os.Exit(1)
+	return errors.New(strings.TrimPrefix(fmt.Sprint(args...), "error: "))
+}
+
+// usage prints msg and returns it as a usageError,
+// for invalid arguments and flag values.
+func (l *Log) usage(msg string) error {
+	l.Println("error:", msg)
+	return usageError{errors.New(msg)}
 }
 
-func (l *Log) fatalErr(err error) {
-	l.fatal("error:", err)
+// fatalErr prints err and returns it.
+func (l *Log) fatalErr(err error) error {
+	l.Println("error:", err)
+	return err
+}
+
+// noChange prints err, which is migrate.ErrNoChange,
+// or fails with it if failOnNoChange is set.
+func (l *Log) noChange(err error) error {
+	if l.failOnNoChange {
+		return l.fatalErr(err)
+	}
+	l.Println(err)
+	return nil
 }
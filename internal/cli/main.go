@@ -1,8 +1,12 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"strconv"
@@ -12,26 +16,115 @@ import (
 
 	"github.com/solvedata/migrate/v4"
 	"github.com/solvedata/migrate/v4/database"
+	iurl "github.com/solvedata/migrate/v4/internal/url"
+	"github.com/solvedata/migrate/v4/lock"
+	_ "github.com/solvedata/migrate/v4/lock/flock"
+	_ "github.com/solvedata/migrate/v4/lock/sqlrow"
+	"github.com/solvedata/migrate/v4/metrics"
 	"github.com/solvedata/migrate/v4/source"
 )
 
 const defaultTimeFormat = "20060102150405"
 
-// set main log
-var log = &Log{}
+// Options are what a run of the CLI uses instead of the
+// globals of the process, so it can run within other programs.
+type Options struct {
+	// Version is printed by -version.
+	Version string
+
+	// Stdin answers confirmations, none are given if nil.
+	// Stdout and Stderr are discarded if nil.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Logger receives the messages otherwise printed to Stderr, if set.
+	Logger migrate.Logger
+
+	// Signals stop the migrations after the running one, if set.
+	Signals <-chan os.Signal
+
+	// SourceDrivers, DatabaseDrivers and LockDrivers open the URLs with
+	// their key as scheme, instead of the globally registered drivers.
+	SourceDrivers   map[string]source.Driver
+	DatabaseDrivers map[string]database.Driver
+	LockDrivers     map[string]lock.Driver
+}
 
 func Main(version string) {
-	helpPtr := flag.Bool("help", false, "")
-	versionPtr := flag.Bool("version", false, "")
-	verbosePtr := flag.Bool("verbose", false, "")
-	prefetchPtr := flag.Uint("prefetch", 10, "")
-	lockTimeoutPtr := flag.Uint("lock-timeout", 15, "")
-	pathPtr := flag.String("path", "", "")
-	databasePtr := flag.String("database", "", "")
-	sourcePtr := flag.String("source", "", "")
-
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr,
+	// handle Ctrl+c
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT)
+
+	err := Run(context.Background(), os.Args[1:], Options{
+		Version: version,
+		Stdin:   os.Stdin,
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+		Signals: signals,
+	})
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// Run runs the CLI with args, which don't include the program name. It
+// returns the error the command failed with, which has been printed
+// already and whose class is the exit code of Main. Once ctx is done,
+// migrations stop at the next safe point.
+func Run(ctx context.Context, args []string, opts Options) (err error) {
+	if opts.Stdin == nil {
+		opts.Stdin = strings.NewReader("")
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = ioutil.Discard
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = ioutil.Discard
+	}
+	log := newLog(opts.Stderr, opts.Logger)
+
+	// closers release what the command used, once its result is printed
+	var closers []func()
+	defer func() {
+		if u, ok := err.(usageError); ok && u.error == flag.ErrHelp {
+			err = nil
+		}
+		if log.output != nil {
+			log.output.print(err)
+		}
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}()
+
+	fs := newFlagSet("migrate", opts.Stderr)
+	helpPtr := fs.Bool("help", false, "")
+	versionPtr := fs.Bool("version", false, "")
+	verbosePtr := fs.Bool("verbose", false, "")
+	prefetchPtr := fs.Uint("prefetch", 10, "")
+	lockTimeoutPtr := fs.Uint("lock-timeout", 15, "")
+	pathPtr := fs.String("path", "", "")
+	databasePtr := fs.String("database", "", "")
+	sourcePtr := fs.String("source", "", "")
+	logFormatPtr := fs.String("log-format", "text", "")
+	outputPtr := fs.String("output", "text", "")
+	failOnNoChangePtr := fs.Bool("fail-on-no-change", false, "")
+	metricsFilePtr := fs.String("metrics-file", "", "")
+	metricsAddrPtr := fs.String("metrics-addr", "", "")
+	autoRollbackPtr := fs.Bool("auto-rollback", false, "")
+	singleTransactionPtr := fs.Bool("single-transaction", false, "")
+	trackStatementsPtr := fs.Bool("track-statements", false, "")
+	lockURLPtr := fs.String("lock-url", "", "")
+	envPtr := fs.String("env", "", "")
+	configPtr := fs.String("config", "", "")
+	templatePtr := fs.Bool("template", false, "")
+	varFilePtr := fs.String("var-file", "", "")
+	vars := make(varsFlag)
+	fs.Var(vars, "var", "")
+
+	fs.Usage = func() {
+		fmt.Fprint(opts.Stderr,
 			`Usage: migrate OPTIONS COMMAND [arg...]
        migrate [ -version | -help ]
 
@@ -41,7 +134,34 @@ Options:
   -database        Run migrations against this database (driver://url)
   -prefetch N      Number of migrations to load in advance before executing (default 10)
   -lock-timeout N  Allow N seconds to acquire database lock (default 15)
+  -lock-url URL    Lock with this lock driver (driver://url) instead of the database driver
+  -auto-rollback   Run the down migration of a failed up migration and restore the previous version
+  -single-transaction
+                   Apply all migrations of a command in one transaction, all or nothing
+                   (postgres, cockroachdb, sqlite3 and sqlserver)
+  -track-statements
+                   Run up migrations statement by statement and record the progress,
+                   so a failed migration can be continued with up -resume (mysql)
+  -config P        Read settings from config file P (default: migrate.yml, migrate.yaml,
+                   migrate.toml or migrate.json in the working directory, if any)
+  -env E           Use the settings of environment E of the config file, apply migrations
+                   restricted to E with the env directive, skip those restricted to others
+  -template        Render migrations as text/template templates, i.e. {{.schema}}, with the
+                   variables of -var, -var-file and x-var-* query parameters of the database URL
+  -var K=V         Set template variable K to V, can be repeated (implies -template)
+  -var-file P      Read template variables from file P, one K=V per line (implies -template)
+  -fail-on-no-change
+                   Exit with code 10 if goto, up or down have nothing to apply
   -verbose         Print verbose logging
+  -log-format F    Print migration progress as text or as JSON lines to stdout (text|json, default text)
+  -output F        Print the outcome of the command as text or as JSON to stdout (text|json, default text)
+                   With json, the events of the run are printed as JSON lines, followed by
+                   a document of type result with the migrations that ran, the final version
+                   and the error, if any
+  -metrics-file P  Write Prometheus metrics to file P when done, i.e. for the node exporter textfile collector
+  -metrics-addr A  Serve Prometheus metrics over HTTP on address A (i.e. localhost:9090) while running,
+                   the server stops with the command, so scrapes miss the final version and
+                   outcome, use -metrics-file for those
   -version         Print version
   -help            Print usage
 
@@ -50,32 +170,101 @@ Commands:
 			   Create a set of timestamped up/down migrations titled NAME, in directory D with extension E.
 			   Use -seq option to generate sequential up/down migrations with N digits.
 			   Use -format option to specify a Go time format string.
-  goto V       Migrate to version V
-  up [N]       Apply all or N up migrations
-  down [N]     Apply all or N down migrations
+  goto [-dry-run] V
+               Migrate to version V
+  up [-dry-run] [-allow-out-of-order] [-resume] [N]
+               Apply all or N up migrations
+               Use -allow-out-of-order option to apply older migrations that were never applied
+               first (requires a database with migration history enabled).
+               Use -resume option to continue a dirty migration at the statement that failed
+               (requires -track-statements when it failed).
+  down [-dry-run] [N]
+               Apply all or N down migrations
+               Use -dry-run option to print the migrations goto, up or down would apply.
   drop         Drop everything inside database
   force V      Set version V but don't run migration (ignores dirty state)
   version      Print current migration version
-
-Source drivers: `+strings.Join(source.List(), ", ")+`
-Database drivers: `+strings.Join(database.List(), ", ")+"\n")
+  status [-format F]
+               Print every migration version with its state: applied, pending, current
+               or missing from source, and whether its up and down migrations exist
+               Use -format option to print JSON for tooling (text|json, default text).
+  verify       Compare applied migrations with the source and fail if any changed
+               (requires a database with migration history enabled)
+  lock status  Print who holds the migration lock and since when
+  lock break [-force]
+               Release the migration lock held by another process, i.e. after a deploy job died
+               Use -force option to skip the confirmation.
+
+Exit codes:
+  0   Success, also if there was nothing to apply unless -fail-on-no-change is set
+  1   Other errors
+  2   Invalid command or flags
+  3   Database error, i.e. a failed SQL statement
+  4   Dirty database, fix it and force the version
+  5   Database locked by another run
+  6   Timeout acquiring the database lock
+  7   Source, migration or file not found
+  8   Fewer migrations in the source than requested with N
+  9   Can't open source or database, i.e. invalid URL or unknown driver
+  10  Nothing to apply, with -fail-on-no-change
+  11  The version was changed concurrently by another run
+  12  Migrations older than the current version are missing, see -allow-out-of-order
+  13  The lock lease was lost to another run while migrating
+  14  Applied migrations changed in the source, found by verify
+
+Source drivers: `+strings.Join(opts.sourceDrivers(), ", ")+`
+Database drivers: `+strings.Join(opts.databaseDrivers(), ", ")+`
+Lock drivers: `+strings.Join(opts.lockDrivers(), ", ")+"\n")
 	}
 
-	flag.Parse()
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
 
 	// initialize logger
 	log.verbose = *verbosePtr
 
 	// show cli version
 	if *versionPtr {
-		fmt.Fprintln(os.Stderr, version)
-		os.Exit(0)
+		fmt.Fprintln(opts.Stderr, opts.Version)
+		return nil
 	}
 
 	// show help
 	if *helpPtr {
-		flag.Usage()
-		os.Exit(0)
+		fs.Usage()
+		return nil
+	}
+
+	switch *outputPtr {
+	case "text":
+	case "json":
+		log.output = newJSONOutput(opts.Stdout, fs.Arg(0), "")
+	default:
+		return log.usage("-output must be text or json")
+	}
+
+	// read the config file, flags on the command line take precedence
+	var createDefaults createSettings
+	cfg, err := loadConfig(*configPtr)
+	if err != nil {
+		return log.fatalErr(err)
+	}
+	if cfg != nil {
+		settings, err := cfg.environment(*envPtr)
+		if err != nil {
+			return log.fatalErr(err)
+		}
+		if err := settings.apply(fs); err != nil {
+			return log.fatalErr(err)
+		}
+		createDefaults = settings.Create
+	}
+	log.failOnNoChange = *failOnNoChangePtr
+
+	if log.output != nil {
+		// the driver is unknown if the URL is invalid, which New reports
+		log.output.driver, _ = iurl.SchemeFromURL(*databasePtr)
 	}
 
 	// translate -path into -source if given
@@ -86,76 +275,155 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 	// initialize migrate
 	// don't catch migraterErr here and let each command decide
 	// how it wants to handle the error
-	migrater, migraterErr := migrate.New(*sourcePtr, *databasePtr)
-	defer func() {
-		if migraterErr == nil {
+	migrater, migraterErr := opts.newMigrate(*sourcePtr, *databasePtr)
+	if migraterErr != nil {
+		migraterErr = openError{migraterErr}
+	}
+	if migraterErr == nil {
+		closers = append(closers, func() {
 			if _, err := migrater.Close(); err != nil {
 				log.Println(err)
 			}
+		})
+
+		observers := make([]migrate.Observer, 0)
+		switch *logFormatPtr {
+		case "text":
+			migrater.Log = log
+		case "json":
+			observers = append(observers, migrate.NewJSONObserver(opts.Stdout))
+		default:
+			return log.usage("-log-format must be text or json")
+		}
+
+		if log.output != nil {
+			log.output.m = migrater
+			observers = append(observers, log.output)
+			if *logFormatPtr != "json" {
+				observers = append(observers, migrate.NewJSONObserver(opts.Stdout))
+			}
+		}
+
+		if *metricsFilePtr != "" || *metricsAddrPtr != "" {
+			collector := metrics.NewCollector()
+			observers = append(observers, collector)
+
+			stopMetrics, err := serveMetrics(log, migrater, collector, *metricsFilePtr, *metricsAddrPtr)
+			if err != nil {
+				return err
+			}
+			closers = append(closers, stopMetrics)
+		}
+
+		if len(observers) > 0 {
+			migrater.Observer = migrate.MultiObserver(observers...)
 		}
-	}()
-	if migraterErr == nil {
-		migrater.Log = log
 		migrater.PrefetchMigrations = *prefetchPtr
 		migrater.LockTimeout = time.Duration(int64(*lockTimeoutPtr)) * time.Second
+		migrater.AutoRollback = *autoRollbackPtr
+		migrater.SingleTransaction = *singleTransactionPtr
+		migrater.TrackStatements = *trackStatementsPtr
+		migrater.Env = *envPtr
+
+		// -var takes precedence over -var-file over the database URL
+		migrater.Template = *templatePtr || *varFilePtr != "" || len(vars) > 0
+		if *varFilePtr != "" {
+			fileVars, err := readVarsFile(*varFilePtr)
+			if err != nil {
+				return log.fatalErr(err)
+			}
+			for k, v := range fileVars {
+				migrater.Vars[k] = v
+			}
+		}
+		for k, v := range vars {
+			migrater.Vars[k] = v
+		}
 
-		// handle Ctrl+c
-		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, syscall.SIGINT)
+		if *lockURLPtr != "" {
+			locker, err := opts.openLock(*lockURLPtr)
+			if err != nil {
+				return log.fatalErr(openError{err})
+			}
+			closers = append(closers, func() {
+				if err := locker.Close(); err != nil {
+					log.Println(err)
+				}
+			})
+			migrater.Locker = locker
+		}
+
+		// stop after the running migration on a signal
+		done := make(chan struct{})
+		closers = append(closers, func() { close(done) })
 		go func() {
-			for range signals {
+			select {
+			case <-opts.Signals:
 				log.Println("Stopping after this running migration ...")
 				migrater.GracefulStop <- true
-				return
+			case <-done:
 			}
 		}()
 	}
 
 	startTime := time.Now()
 
-	switch flag.Arg(0) {
+	switch fs.Arg(0) {
 	case "create":
-		args := flag.Args()[1:]
-		seq := false
+		args := fs.Args()[1:]
+		seq := createDefaults.Seq != nil && *createDefaults.Seq
 		seqDigits := 6
+		if createDefaults.Digits != 0 {
+			seqDigits = createDefaults.Digits
+		}
 
-		createFlagSet := flag.NewFlagSet("create", flag.ExitOnError)
-		extPtr := createFlagSet.String("ext", "", "File extension")
-		dirPtr := createFlagSet.String("dir", "", "Directory to place file in (default: current working directory)")
+		createFlagSet := newFlagSet("create", opts.Stderr)
+		extPtr := createFlagSet.String("ext", createDefaults.Ext, "File extension")
+		dirPtr := createFlagSet.String("dir", createDefaults.Dir, "Directory to place file in (default: current working directory)")
 		formatPtr := createFlagSet.String("format", defaultTimeFormat, `The Go time format string to use. If the string "unix" or "unixNano" is specified, then the seconds or nanoseconds since January 1, 1970 UTC respectively will be used. Caution, due to the behavior of time.Time.Format(), invalid format strings will not error`)
 		createFlagSet.BoolVar(&seq, "seq", seq, "Use sequential numbers instead of timestamps (default: false)")
 		createFlagSet.IntVar(&seqDigits, "digits", seqDigits, "The number of digits to use in sequences (default: 6)")
-		if err := createFlagSet.Parse(args); err != nil {
-			log.Println(err)
+		if err := parseFlags(createFlagSet, args); err != nil {
+			return err
 		}
 
 		if createFlagSet.NArg() == 0 {
-			log.fatal("error: please specify name")
+			return log.usage("please specify name")
 		}
 		name := createFlagSet.Arg(0)
 
 		if *extPtr == "" {
-			log.fatal("error: -ext flag must be specified")
+			return log.usage("-ext flag must be specified")
 		}
 		*extPtr = "." + strings.TrimPrefix(*extPtr, ".")
 
-		createCmd(*dirPtr, startTime, *formatPtr, name, *extPtr, seq, seqDigits)
+		return createCmd(log, *dirPtr, startTime, *formatPtr, name, *extPtr, seq, seqDigits)
 
 	case "goto":
 		if migraterErr != nil {
-			log.fatalErr(migraterErr)
+			return log.fatalErr(migraterErr)
 		}
 
-		if flag.Arg(1) == "" {
-			log.fatal("error: please specify version argument V")
+		gotoFlagSet := newFlagSet("goto", opts.Stderr)
+		dryRun := gotoFlagSet.Bool("dry-run", false, "Print the migrations that would be applied")
+
+		args := fs.Args()[1:]
+		if err := parseFlags(gotoFlagSet, args); err != nil {
+			return err
 		}
 
-		v, err := strconv.ParseUint(flag.Arg(1), 10, 64)
+		if gotoFlagSet.Arg(0) == "" {
+			return log.usage("please specify version argument V")
+		}
+
+		v, err := strconv.ParseUint(gotoFlagSet.Arg(0), 10, 64)
 		if err != nil {
-			log.fatal("error: can't read version argument V")
+			return log.usage("can't read version argument V")
 		}
 
-		gotoCmd(migrater, uint(v))
+		if err := gotoCmd(ctx, log, migrater, uint(v), *dryRun); err != nil {
+			return err
+		}
 
 		if log.verbose {
 			log.Println("Finished after", time.Since(startTime))
@@ -163,19 +431,41 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 
 	case "up":
 		if migraterErr != nil {
-			log.fatalErr(migraterErr)
+			return log.fatalErr(migraterErr)
 		}
 
+		upFlagSet := newFlagSet("up", opts.Stderr)
+		dryRun := upFlagSet.Bool("dry-run", false, "Print the migrations that would be applied")
+		allowOutOfOrder := upFlagSet.Bool("allow-out-of-order", false, "Apply missing migrations older than the current version")
+		resume := upFlagSet.Bool("resume", false, "Continue a dirty migration at the statement that failed")
+
+		args := fs.Args()[1:]
+		if err := parseFlags(upFlagSet, args); err != nil {
+			return err
+		}
+
+		migrater.AllowOutOfOrder = *allowOutOfOrder
+
 		limit := -1
-		if flag.Arg(1) != "" {
-			n, err := strconv.ParseUint(flag.Arg(1), 10, 64)
+		if upFlagSet.Arg(0) != "" {
+			n, err := strconv.ParseUint(upFlagSet.Arg(0), 10, 64)
 			if err != nil {
-				log.fatal("error: can't read limit argument N")
+				return log.usage("can't read limit argument N")
 			}
 			limit = int(n)
 		}
 
-		upCmd(migrater, limit)
+		if *allowOutOfOrder && limit >= 0 {
+			return log.usage("-allow-out-of-order can't be used with limit argument N")
+		}
+
+		if *resume && (limit >= 0 || *dryRun) {
+			return log.usage("-resume can't be used with -dry-run or limit argument N")
+		}
+
+		if err := upCmd(ctx, log, migrater, limit, *dryRun, *resume); err != nil {
+			return err
+		}
 
 		if log.verbose {
 			log.Println("Finished after", time.Since(startTime))
@@ -183,36 +473,33 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 
 	case "down":
 		if migraterErr != nil {
-			log.fatalErr(migraterErr)
+			return log.fatalErr(migraterErr)
 		}
 
-		downFlagSet := flag.NewFlagSet("down", flag.ExitOnError)
+		downFlagSet := newFlagSet("down", opts.Stderr)
 		applyAll := downFlagSet.Bool("all", false, "Apply all down migrations")
+		dryRun := downFlagSet.Bool("dry-run", false, "Print the migrations that would be applied")
 
-		args := flag.Args()[1:]
-		if err := downFlagSet.Parse(args); err != nil {
-			log.fatalErr(err)
+		args := fs.Args()[1:]
+		if err := parseFlags(downFlagSet, args); err != nil {
+			return err
 		}
 
 		downArgs := downFlagSet.Args()
 		num, needsConfirm, err := numDownMigrationsFromArgs(*applyAll, downArgs)
 		if err != nil {
-			log.fatalErr(err)
-		}
-		if needsConfirm {
-			log.Println("Are you sure you want to apply all down migrations? [y/N]")
-			var response string
-			fmt.Scanln(&response)
-			response = strings.ToLower(strings.TrimSpace(response))
-
-			if response == "y" {
-				log.Println("Applying all down migrations")
-			} else {
-				log.fatal("Not applying all down migrations")
+			return log.usage(err.Error())
+		}
+		if needsConfirm && !*dryRun {
+			if !confirm(log, opts.Stdin, "Are you sure you want to apply all down migrations?") {
+				return log.fatal("Not applying all down migrations")
 			}
+			log.Println("Applying all down migrations")
 		}
 
-		downCmd(migrater, num)
+		if err := downCmd(ctx, log, migrater, num, *dryRun); err != nil {
+			return err
+		}
 
 		if log.verbose {
 			log.Println("Finished after", time.Since(startTime))
@@ -220,10 +507,12 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 
 	case "drop":
 		if migraterErr != nil {
-			log.fatalErr(migraterErr)
+			return log.fatalErr(migraterErr)
 		}
 
-		dropCmd(migrater)
+		if err := dropCmd(ctx, log, migrater); err != nil {
+			return err
+		}
 
 		if log.verbose {
 			log.Println("Finished after", time.Since(startTime))
@@ -231,23 +520,25 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 
 	case "force":
 		if migraterErr != nil {
-			log.fatalErr(migraterErr)
+			return log.fatalErr(migraterErr)
 		}
 
-		if flag.Arg(1) == "" {
-			log.fatal("error: please specify version argument V")
+		if fs.Arg(1) == "" {
+			return log.usage("please specify version argument V")
 		}
 
-		v, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+		v, err := strconv.ParseInt(fs.Arg(1), 10, 64)
 		if err != nil {
-			log.fatal("error: can't read version argument V")
+			return log.usage("can't read version argument V")
 		}
 
 		if v < -1 {
-			log.fatal("error: argument V must be >= -1")
+			return log.usage("argument V must be >= -1")
 		}
 
-		forceCmd(migrater, int(v))
+		if err := forceCmd(ctx, log, migrater, int(v)); err != nil {
+			return err
+		}
 
 		if log.verbose {
 			log.Println("Finished after", time.Since(startTime))
@@ -255,16 +546,95 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 
 	case "version":
 		if migraterErr != nil {
-			log.fatalErr(migraterErr)
+			return log.fatalErr(migraterErr)
+		}
+
+		return versionCmd(log, migrater)
+
+	case "status":
+		if migraterErr != nil {
+			return log.fatalErr(migraterErr)
+		}
+
+		statusFlagSet := newFlagSet("status", opts.Stderr)
+		format := statusFlagSet.String("format", "text", "Print the status as text or json")
+		if err := parseFlags(statusFlagSet, fs.Args()[1:]); err != nil {
+			return err
+		}
+		if *format != "text" && *format != "json" {
+			return log.usage("-format must be text or json")
+		}
+
+		return statusCmd(log, opts.Stdout, migrater, *format)
+
+	case "verify":
+		if migraterErr != nil {
+			return log.fatalErr(migraterErr)
+		}
+
+		if err := verifyCmd(log, migrater); err != nil {
+			return err
+		}
+
+		if log.verbose {
+			log.Println("Finished after", time.Since(startTime))
 		}
 
-		versionCmd(migrater)
+	case "lock":
+		if migraterErr != nil {
+			return log.fatalErr(migraterErr)
+		}
+
+		args := fs.Args()[1:]
+		if len(args) == 0 {
+			return log.usage("please specify status or break")
+		}
+
+		switch args[0] {
+		case "status":
+			return lockStatusCmd(log, migrater)
+
+		case "break":
+			breakFlagSet := newFlagSet("lock break", opts.Stderr)
+			force := breakFlagSet.Bool("force", false, "Don't ask for confirmation")
+			if err := parseFlags(breakFlagSet, args[1:]); err != nil {
+				return err
+			}
+
+			if !*force && !confirm(log, opts.Stdin, "Are you sure you want to break the migration lock? Migrations may still be running.") {
+				return log.fatal("Not breaking the migration lock")
+			}
+
+			return lockBreakCmd(log, migrater)
+
+		default:
+			return log.usage("please specify status or break")
+		}
 
 	default:
-		flag.Usage()
+		fs.Usage()
+
+		// A missing or unknown command is a usage error like an invalid flag.
+		if fs.Arg(0) == "" {
+			return usageError{errors.New("please specify a command")}
+		}
+		return usageError{fmt.Errorf("unknown command %v", fs.Arg(0))}
+	}
+
+	return nil
+}
+
+// newFlagSet returns a flag set for command name, which prints its errors to w.
+func newFlagSet(name string, w io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	return fs
+}
 
-		// If a command is not found we exit with a status 2 to match the behavior
-		// of flag.Parse() with flag.ExitOnError when parsing an invalid flag.
-		os.Exit(2)
+// parseFlags parses args with fs, which printed the error, if any.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return usageError{err}
 	}
+	return nil
 }
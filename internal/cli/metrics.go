@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/metrics"
+)
+
+// serveMetrics serves the metrics of collector on addr, if not empty, while
+// the command runs. The returned function sets the current version, writes
+// the metrics to path, if not empty, and stops serving. It is safe to call
+// it more than once. The final version and outcome are only written to path,
+// scrapes of addr don't see them as the server stops with the command.
+func serveMetrics(log *Log, m *migrate.Migrate, collector *metrics.Collector, path, addr string) (func(), error) {
+	var srv *http.Server
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, log.fatalErr(err)
+		}
+		srv = &http.Server{Handler: collector}
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Println("error:", err)
+			}
+		}()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			v, dirty, err := m.Version()
+			switch err {
+			case nil:
+				collector.SetVersion(int(v), dirty)
+			case migrate.ErrNilVersion:
+				collector.SetVersion(database.NilVersion, false)
+			}
+
+			if path != "" {
+				if err := collector.WriteFile(path); err != nil {
+					log.Println("error:", err)
+				}
+			}
+
+			if srv != nil {
+				if err := srv.Close(); err != nil {
+					log.Println("error:", err)
+				}
+			}
+		})
+	}, nil
+}
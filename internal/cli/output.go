@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+)
+
+// maxQueryExcerpt limits the length of the query in a JSON error.
+const maxQueryExcerpt = 1000
+
+// jsonOutput collects the outcome of a command for -output json
+// and prints it as one JSON document once the command is done.
+type jsonOutput struct {
+	w       io.Writer
+	command string
+	driver  string
+	start   time.Time
+
+	// m is the Migrate instance of the command, if any
+	m *migrate.Migrate
+
+	mu         sync.Mutex
+	migrations []jsonMigration
+	files      []string
+}
+
+// jsonResult is the document printed when a command is done. Its type
+// tells it apart from the events printed while the command runs.
+type jsonResult struct {
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Success    bool            `json:"success"`
+	DurationMs float64         `json:"duration_ms"`
+	Migrations []jsonMigration `json:"migrations"`
+	Version    *uint           `json:"version,omitempty"`
+	Dirty      bool            `json:"dirty"`
+	Files      []string        `json:"files,omitempty"`
+	Error      *jsonError      `json:"error,omitempty"`
+	ExitCode   int             `json:"exit_code"`
+}
+
+// jsonMigration is a migration that ran during the command.
+type jsonMigration struct {
+	Version       uint    `json:"version"`
+	TargetVersion int     `json:"target_version"`
+	Identifier    string  `json:"identifier"`
+	Direction     string  `json:"direction"`
+	DurationMs    float64 `json:"duration_ms"`
+	Success       bool    `json:"success"`
+}
+
+// jsonError describes the error a command failed with. Driver, Query,
+// Line and Details are set for errors of the database driver.
+type jsonError struct {
+	Message string `json:"message"`
+	Driver  string `json:"driver,omitempty"`
+	Query   string `json:"query,omitempty"`
+	Line    uint   `json:"line,omitempty"`
+	Details string `json:"details,omitempty"`
+	Origin  string `json:"original,omitempty"`
+}
+
+func newJSONOutput(w io.Writer, command, driver string) *jsonOutput {
+	return &jsonOutput{
+		w:          w,
+		command:    command,
+		driver:     driver,
+		start:      time.Now(),
+		migrations: make([]jsonMigration, 0),
+	}
+}
+
+// Observe implements migrate.Observer, recording the migrations that ran.
+func (o *jsonOutput) Observe(e migrate.Event) {
+	if e.Type != migrate.EventRunFinished || e.Migration == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.migrations = append(o.migrations, jsonMigration{
+		Version:       e.Version,
+		TargetVersion: e.TargetVersion,
+		Identifier:    e.Identifier,
+		Direction:     string(e.Migration.Direction()),
+		DurationMs:    float64(e.Duration) / float64(time.Millisecond),
+		Success:       e.Err == nil,
+	})
+}
+
+// addFile records a file created by the command. It does nothing if o is nil.
+func (o *jsonOutput) addFile(name string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.files = append(o.files, name)
+}
+
+// print prints the result of the command, which failed if err isn't nil.
+func (o *jsonOutput) print(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	r := jsonResult{
+		Type:       "result",
+		Command:    o.command,
+		Success:    err == nil,
+		DurationMs: float64(time.Since(o.start)) / float64(time.Millisecond),
+		Migrations: o.migrations,
+		Files:      o.files,
+	}
+	if o.m != nil {
+		if v, dirty, errVersion := o.m.Version(); errVersion == nil {
+			r.Version, r.Dirty = &v, dirty
+		}
+	}
+	if err != nil {
+		r.Error = newJSONError(err, o.driver)
+		r.ExitCode = exitCode(err)
+	}
+
+	// there is nobody to report a failed write to
+	_ = json.NewEncoder(o.w).Encode(r)
+}
+
+// newJSONError describes err, with the fields of the database.Error it wraps, if any.
+func newJSONError(err error, driver string) *jsonError {
+	je := &jsonError{Message: err.Error()}
+
+	if e, ok := err.(openError); ok {
+		err = e.error
+	}
+	if e, ok := err.(migrate.RollbackError); ok {
+		err = e.Err
+	}
+	var dbErr *database.Error
+	switch e := err.(type) {
+	case database.Error:
+		dbErr = &e
+	case *database.Error:
+		dbErr = e
+	}
+	if dbErr == nil {
+		return je
+	}
+
+	je.Driver = driver
+	je.Line = dbErr.Line
+	je.Details = dbErr.Err
+	if dbErr.OrigErr != nil {
+		je.Origin = dbErr.OrigErr.Error()
+	}
+	query := dbErr.Query
+	if len(query) > maxQueryExcerpt {
+		n := maxQueryExcerpt
+		for n > 0 && !utf8.RuneStart(query[n]) {
+			n--
+		}
+		query = append(query[:n:n], "..."...)
+	}
+	je.Query = string(query)
+	return je
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+)
+
+func TestNewJSONError(t *testing.T) {
+	orig := errors.New("syntax error")
+	dbErr := database.Error{OrigErr: orig, Err: "migration failed", Query: []byte("SELECT"), Line: 3}
+	expected := jsonError{Driver: "postgres", Query: "SELECT", Line: 3, Details: "migration failed", Origin: "syntax error"}
+
+	for _, err := range []error{dbErr, &dbErr, migrate.RollbackError{Version: 1, Err: dbErr}} {
+		je := newJSONError(err, "postgres")
+		expected.Message = err.Error()
+		if *je != expected {
+			t.Errorf("expected %+v, got %+v", expected, *je)
+		}
+	}
+
+	if je := newJSONError(orig, "postgres"); *je != (jsonError{Message: "syntax error"}) {
+		t.Errorf("expected only a message, got %+v", *je)
+	}
+
+	long := database.Error{Query: []byte(strings.Repeat("é", maxQueryExcerpt))}
+	if je := newJSONError(long, "postgres"); len(je.Query) != maxQueryExcerpt+len("...") || !strings.HasSuffix(je.Query, "é...") {
+		t.Errorf("expected the query to be cut at a rune boundary, got %v bytes", len(je.Query))
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	o := newJSONOutput(&buf, "up", "postgres")
+	o.Observe(migrate.Event{Type: migrate.EventRunStarted, Migration: &migrate.Migration{Version: 1, TargetVersion: 1}})
+	o.Observe(migrate.Event{Type: migrate.EventRunFinished, Version: 1, TargetVersion: 1, Identifier: "create_users",
+		Duration: time.Second, Migration: &migrate.Migration{Version: 1, TargetVersion: 1}})
+	o.Observe(migrate.Event{Type: migrate.EventRunFinished, Version: 2, TargetVersion: 2, Identifier: "add_index",
+		Err: errors.New("failed"), Migration: &migrate.Migration{Version: 2, TargetVersion: 2}})
+	o.print(errors.New("failed"))
+
+	var r jsonResult
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	expected := []jsonMigration{
+		{Version: 1, TargetVersion: 1, Identifier: "create_users", Direction: "up", DurationMs: 1000, Success: true},
+		{Version: 2, TargetVersion: 2, Identifier: "add_index", Direction: "up"},
+	}
+	if r.Type != "result" || r.Command != "up" || r.Success || r.Error == nil || r.Error.Message != "failed" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if len(r.Migrations) != len(expected) || r.Migrations[0] != expected[0] || r.Migrations[1] != expected[1] {
+		t.Errorf("expected migrations %+v, got %+v", expected, r.Migrations)
+	}
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// varsFlag collects the template variables of repeated -var key=value flags.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varsFlag) Set(s string) error {
+	key, value, err := parseVar(s)
+	if err != nil {
+		return err
+	}
+	v[key] = value
+	return nil
+}
+
+// parseVar parses a key=value pair.
+func parseVar(s string) (key, value string, err error) {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return "", "", fmt.Errorf("invalid variable %q, expected key=value", s)
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), nil
+}
+
+// readVarsFile reads template variables from the file at path,
+// one key=value pair per line. Blank lines and lines starting with # are ignored.
+func readVarsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars, err := readVars(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return vars, nil
+}
+
+func readVars(r io.Reader) (map[string]string, error) {
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := parseVar(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadVars(t *testing.T) {
+	vars, err := readVars(strings.NewReader("# staging\nschema = app\n\nurl=http://x?a=b\nempty=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"schema": "app", "url": "http://x?a=b", "empty": ""}
+	if !reflect.DeepEqual(expected, vars) {
+		t.Errorf("expected %v, got %v", expected, vars)
+	}
+
+	if _, err := readVars(strings.NewReader("schema=app\nnope\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+}
+
+func TestVarsFlag(t *testing.T) {
+	vars := make(varsFlag)
+	for _, s := range []string{"b=2", "a=1", "a=3"} {
+		if err := vars.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := vars.String(); s != "a=3,b=2" {
+		t.Errorf("expected a=3,b=2, got %v", s)
+	}
+	if err := vars.Set("=1"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
@@ -0,0 +1,113 @@
+// Package flock implements a lock driver holding an exclusive flock(2)
+// on a local file, which serializes migrations run from the same host,
+// i.e. from several processes or containers sharing a volume.
+package flock
+
+import (
+	"context"
+	"fmt"
+	nurl "net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/solvedata/migrate/v4/lock"
+)
+
+func init() {
+	lock.Register("flock", &Flock{})
+}
+
+// DefaultPollInterval is the time to wait between attempts to acquire the lock.
+var DefaultPollInterval = 100 * time.Millisecond
+
+var (
+	ErrNoPath = fmt.Errorf("no path")
+)
+
+type Flock struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// New returns a lock driver for the file at path.
+// The file is created if it doesn't exist.
+func New(path string) *Flock {
+	return &Flock{path: path}
+}
+
+// Open accepts URLs of the form flock:///absolute/path or flock://relative/path.
+func (l *Flock) Open(url string) (lock.Driver, error) {
+	u, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	// concat host and path to restore full path
+	p := u.Opaque
+	if len(p) == 0 {
+		p = u.Host + u.Path
+	}
+	if len(p) == 0 {
+		return nil, ErrNoPath
+	}
+
+	return New(p), nil
+}
+
+func (l *Flock) Close() error {
+	return nil
+}
+
+func (l *Flock) Lock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		return lock.ErrLocked
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	// flock can't be canceled while blocking, so poll instead
+	for {
+		err := tryLock(f)
+		if err == nil {
+			l.f = f
+			return nil
+		}
+		if err != lock.ErrLocked {
+			_ = f.Close()
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return ctx.Err()
+		case <-time.After(DefaultPollInterval):
+		}
+	}
+}
+
+func (l *Flock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return lock.ErrNotLocked
+	}
+
+	f := l.f
+	l.f = nil
+	if err := unlock(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
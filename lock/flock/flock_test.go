@@ -0,0 +1,68 @@
+package flock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/solvedata/migrate/v4/lock"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	d, err := (&Flock{}).Open("flock://" + filepath.Join(dir, "migrate.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := New(filepath.Join(dir, "migrate.lock"))
+
+	if err := d.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Lock(context.Background()); err != lock.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*DefaultPollInterval)
+	defer cancel()
+	if err := other.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- other.Lock(ctx)
+	}()
+	if err := d.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the lock to be acquired once released, got %v", err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Unlock(); err != lock.ErrNotLocked {
+		t.Fatalf("expected ErrNotLocked, got %v", err)
+	}
+}
+
+func TestOpenNoPath(t *testing.T) {
+	if _, err := (&Flock{}).Open("flock://"); err != ErrNoPath {
+		t.Fatalf("expected ErrNoPath, got %v", err)
+	}
+}
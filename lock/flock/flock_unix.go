@@ -0,0 +1,23 @@
+// +build !windows
+
+package flock
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/solvedata/migrate/v4/lock"
+)
+
+// tryLock returns lock.ErrLocked if another file description holds the lock.
+func tryLock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return lock.ErrLocked
+	}
+	return err
+}
+
+func unlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,16 @@
+package flock
+
+import (
+	"fmt"
+	"os"
+)
+
+var errUnsupported = fmt.Errorf("flock is not supported on windows")
+
+func tryLock(f *os.File) error {
+	return errUnsupported
+}
+
+func unlock(f *os.File) error {
+	return errUnsupported
+}
@@ -0,0 +1,81 @@
+// Package lock provides the Driver interface for locks outside of the
+// database being migrated. All lock drivers must implement this interface
+// and register themselves. A Driver satisfies migrate.Locker.
+package lock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	iurl "github.com/solvedata/migrate/v4/internal/url"
+)
+
+var (
+	ErrLocked    = fmt.Errorf("can't acquire lock")
+	ErrNotLocked = fmt.Errorf("not locked")
+)
+
+var driversMu sync.RWMutex
+var drivers = make(map[string]Driver)
+
+// Driver is the interface every lock driver must implement.
+type Driver interface {
+	// Open returns a new driver instance configured with parameters
+	// coming from the URL string. Migrate will call this function
+	// only once per instance.
+	Open(url string) (Driver, error)
+
+	// Close closes the underlying resources of the lock.
+	// It does not release the lock.
+	Close() error
+
+	// Lock blocks until the lock is acquired or ctx is done.
+	// It must not hold the lock once it returned ctx.Err().
+	Lock(ctx context.Context) error
+
+	// Unlock releases the lock acquired by Lock.
+	// Return ErrNotLocked if the lock isn't held.
+	Unlock() error
+}
+
+// Open returns a new driver instance.
+func Open(url string) (Driver, error) {
+	scheme, err := iurl.SchemeFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	driversMu.RLock()
+	d, ok := drivers[scheme]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("lock driver: unknown driver %v (forgotten import?)", scheme)
+	}
+
+	return d.Open(url)
+}
+
+// Register globally registers a driver.
+func Register(name string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("Register driver is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("Register called twice for driver " + name)
+	}
+	drivers[name] = driver
+}
+
+// List lists the registered drivers
+func List() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for n := range drivers {
+		names = append(names, n)
+	}
+	return names
+}
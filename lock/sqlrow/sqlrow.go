@@ -0,0 +1,358 @@
+// Package sqlrow implements a lock driver inserting a row into a table of
+// any database/sql database, which serializes migrations run from several
+// hosts against databases whose driver can't lock, i.e. Cassandra or Redshift.
+package sqlrow
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	nurl "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/solvedata/migrate/v4/database"
+	iurl "github.com/solvedata/migrate/v4/internal/url"
+	"github.com/solvedata/migrate/v4/lock"
+)
+
+// SQLDrivers are the database/sql drivers which can be used with Open,
+// with URLs of the form sql+DRIVER://DSN. The drivers must be imported
+// separately. Use WithInstance for other drivers.
+var SQLDrivers = []string{"postgres", "mysql", "sqlite3"}
+
+// urlDSN lists the database/sql drivers that expect the whole URL as DSN.
+var urlDSN = map[string]bool{"postgres": true}
+
+func init() {
+	for _, name := range SQLDrivers {
+		lock.Register("sql+"+name, &SQLRow{})
+	}
+}
+
+var DefaultLockTable = "schema_lock"
+var DefaultLockName = "migrate"
+
+// DefaultPollInterval is the time to wait between attempts to acquire the lock.
+var DefaultPollInterval = time.Second
+
+var (
+	ErrNilConfig = fmt.Errorf("no config")
+)
+
+type Config struct {
+	// LockTable is the table holding the lock rows. It is created if it
+	// doesn't exist, with the columns name, locked_by, locked_at and expires_at.
+	LockTable string
+
+	// LockName identifies the lock, so a single table can hold the locks
+	// of several migration sets.
+	LockName string
+
+	// LeaseTTL is the time after which the lock of a process that died
+	// can be taken over. It defaults to database.DefaultLeaseTTL.
+	LeaseTTL time.Duration
+}
+
+type SQLRow struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	isLocked bool
+	owner    string
+	lease    *database.LeaseLock
+
+	// Open and WithInstance need to guarantee that config is never nil
+	config *Config
+}
+
+func WithInstance(instance *sql.DB, config *Config) (lock.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+
+	if len(config.LockTable) == 0 {
+		config.LockTable = DefaultLockTable
+	}
+	if len(config.LockName) == 0 {
+		config.LockName = DefaultLockName
+	}
+
+	hostname, _ := os.Hostname()
+	l := &SQLRow{
+		db:     instance,
+		owner:  fmt.Sprintf("%v:%v", hostname, os.Getpid()),
+		config: config,
+	}
+	l.lease = database.NewLeaseLock(leaseStore{l})
+	l.lease.TTL = config.LeaseTTL
+	return l, nil
+}
+
+// Open accepts URLs of the form sql+DRIVER://DSN?x-lock-table=T&x-lock-name=N&x-lease-ttl=D.
+// The DSN keeps the scheme of the URL for drivers expecting URLs (postgres),
+// i.e. sql+postgres://user@host/db or sql+mysql://user@tcp(host:3306)/db.
+func (l *SQLRow) Open(url string) (lock.Driver, error) {
+	scheme, err := iurl.SchemeFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+	driverName := strings.TrimPrefix(scheme, "sql+")
+
+	dsn := strings.TrimPrefix(url, "sql+")
+	if !urlDSN[driverName] {
+		dsn = strings.TrimPrefix(dsn, driverName+"://")
+	}
+
+	// filter the custom query params, the DSN may not be a valid URL
+	var customParams nurl.Values
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		params, err := nurl.ParseQuery(dsn[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		customParams = make(nurl.Values)
+		for k, v := range params {
+			if strings.HasPrefix(k, "x-") {
+				customParams[k] = v
+				delete(params, k)
+			}
+		}
+		dsn = dsn[:i]
+		if len(params) > 0 {
+			dsn += "?" + params.Encode()
+		}
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	var leaseTTL time.Duration
+	if s := customParams.Get("x-lease-ttl"); s != "" {
+		leaseTTL, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return WithInstance(db, &Config{
+		LockTable: customParams.Get("x-lock-table"),
+		LockName:  customParams.Get("x-lock-name"),
+		LeaseTTL:  leaseTTL,
+	})
+}
+
+func (l *SQLRow) Close() error {
+	return l.db.Close()
+}
+
+// Lock inserts the lock row, polling until the row of another owner is
+// gone or expired, or ctx is done. The row is a lease which is renewed while
+// held, so the lock of a process that died expires after LeaseTTL.
+func (l *SQLRow) Lock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.isLocked {
+		return lock.ErrLocked
+	}
+
+	if err := l.ensureLockTable(ctx); err != nil {
+		return err
+	}
+
+	// the lease isn't acquired with ctx, a row inserted right when ctx
+	// is done would be held without anybody knowing
+	err := database.PollLock(ctx, DefaultPollInterval, func(time.Duration) (bool, error) {
+		err := l.lease.Lock(context.Background())
+		if err == database.ErrLocked {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	l.isLocked = true
+	return nil
+}
+
+// Unlock deletes the lock row, if it is still owned by this instance.
+func (l *SQLRow) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.isLocked {
+		return lock.ErrNotLocked
+	}
+
+	// the lease stops being renewed even if it can't be released
+	l.isLocked = false
+	return l.lease.Unlock()
+}
+
+// LockLost implements database.LockLossNotifier. The channel is closed
+// once the lock row was deleted or taken over by another process.
+func (l *SQLRow) LockLost() <-chan struct{} {
+	return l.lease.LockLost()
+}
+
+// LockStatus implements database.LockInspector.
+// An expired lease isn't held anymore, since it can be taken over.
+func (l *SQLRow) LockStatus() (held bool, owner string, since time.Time, err error) {
+	if err := l.ensureLockTable(context.Background()); err != nil {
+		return false, "", time.Time{}, err
+	}
+
+	query := `SELECT locked_by, locked_at, expires_at FROM ` + l.config.LockTable + ` WHERE name = ` + quoteString(l.config.LockName)
+	var lockedAt, expiresAt string
+	err = l.db.QueryRowContext(context.Background(), query).Scan(&owner, &lockedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return false, "", time.Time{}, nil
+	}
+	if err != nil {
+		return false, "", time.Time{}, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if expired(expiresAt, time.Now()) {
+		return false, "", time.Time{}, nil
+	}
+
+	// rows inserted by hand may not hold a valid time
+	since, _ = time.Parse(time.RFC3339, lockedAt)
+	return true, owner, since, nil
+}
+
+// ForceUnlock implements database.LockInspector by deleting the lock row.
+// The heartbeat of its owner, if still running, fails with database.ErrLeaseLost.
+func (l *SQLRow) ForceUnlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	query := `DELETE FROM ` + l.config.LockTable + ` WHERE name = ` + quoteString(l.config.LockName)
+	if _, err := l.db.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if l.isLocked {
+		// stop renewing the lease of this instance, its row is gone
+		l.isLocked = false
+		if err := l.lease.Unlock(); err != nil && err != database.ErrLeaseLost {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureLockTable creates the lock table if it doesn't exist,
+// and adds the expires_at column to tables of older versions.
+func (l *SQLRow) ensureLockTable(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS ` + l.config.LockTable +
+		` (name VARCHAR(255) NOT NULL PRIMARY KEY, locked_by VARCHAR(255) NOT NULL, locked_at VARCHAR(64) NOT NULL, expires_at VARCHAR(64) NOT NULL DEFAULT '')`
+	if _, err := l.db.ExecContext(ctx, query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	// not every database supports ADD COLUMN IF NOT EXISTS
+	query = `SELECT expires_at FROM ` + l.config.LockTable + ` WHERE 1 = 0`
+	rows, err := l.db.QueryContext(ctx, query)
+	if err == nil {
+		return rows.Close()
+	}
+	query = `ALTER TABLE ` + l.config.LockTable + ` ADD COLUMN expires_at VARCHAR(64) NOT NULL DEFAULT ''`
+	if _, err := l.db.ExecContext(ctx, query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// leaseStore keeps the lease of the lock in the lock row. Unlike the lease
+// of the database drivers, its expiry is computed with the clock of the host,
+// as there is no portable SQL for it, so clocks must be closer than LeaseTTL.
+type leaseStore struct {
+	l *SQLRow
+}
+
+// lockedBy is the owner of the lock row for the lease of owner.
+func (s leaseStore) lockedBy(owner string) string {
+	return s.l.owner + " " + owner
+}
+
+func (s leaseStore) AcquireLease(ctx context.Context, owner, hostname string, ttl time.Duration) error {
+	now := time.Now()
+	query := `INSERT INTO ` + s.l.config.LockTable + ` (name, locked_by, locked_at, expires_at) VALUES (` +
+		quoteString(s.l.config.LockName) + `, ` + quoteString(s.lockedBy(owner)) + `, ` +
+		quoteString(formatTime(now)) + `, ` + quoteString(formatTime(now.Add(ttl))) + `)`
+	_, err := s.l.db.ExecContext(ctx, query)
+	if err == nil {
+		return nil
+	}
+
+	// tell a duplicate key apart from other errors without parsing
+	// the error codes of every database
+	var lockedBy, expiresAt string
+	rowQuery := `SELECT locked_by, expires_at FROM ` + s.l.config.LockTable + ` WHERE name = ` + quoteString(s.l.config.LockName)
+	switch errRow := s.l.db.QueryRowContext(ctx, rowQuery).Scan(&lockedBy, &expiresAt); {
+	case errRow == sql.ErrNoRows:
+		// released in the meantime, try again
+		return database.ErrLocked
+	case errRow != nil:
+		return &database.Error{OrigErr: err, Err: "failed to set migration lock", Query: []byte(query)}
+	case !expired(expiresAt, now):
+		return database.ErrLocked
+	}
+
+	// take over the expired lease, unless another process did already
+	deleteQuery := `DELETE FROM ` + s.l.config.LockTable + ` WHERE name = ` + quoteString(s.l.config.LockName) +
+		` AND locked_by = ` + quoteString(lockedBy) + ` AND expires_at = ` + quoteString(expiresAt)
+	if _, err := s.l.db.ExecContext(ctx, deleteQuery); err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to take over migration lock", Query: []byte(deleteQuery)}
+	}
+	if _, err := s.l.db.ExecContext(ctx, query); err != nil {
+		return database.ErrLocked
+	}
+	return nil
+}
+
+func (s leaseStore) RenewLease(ctx context.Context, owner string, ttl time.Duration) error {
+	query := `UPDATE ` + s.l.config.LockTable + ` SET expires_at = ` + quoteString(formatTime(time.Now().Add(ttl))) +
+		` WHERE name = ` + quoteString(s.l.config.LockName) + ` AND locked_by = ` + quoteString(s.lockedBy(owner))
+	res, err := s.l.db.ExecContext(ctx, query)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to renew migration lock", Query: []byte(query)}
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return database.ErrLeaseLost
+	}
+	return nil
+}
+
+func (s leaseStore) ReleaseLease(ctx context.Context, owner string) error {
+	query := `DELETE FROM ` + s.l.config.LockTable + ` WHERE name = ` + quoteString(s.l.config.LockName) +
+		` AND locked_by = ` + quoteString(s.lockedBy(owner))
+	if _, err := s.l.db.ExecContext(ctx, query); err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to release migration lock", Query: []byte(query)}
+	}
+	return nil
+}
+
+// formatTime formats t in UTC with a fixed width.
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// expired returns true if expiresAt is before now. Rows of older
+// versions don't have an expiry, they never expire.
+func expired(expiresAt string, now time.Time) bool {
+	t, err := time.Parse(time.RFC3339, expiresAt)
+	return err == nil && t.Before(now)
+}
+
+// quoteString quotes s as a SQL string literal. Placeholders
+// differ between databases, so values are inlined instead.
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,169 @@
+package sqlrow
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/solvedata/migrate/v4/lock"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlrow-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	addr := fmt.Sprintf("sql+sqlite3://%s?x-lock-table=my_lock", filepath.Join(dir, "lock.db"))
+	d, err := (&SQLRow{}).Open(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	other, err := (&SQLRow{}).Open(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := other.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// both run in the same process, so tell them apart
+	other.(*SQLRow).owner += "-other"
+
+	if err := d.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Lock(context.Background()); err != lock.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := other.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if err := d.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Lock(context.Background()); err != nil {
+		t.Fatalf("expected the lock to be acquired once released, got %v", err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Unlock(); err != lock.ErrNotLocked {
+		t.Fatalf("expected ErrNotLocked, got %v", err)
+	}
+}
+
+func TestLockStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlrow-lock-status-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	d, err := (&SQLRow{}).Open(fmt.Sprintf("sql+sqlite3://%s", filepath.Join(dir, "lock.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	l := d.(*SQLRow)
+
+	if held, _, _, err := l.LockStatus(); err != nil || held {
+		t.Fatalf("expected the lock not to be held, got %v (%v)", held, err)
+	}
+	if err := l.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	held, owner, since, err := l.LockStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held || !strings.HasPrefix(owner, l.owner+" ") || since.IsZero() {
+		t.Fatalf("expected the lock to be held by %v, got %v %q %v", l.owner, held, owner, since)
+	}
+	if err := l.ForceUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, _, err := l.LockStatus(); err != nil || held {
+		t.Fatalf("expected the lock to be broken, got %v (%v)", held, err)
+	}
+}
+
+func TestLockExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlrow-lock-expired-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	d, err := (&SQLRow{}).Open(fmt.Sprintf("sql+sqlite3://%s", filepath.Join(dir, "lock.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	l := d.(*SQLRow)
+
+	// the lock table and the row of an older version, which never expires
+	if _, err := l.db.Exec(`CREATE TABLE schema_lock (name VARCHAR(255) NOT NULL PRIMARY KEY, locked_by VARCHAR(255) NOT NULL, locked_at VARCHAR(64) NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.db.Exec(`INSERT INTO schema_lock (name, locked_by, locked_at) VALUES ('migrate', 'old:1', '')`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// the row of a process that died, whose lease expired
+	expiresAt := formatTime(time.Now().Add(-time.Second))
+	if _, err := l.db.Exec(`UPDATE schema_lock SET locked_by = 'dead:1', expires_at = ` + quoteString(expiresAt)); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, _, err := l.LockStatus(); err != nil || held {
+		t.Fatalf("expected an expired lease not to be held, got %v (%v)", held, err)
+	}
+	if err := l.Lock(context.Background()); err != nil {
+		t.Fatalf("expected the expired lease to be taken over, got %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"context"
+	"time"
+
+	"github.com/solvedata/migrate/v4/database"
+)
+
+// Locker is an interface so you can serialize migrations with a lock
+// outside of the database, i.e. for database drivers whose Lock only
+// works within a single process. See package lock for implementations.
+type Locker interface {
+	// Lock blocks until the lock is acquired or ctx is done.
+	// It must not hold the lock once it returned ctx.Err().
+	Lock(ctx context.Context) error
+
+	// Unlock releases the lock acquired by Lock.
+	Unlock() error
+}
+
+// NewDriverLocker returns a Locker that uses the Lock and Unlock methods
+// of the database driver d, passing ctx down to d if it implements
+// database.DriverContext. Migrate uses it if Locker is not set.
+func NewDriverLocker(d database.Driver) Locker {
+	return &driverLocker{d: d}
+}
+
+type driverLocker struct {
+	d database.Driver
+}
+
+func (l *driverLocker) Lock(ctx context.Context) error {
+	if d, ok := l.d.(database.DriverContext); ok {
+		return d.LockContext(ctx)
+	}
+	return l.d.Lock()
+}
+
+func (l *driverLocker) Unlock() error {
+	return l.d.Unlock()
+}
+
+// LockStatus returns whether the migration lock is held, a description of
+// its owner and since when it is held, without locking. The Locker or the
+// database driver must implement database.LockInspector, otherwise
+// ErrNoLockStatus is returned.
+func (m *Migrate) LockStatus() (held bool, owner string, since time.Time, err error) {
+	li, ok := m.lockInspector()
+	if !ok {
+		return false, "", time.Time{}, ErrNoLockStatus
+	}
+	return li.LockStatus()
+}
+
+// ForceUnlock releases the migration lock no matter who holds it.
+// Use with care, the owner may still be migrating. The Locker or the
+// database driver must implement database.LockInspector, otherwise
+// ErrNoLockStatus is returned.
+func (m *Migrate) ForceUnlock() error {
+	li, ok := m.lockInspector()
+	if !ok {
+		return ErrNoLockStatus
+	}
+	return li.ForceUnlock()
+}
+
+// lockInspector returns the Locker, if set, or the
+// database driver if it implements database.LockInspector.
+func (m *Migrate) lockInspector() (database.LockInspector, bool) {
+	if m.Locker != nil {
+		li, ok := m.Locker.(database.LockInspector)
+		return li, ok
+	}
+	li, ok := m.databaseDrv.(database.LockInspector)
+	return li, ok
+}
+
+// lockLost returns the channel of the Locker, if set, or the database
+// driver which is closed once the lock is lost, or nil if it doesn't
+// implement database.LockLossNotifier.
+func (m *Migrate) lockLost() <-chan struct{} {
+	var l interface{} = m.Locker
+	if m.Locker == nil {
+		l = m.databaseDrv
+	}
+	if n, ok := l.(database.LockLossNotifier); ok {
+		return n.LockLost()
+	}
+	return nil
+}
+
+// locker returns the Locker to use, which is
+// the database driver unless Locker is set.
+func (m *Migrate) locker() Locker {
+	if m.Locker != nil {
+		return m.Locker
+	}
+	return NewDriverLocker(m.databaseDrv)
+}
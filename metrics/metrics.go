@@ -0,0 +1,267 @@
+// Package metrics keeps metrics about migration runs and renders them
+// in the Prometheus text exposition format, so they can be scraped over
+// HTTP or picked up by the textfile collector of the node exporter.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/solvedata/migrate/v4"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the histogram buckets.
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+
+// Collector is a migrate.Observer that keeps metrics about migration runs.
+// It is safe for concurrent use.
+type Collector struct {
+	mu sync.Mutex
+
+	buckets []float64
+
+	applied   map[string]float64 // by direction
+	failed    map[string]float64 // by direction
+	durations map[durationKey]*histogram
+	lockWait  *histogram
+
+	hasVersion bool
+	version    int
+	dirty      bool
+}
+
+type durationKey struct {
+	version   uint
+	direction string
+}
+
+// NewCollector returns a Collector using DefaultBuckets.
+func NewCollector() *Collector {
+	return NewCollectorWithBuckets(DefaultBuckets)
+}
+
+// NewCollectorWithBuckets returns a Collector using the given
+// upper bounds (in seconds, ascending) for its histograms.
+func NewCollectorWithBuckets(buckets []float64) *Collector {
+	return &Collector{
+		buckets:   buckets,
+		applied:   make(map[string]float64),
+		failed:    make(map[string]float64),
+		durations: make(map[durationKey]*histogram),
+		lockWait:  newHistogram(buckets),
+	}
+}
+
+// Observe implements migrate.Observer.
+func (c *Collector) Observe(e migrate.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch e.Type {
+	case migrate.EventRunFinished:
+		direction := string(e.Migration.Direction())
+		if e.Err != nil {
+			c.failed[direction]++
+			return
+		}
+		c.applied[direction]++
+
+		key := durationKey{e.Version, direction}
+		h, ok := c.durations[key]
+		if !ok {
+			h = newHistogram(c.buckets)
+			c.durations[key] = h
+		}
+		h.observe(e.Duration)
+
+	case migrate.EventVersionDirty:
+		c.hasVersion, c.version, c.dirty = true, e.TargetVersion, true
+
+	case migrate.EventVersionClean:
+		c.hasVersion, c.version, c.dirty = true, e.TargetVersion, false
+
+	case migrate.EventLockAcquired:
+		c.lockWait.observe(e.Duration)
+	}
+}
+
+// SetVersion sets the current version and dirty state, i.e. as returned
+// by migrate.Migrate.Version, for runs that didn't apply any migration.
+// Use database.NilVersion if there is no version yet.
+func (c *Collector) SetVersion(version int, dirty bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hasVersion, c.version, c.dirty = true, version, dirty
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	writeHeader(cw, "migrate_migrations_applied_total", "counter", "Number of migrations applied successfully.")
+	for _, direction := range sortedKeys(c.applied) {
+		fmt.Fprintf(cw, "migrate_migrations_applied_total{direction=%q} %v\n", direction, c.applied[direction])
+	}
+
+	writeHeader(cw, "migrate_migrations_failed_total", "counter", "Number of migrations that failed.")
+	for _, direction := range sortedKeys(c.failed) {
+		fmt.Fprintf(cw, "migrate_migrations_failed_total{direction=%q} %v\n", direction, c.failed[direction])
+	}
+
+	writeHeader(cw, "migrate_migration_duration_seconds", "histogram", "Time it took to run a migration.")
+	keys := make([]durationKey, 0, len(c.durations))
+	for k := range c.durations {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].version != keys[j].version {
+			return keys[i].version < keys[j].version
+		}
+		return keys[i].direction < keys[j].direction
+	})
+	for _, k := range keys {
+		labels := fmt.Sprintf("direction=%q,version=\"%v\"", k.direction, k.version)
+		c.durations[k].write(cw, "migrate_migration_duration_seconds", labels)
+	}
+
+	writeHeader(cw, "migrate_lock_wait_seconds", "histogram", "Time spent waiting for the database lock.")
+	c.lockWait.write(cw, "migrate_lock_wait_seconds", "")
+
+	if c.hasVersion {
+		writeHeader(cw, "migrate_version", "gauge", "Current migration version, -1 if there is none.")
+		fmt.Fprintf(cw, "migrate_version %v\n", c.version)
+
+		dirty := 0
+		if c.dirty {
+			dirty = 1
+		}
+		writeHeader(cw, "migrate_dirty", "gauge", "Whether the current migration version is dirty.")
+		fmt.Fprintf(cw, "migrate_dirty %v\n", dirty)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// WriteFile writes all metrics to the file at path. The file is replaced
+// atomically, so a collector never reads a partially written file.
+func (c *Collector) WriteFile(path string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := c.WriteTo(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ServeHTTP implements http.Handler, serving all metrics.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = c.WriteTo(w)
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%v_bucket{%v%vle=%q} %v\n", name, labels, sep, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%v_bucket{%v%vle=\"+Inf\"} %v\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%v_sum%v %v\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%v_count%v %v\n", name, labels, h.count)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countingWriter counts the bytes written to w and
+// remembers the first error, so callers can ignore it.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/solvedata/migrate/v4"
+	dStub "github.com/solvedata/migrate/v4/database/stub"
+	"github.com/solvedata/migrate/v4/source"
+	sStub "github.com/solvedata/migrate/v4/source/stub"
+)
+
+func newMigrate(t *testing.T) *migrate.Migrate {
+	sourceDrv, err := sStub.WithInstance(nil, &sStub.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	databaseDrv, err := dStub.WithInstance(nil, &dStub.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := migrate.NewWithInstance("stub", sourceDrv, "stub", databaseDrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCollector(t *testing.T) {
+	m := newMigrate(t)
+	c := NewCollector()
+	m.Observer = c
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := c.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	expected := []string{
+		"# TYPE migrate_migrations_applied_total counter",
+		`migrate_migrations_applied_total{direction="down"} 1`,
+		`migrate_migrations_applied_total{direction="up"} 2`,
+		"# TYPE migrate_migration_duration_seconds histogram",
+		`migrate_migration_duration_seconds_bucket{direction="up",version="1",le="0.01"} 1`,
+		`migrate_migration_duration_seconds_bucket{direction="up",version="2",le="+Inf"} 1`,
+		`migrate_migration_duration_seconds_count{direction="down",version="2"} 1`,
+		`migrate_lock_wait_seconds_count 2`,
+		"migrate_version 1",
+		"migrate_dirty 0",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected line %q in\n%v", line, out)
+		}
+	}
+}
+
+func TestCollectorSetVersion(t *testing.T) {
+	c := NewCollector()
+
+	buf := &bytes.Buffer{}
+	if _, err := c.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "migrate_version") {
+		t.Errorf("expected no version before it is known, got\n%v", buf.String())
+	}
+
+	c.SetVersion(-1, false)
+	buf.Reset()
+	if _, err := c.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "migrate_version -1\n") {
+		t.Errorf("expected nil version, got\n%v", buf.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(500 * time.Millisecond)
+	h.observe(5 * time.Second)
+
+	buf := &bytes.Buffer{}
+	h.write(buf, "test", `a="b"`)
+
+	expected := `test_bucket{a="b",le="0.1"} 1
+test_bucket{a="b",le="1"} 2
+test_bucket{a="b",le="+Inf"} 3
+test_sum{a="b"} 5.55
+test_count{a="b"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%v\ngot\n%v", expected, buf.String())
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	c := NewCollector()
+	c.SetVersion(3, true)
+
+	path := filepath.Join(dir, "migrate.prom")
+	if err := c.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "migrate_dirty 1\n") {
+		t.Errorf("expected dirty state in\n%s", b)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected temporary files to be removed, got %v files", len(files))
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	c := NewCollector()
+	c.SetVersion(3, false)
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "migrate_version 3\n") {
+		t.Errorf("expected version in\n%v", rec.Body.String())
+	}
+}
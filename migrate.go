@@ -5,9 +5,14 @@
 package migrate
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,6 +39,9 @@ var (
 	ErrInvalidVersion = errors.New("version must be >= -1")
 	ErrLocked         = errors.New("database locked")
 	ErrLockTimeout    = errors.New("timeout: can't acquire database lock")
+	ErrNoTransactor   = errors.New("database driver doesn't support transactions")
+	ErrNoLockStatus   = errors.New("lock doesn't support inspection")
+	ErrNoProgress     = errors.New("no statement progress recorded, can't resume")
 )
 
 // ErrShortLimit is an error returned when not enough migrations
@@ -47,6 +55,59 @@ func (e ErrShortLimit) Error() string {
 	return fmt.Sprintf("limit %v short", e.Short)
 }
 
+// ChecksumMismatch describes an applied migration whose content in the
+// source differs from the content that was applied to the database.
+type ChecksumMismatch struct {
+	Version    uint
+	Identifier string
+
+	// AppliedChecksum is the checksum recorded in the migration history.
+	AppliedChecksum string
+
+	// SourceChecksum is the checksum of the migration in the source.
+	// It is empty if the migration doesn't exist in the source anymore.
+	SourceChecksum string
+}
+
+// String implements string.Stringer.
+func (c ChecksumMismatch) String() string {
+	if c.SourceChecksum == "" {
+		return fmt.Sprintf("%v %v: applied %v, missing in source", c.Version, c.Identifier, c.AppliedChecksum)
+	}
+	return fmt.Sprintf("%v %v: applied %v, source %v", c.Version, c.Identifier, c.AppliedChecksum, c.SourceChecksum)
+}
+
+// ErrOutOfOrder is returned by Up if the source holds migrations older than
+// the current version that have never been applied, see Migrate.Missing.
+type ErrOutOfOrder struct {
+	Versions []uint
+}
+
+// Error implements the error interface.
+func (e ErrOutOfOrder) Error() string {
+	return fmt.Sprintf("migrations older than the current version not applied: %v", e.Versions)
+}
+
+// RollbackError is returned if a migration failed and AutoRollback is set.
+type RollbackError struct {
+	Version uint
+
+	// Err is the error the migration failed with.
+	Err error
+
+	// RollbackErr is the error the rollback failed with, nil if the
+	// database was rolled back to the previous clean version.
+	RollbackErr error
+}
+
+// Error implements the error interface.
+func (e RollbackError) Error() string {
+	if e.RollbackErr == nil {
+		return fmt.Sprintf("migration %v failed and was rolled back: %v", e.Version, e.Err)
+	}
+	return fmt.Sprintf("migration %v failed: %v; rollback failed: %v", e.Version, e.Err, e.RollbackErr)
+}
+
 type ErrDirty struct {
 	Version int
 }
@@ -64,22 +125,82 @@ type Migrate struct {
 	// Log accepts a Logger interface
 	Log Logger
 
+	// Hooks accepts a Hooks interface, which is called around
+	// each migration and each run of migrations.
+	Hooks Hooks
+
+	// Observer accepts an Observer interface, which receives
+	// typed events while migrating, next to Log.
+	Observer Observer
+
+	// Locker accepts a Locker interface, which is used to lock
+	// instead of the database driver if set.
+	Locker Locker
+
 	// GracefulStop accepts `true` and will stop executing migrations
 	// as soon as possible at a safe break point, so that the database
-	// is not corrupted.
+	// is not corrupted. It behaves like cancelling the context passed to
+	// one of the *Context methods, except that the migration currently
+	// running is never interrupted and no error is returned.
 	GracefulStop chan bool
 	isLockedMu   *sync.Mutex
 
 	isGracefulStop bool
 	isLocked       bool
+	lockedAt       time.Time
+
+	// lockCancel cancels the context returned by lock
+	lockCancel context.CancelFunc
+
+	// abandonedLock is closed once a Lock that lock gave up on returned
+	abandonedLock chan struct{}
 
 	// PrefetchMigrations defaults to DefaultPrefetchMigrations,
 	// but can be set per Migrate instance.
 	PrefetchMigrations uint
 
 	// LockTimeout defaults to DefaultLockTimeout,
-	// but can be set per Migrate instance.
+	// but can be set per Migrate instance. It applies to every Locker and
+	// database driver, even if Lock blocks regardless of its context: a lock
+	// acquired after the timeout is released again.
 	LockTimeout time.Duration
+
+	// AllowOutOfOrder makes Up apply missing migrations (see Missing)
+	// before moving on, instead of returning ErrOutOfOrder.
+	// The version of the database doesn't change while applying them.
+	AllowOutOfOrder bool
+
+	// AutoRollback makes Migrate run the down migration of an up migration
+	// that failed and restore the previous clean version, instead of leaving
+	// the database dirty. Failures are reported as RollbackError.
+	AutoRollback bool
+
+	// SingleTransaction makes Migrate run all migrations of a run and their
+	// version bookkeeping in a single transaction, so either all of them are
+	// applied or none. The database driver must implement database.Transactor,
+	// otherwise ErrNoTransactor is returned. AutoRollback has no effect then.
+	// Migrations running themselves (see source.Runner), i.e. gofunc
+	// migrations, only run within it if they use the database driver.
+	SingleTransaction bool
+
+	// TrackStatements makes Migrate run up migrations statement by statement
+	// and record how many of them succeeded, if the database driver implements
+	// database.ProgressDriver. An up migration that failed halfway can then be
+	// continued at the failed statement with Resume.
+	TrackStatements bool
+
+	// Env is the environment migrations are applied in. Migrations that are
+	// restricted to other environments with the env directive are skipped,
+	// but their version is recorded all the same.
+	Env string
+
+	// Template makes Migrate render the body of each migration as a
+	// text/template with Vars before running it, i.e. {{.schema}}.
+	Template bool
+
+	// Vars are the variables for Template. New and NewWithSourceInstance
+	// set them from x-var-* query parameters of the database URL.
+	Vars map[string]string
 }
 
 // New returns a new Migrate instance from a source URL and a database URL.
@@ -111,6 +232,10 @@ func New(sourceURL, databaseURL string) (*Migrate, error) {
 	}
 	m.databaseDrv = databaseDrv
 
+	if m.Vars, err = VarsFromURL(databaseURL); err != nil {
+		return nil, err
+	}
+
 	return m, nil
 }
 
@@ -161,6 +286,10 @@ func NewWithSourceInstance(sourceName string, sourceInstance source.Driver, data
 	}
 	m.databaseDrv = databaseDrv
 
+	if m.Vars, err = VarsFromURL(databaseURL); err != nil {
+		return nil, err
+	}
+
 	m.sourceDrv = sourceInstance
 
 	return m, nil
@@ -212,7 +341,15 @@ func (m *Migrate) Close() (source error, database error) {
 // Migrate looks at the currently active migration version,
 // then migrates either up or down to the specified version.
 func (m *Migrate) Migrate(version uint) error {
-	if err := m.lock(); err != nil {
+	return m.MigrateContext(context.Background(), version)
+}
+
+// MigrateContext is like Migrate, but stops at the next safe break point
+// once ctx is done. ctx is passed down to the database driver if it
+// implements database.DriverContext.
+func (m *Migrate) MigrateContext(ctx context.Context, version uint) error {
+	ctx, err := m.lock(ctx)
+	if err != nil {
 		return err
 	}
 
@@ -226,19 +363,27 @@ func (m *Migrate) Migrate(version uint) error {
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
-	go m.read(curVersion, int(version), ret)
+	go m.read(ctx, curVersion, int(version), ret)
 
-	return m.unlockErr(m.runMigrations(ret))
+	return m.unlockErr(m.runMigrations(ctx, ret))
 }
 
 // Steps looks at the currently active migration version.
 // It will migrate up if n > 0, and down if n < 0.
 func (m *Migrate) Steps(n int) error {
+	return m.StepsContext(context.Background(), n)
+}
+
+// StepsContext is like Steps, but stops at the next safe break point
+// once ctx is done. ctx is passed down to the database driver if it
+// implements database.DriverContext.
+func (m *Migrate) StepsContext(ctx context.Context, n int) error {
 	if n == 0 {
 		return ErrNoChange
 	}
 
-	if err := m.lock(); err != nil {
+	ctx, err := m.lock(ctx)
+	if err != nil {
 		return err
 	}
 
@@ -254,18 +399,26 @@ func (m *Migrate) Steps(n int) error {
 	ret := make(chan interface{}, m.PrefetchMigrations)
 
 	if n > 0 {
-		go m.readUp(curVersion, n, ret)
+		go m.readUp(ctx, curVersion, n, ret)
 	} else {
-		go m.readDown(curVersion, -n, ret)
+		go m.readDown(ctx, curVersion, -n, ret)
 	}
 
-	return m.unlockErr(m.runMigrations(ret))
+	return m.unlockErr(m.runMigrations(ctx, ret))
 }
 
 // Up looks at the currently active migration version
 // and will migrate all the way up (applying all up migrations).
 func (m *Migrate) Up() error {
-	if err := m.lock(); err != nil {
+	return m.UpContext(context.Background())
+}
+
+// UpContext is like Up, but stops at the next safe break point
+// once ctx is done. ctx is passed down to the database driver if it
+// implements database.DriverContext.
+func (m *Migrate) UpContext(ctx context.Context) error {
+	ctx, err := m.lock(ctx)
+	if err != nil {
 		return err
 	}
 
@@ -278,16 +431,43 @@ func (m *Migrate) Up() error {
 		return m.unlockErr(ErrDirty{curVersion})
 	}
 
+	return m.unlockErr(m.up(ctx, curVersion))
+}
+
+// up migrates all the way up from the clean curVersion, applying missing
+// versions first if AllowOutOfOrder is set. It must be called with the lock held.
+func (m *Migrate) up(ctx context.Context, curVersion int) error {
+	missing, err := m.missing(curVersion)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 && !m.AllowOutOfOrder {
+		return ErrOutOfOrder{missing}
+	}
+
 	ret := make(chan interface{}, m.PrefetchMigrations)
 
-	go m.readUp(curVersion, -1, ret)
-	return m.unlockErr(m.runMigrations(ret))
+	if len(missing) > 0 {
+		go m.readOutOfOrder(ctx, missing, curVersion, ret)
+	} else {
+		go m.readUp(ctx, curVersion, -1, ret)
+	}
+	return m.runMigrations(ctx, ret)
 }
 
 // Down looks at the currently active migration version
 // and will migrate all the way down (applying all down migrations).
 func (m *Migrate) Down() error {
-	if err := m.lock(); err != nil {
+	return m.DownContext(context.Background())
+}
+
+// DownContext is like Down, but stops at the next safe break point
+// once ctx is done. ctx is passed down to the database driver if it
+// implements database.DriverContext.
+func (m *Migrate) DownContext(ctx context.Context) error {
+	ctx, err := m.lock(ctx)
+	if err != nil {
 		return err
 	}
 
@@ -301,13 +481,19 @@ func (m *Migrate) Down() error {
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
-	go m.readDown(curVersion, -1, ret)
-	return m.unlockErr(m.runMigrations(ret))
+	go m.readDown(ctx, curVersion, -1, ret)
+	return m.unlockErr(m.runMigrations(ctx, ret))
 }
 
 // Drop deletes everything in the database.
 func (m *Migrate) Drop() error {
-	if err := m.lock(); err != nil {
+	return m.DropContext(context.Background())
+}
+
+// DropContext is like Drop, but gives up acquiring the lock once ctx is done.
+func (m *Migrate) DropContext(ctx context.Context) error {
+	ctx, err := m.lock(ctx)
+	if err != nil {
 		return err
 	}
 	if err := m.databaseDrv.Drop(); err != nil {
@@ -321,11 +507,19 @@ func (m *Migrate) Drop() error {
 // Usually you don't need this function at all. Use Migrate,
 // Steps, Up or Down instead.
 func (m *Migrate) Run(migration ...*Migration) error {
+	return m.RunContext(context.Background(), migration...)
+}
+
+// RunContext is like Run, but stops at the next safe break point
+// once ctx is done. ctx is passed down to the database driver if it
+// implements database.DriverContext.
+func (m *Migrate) RunContext(ctx context.Context, migration ...*Migration) error {
 	if len(migration) == 0 {
 		return ErrNoChange
 	}
 
-	if err := m.lock(); err != nil {
+	ctx, err := m.lock(ctx)
+	if err != nil {
 		return err
 	}
 
@@ -343,37 +537,35 @@ func (m *Migrate) Run(migration ...*Migration) error {
 	go func() {
 		defer close(ret)
 		for _, migr := range migration {
-			if m.PrefetchMigrations > 0 && migr.Body != nil {
-				m.logVerbosePrintf("Start buffering %v\n", migr.LogString())
-			} else {
-				m.logVerbosePrintf("Scheduled %v\n", migr.LogString())
-			}
+			m.emitMigration(EventMigrationScheduled, migr, 0, nil)
 
 			ret <- migr
-			go func(migr *Migration) {
-				if err := migr.Buffer(); err != nil {
-					m.logErr(err)
-				}
-			}(migr)
+			go m.buffer(migr)
 		}
 	}()
 
-	return m.unlockErr(m.runMigrations(ret))
+	return m.unlockErr(m.runMigrations(ctx, ret))
 }
 
 // Force sets a migration version.
 // It does not check any currently active version in database.
 // It resets the dirty state to false.
 func (m *Migrate) Force(version int) error {
+	return m.ForceContext(context.Background(), version)
+}
+
+// ForceContext is like Force, but aborts once ctx is done.
+func (m *Migrate) ForceContext(ctx context.Context, version int) error {
 	if version < -1 {
 		return ErrInvalidVersion
 	}
 
-	if err := m.lock(); err != nil {
+	ctx, err := m.lock(ctx)
+	if err != nil {
 		return err
 	}
 
-	if err := m.databaseDrv.SetVersion(version, false); err != nil {
+	if err := m.setVersion(ctx, version, false); err != nil {
 		return m.unlockErr(err)
 	}
 
@@ -395,11 +587,246 @@ func (m *Migrate) Version() (version uint, dirty bool, err error) {
 	return suint(v), d, nil
 }
 
+// Verify compares the up migrations applied to the database with the ones
+// in the source and returns every applied version whose content changed since.
+// It relies on the checksums kept in the migration history, so it returns
+// database.ErrNoHistory if the database driver doesn't keep a history.
+// Migrations applied without a checksum are skipped.
+func (m *Migrate) Verify() ([]ChecksumMismatch, error) {
+	d, ok := m.databaseDrv.(database.HistoryDriver)
+	if !ok {
+		return nil, database.ErrNoHistory
+	}
+
+	entries, err := d.History()
+	if err != nil {
+		return nil, err
+	}
+
+	// the last successful run of a version tells if it is applied
+	applied := make(map[uint]database.HistoryEntry)
+	for _, e := range entries {
+		if e.Success {
+			applied[e.Version] = e
+		}
+	}
+
+	versions := make([]uint, 0, len(applied))
+	for v, e := range applied {
+		if e.Direction == string(source.Up) && e.Checksum != "" {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	mismatches := make([]ChecksumMismatch, 0)
+	for _, v := range versions {
+		e := applied[v]
+		sum, err := m.sourceChecksum(v)
+		if err != nil {
+			return nil, err
+		}
+		if sum != e.Checksum {
+			mismatches = append(mismatches, ChecksumMismatch{
+				Version:         v,
+				Identifier:      e.Identifier,
+				AppliedChecksum: e.Checksum,
+				SourceChecksum:  sum,
+			})
+		}
+	}
+	return mismatches, nil
+}
+
+// Missing returns the versions in the source that are older than the
+// current version, but have never been applied, i.e. migrations merged
+// from a parallel branch after newer ones had already been applied.
+// It relies on the migration history, so it returns database.ErrNoHistory
+// if the database driver doesn't keep a history.
+func (m *Migrate) Missing() ([]uint, error) {
+	d, ok := m.databaseDrv.(database.HistoryDriver)
+	if !ok {
+		return nil, database.ErrNoHistory
+	}
+
+	entries, err := d.History()
+	if err != nil {
+		return nil, err
+	}
+
+	curVersion, _, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.missingFromHistory(curVersion, entries)
+}
+
+// missing is like Missing, but reports nothing instead of
+// failing if the database driver doesn't keep a history.
+func (m *Migrate) missing(curVersion int) ([]uint, error) {
+	entries, err := m.history()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.missingFromHistory(curVersion, entries)
+}
+
+// missingFromHistory returns the versions in the source below curVersion
+// that entries don't know as applied. Versions older than the first one
+// in the history are assumed to be applied, so that enabling the history
+// on an existing database doesn't report its whole past as missing.
+func (m *Migrate) missingFromHistory(curVersion int, entries []database.HistoryEntry) ([]uint, error) {
+	if curVersion == database.NilVersion || len(entries) == 0 {
+		return nil, nil
+	}
+
+	// the last successful run of a version tells if it is applied
+	oldest := entries[0].Version
+	applied := make(map[uint]bool)
+	for _, e := range entries {
+		if e.Version < oldest {
+			oldest = e.Version
+		}
+		if e.Success {
+			applied[e.Version] = e.Direction == string(source.Up)
+		}
+	}
+
+	missing := make([]uint, 0)
+	version, err := m.sourceDrv.First()
+	for err == nil && int(version) < curVersion {
+		if version >= oldest && !applied[version] {
+			missing = append(missing, version)
+		}
+		version, err = m.sourceDrv.Next(version)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// sourceChecksum returns the checksum of the up migration for version
+// or an empty string if the source doesn't have it.
+func (m *Migrate) sourceChecksum(version uint) (sum string, err error) {
+	r, _, err := m.sourceDrv.ReadUp(version)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer func() {
+		if errClose := r.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	return checksum(r)
+}
+
+// PlanMigrate returns the migrations Migrate would apply to reach version,
+// in order, without running them against the database. The migration bodies
+// are read from the source to determine their size (see Migration.BytesRead).
+func (m *Migrate) PlanMigrate(version uint) ([]*Migration, error) {
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	if dirty {
+		return nil, ErrDirty{curVersion}
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+	go m.read(context.Background(), curVersion, int(version), ret)
+
+	return m.planMigrations(ret)
+}
+
+// PlanSteps returns the migrations Steps would apply, in order,
+// without running them against the database. See PlanMigrate.
+func (m *Migrate) PlanSteps(n int) ([]*Migration, error) {
+	if n == 0 {
+		return nil, ErrNoChange
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	if dirty {
+		return nil, ErrDirty{curVersion}
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+
+	if n > 0 {
+		go m.readUp(context.Background(), curVersion, n, ret)
+	} else {
+		go m.readDown(context.Background(), curVersion, -n, ret)
+	}
+
+	return m.planMigrations(ret)
+}
+
+// PlanUp returns the migrations Up would apply, in order,
+// without running them against the database. See PlanMigrate.
+func (m *Migrate) PlanUp() ([]*Migration, error) {
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	if dirty {
+		return nil, ErrDirty{curVersion}
+	}
+
+	missing, err := m.missing(curVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) > 0 && !m.AllowOutOfOrder {
+		return nil, ErrOutOfOrder{missing}
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+	if len(missing) > 0 {
+		go m.readOutOfOrder(context.Background(), missing, curVersion, ret)
+	} else {
+		go m.readUp(context.Background(), curVersion, -1, ret)
+	}
+
+	return m.planMigrations(ret)
+}
+
+// PlanDown returns the migrations Down would apply, in order,
+// without running them against the database. See PlanMigrate.
+func (m *Migrate) PlanDown() ([]*Migration, error) {
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	if dirty {
+		return nil, ErrDirty{curVersion}
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+	go m.readDown(context.Background(), curVersion, -1, ret)
+
+	return m.planMigrations(ret)
+}
+
 // read reads either up or down migrations from source `from` to `to`.
 // Each migration is then written to the ret channel.
 // If an error occurs during reading, that error is written to the ret channel, too.
 // Once read is done reading it will close the ret channel.
-func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
+func (m *Migrate) read(ctx context.Context, from int, to int, ret chan<- interface{}) {
 	defer close(ret)
 
 	// check if from version exists
@@ -441,18 +868,14 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go func() {
-				if err := migr.Buffer(); err != nil {
-					m.logErr(err)
-				}
-			}()
+			go m.buffer(migr)
 
 			from = int(firstVersion)
 		}
 
 		// run until we reach target ...
 		for from < to {
-			if m.stop() {
+			if m.stop(ctx) {
 				return
 			}
 
@@ -469,11 +892,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go func() {
-				if err := migr.Buffer(); err != nil {
-					m.logErr(err)
-				}
-			}()
+			go m.buffer(migr)
 
 			from = int(next)
 		}
@@ -482,7 +901,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 		// it's going down
 		// run until we reach target ...
 		for from > to && from >= 0 {
-			if m.stop() {
+			if m.stop(ctx) {
 				return
 			}
 
@@ -495,11 +914,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 					return
 				}
 				ret <- migr
-				go func() {
-					if err := migr.Buffer(); err != nil {
-						m.logErr(err)
-					}
-				}()
+				go m.buffer(migr)
 
 				return
 
@@ -515,11 +930,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go func() {
-				if err := migr.Buffer(); err != nil {
-					m.logErr(err)
-				}
-			}()
+			go m.buffer(migr)
 
 			from = int(prev)
 		}
@@ -531,7 +942,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 // Each migration is then written to the ret channel.
 // If an error occurs during reading, that error is written to the ret channel, too.
 // Once readUp is done reading it will close the ret channel.
-func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
+func (m *Migrate) readUp(ctx context.Context, from int, limit int, ret chan<- interface{}) {
 	defer close(ret)
 
 	// check if from version exists
@@ -549,7 +960,7 @@ func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
 
 	count := 0
 	for count < limit || limit == -1 {
-		if m.stop() {
+		if m.stop(ctx) {
 			return
 		}
 
@@ -568,11 +979,7 @@ func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go func() {
-				if err := migr.Buffer(); err != nil {
-					m.logErr(err)
-				}
-			}()
+			go m.buffer(migr)
 			from = int(firstVersion)
 			count++
 			continue
@@ -616,22 +1023,50 @@ func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
 		}
 
 		ret <- migr
-		go func() {
-			if err := migr.Buffer(); err != nil {
-				m.logErr(err)
-			}
-		}()
+		go m.buffer(migr)
 		from = int(next)
 		count++
 	}
 }
 
+// readOutOfOrder sends the up migrations of the missing versions first,
+// keeping the database at curVersion, and then whatever readUp reads
+// starting at curVersion. It closes ret like readUp does.
+func (m *Migrate) readOutOfOrder(ctx context.Context, missing []uint, curVersion int, ret chan<- interface{}) {
+	defer close(ret)
+
+	for _, version := range missing {
+		if m.stop(ctx) {
+			return
+		}
+
+		migr, err := m.newMigration(version, curVersion)
+		if err != nil {
+			ret <- err
+			return
+		}
+
+		ret <- migr
+		go m.buffer(migr)
+	}
+
+	up := make(chan interface{}, m.PrefetchMigrations)
+	go m.readUp(ctx, curVersion, -1, up)
+	for r := range up {
+		// the missing migrations were a change already
+		if r == ErrNoChange {
+			continue
+		}
+		ret <- r
+	}
+}
+
 // readDown reads down migrations from `from` limitted by `limit`.
 // limit can be -1, implying no limit and reading until there are no more migrations.
 // Each migration is then written to the ret channel.
 // If an error occurs during reading, that error is written to the ret channel, too.
 // Once readDown is done reading it will close the ret channel.
-func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
+func (m *Migrate) readDown(ctx context.Context, from int, limit int, ret chan<- interface{}) {
 	defer close(ret)
 
 	// check if from version exists
@@ -661,7 +1096,7 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 
 	count := 0
 	for count < limit || limit == -1 {
-		if m.stop() {
+		if m.stop(ctx) {
 			return
 		}
 
@@ -681,11 +1116,7 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 					return
 				}
 				ret <- migr
-				go func() {
-					if err := migr.Buffer(); err != nil {
-						m.logErr(err)
-					}
-				}()
+				go m.buffer(migr)
 				count++
 			}
 
@@ -706,11 +1137,7 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 		}
 
 		ret <- migr
-		go func() {
-			if err := migr.Buffer(); err != nil {
-				m.logErr(err)
-			}
-		}()
+		go m.buffer(migr)
 		from = int(prev)
 		count++
 	}
@@ -720,13 +1147,29 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 // sent on this channel will result in a panic. Each migration is then
 // proxied to the database driver and run against the database.
 // Before running a newly received migration it will check if it's supposed
-// to stop execution because it might have received a stop signal on the
-// GracefulStop channel.
-func (m *Migrate) runMigrations(ret <-chan interface{}) error {
+// to stop execution because ctx is done or it might have received a stop
+// signal on the GracefulStop channel.
+func (m *Migrate) runMigrations(ctx context.Context, ret <-chan interface{}) (err error) {
+	// AfterRun is only called if BeforeRun was
+	hasRun := false
+	var tx database.Transactor
+
+	// the version expected in the database, see setVersionIf
+	var curVersion int
+	var curDirty bool
+	defer func() {
+		if tx != nil {
+			err = endTransaction(tx, err)
+		}
+		if hasRun {
+			err = m.afterRun(err)
+		}
+	}()
+
 	for r := range ret {
 
-		if m.stop() {
-			return nil
+		if m.stop(ctx) {
+			return ctx.Err()
 		}
 
 		switch r := r.(type) {
@@ -736,41 +1179,191 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 		case *Migration:
 			migr := r
 
-			// set version with dirty state
-			if err := m.databaseDrv.SetVersion(migr.TargetVersion, true); err != nil {
+			if !hasRun {
+				t, ok := m.databaseDrv.(database.Transactor)
+				if m.SingleTransaction && !ok {
+					return ErrNoTransactor
+				}
+
+				if err := m.beforeRun(); err != nil {
+					return err
+				}
+				hasRun = true
+
+				if m.SingleTransaction {
+					if err := t.Begin(); err != nil {
+						return err
+					}
+					tx = t
+				}
+
+				curVersion, curDirty, err = m.databaseDrv.Version()
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := migr.readDirectives(); err != nil {
+				return err
+			}
+			if migr.Directives.NoTransaction && tx != nil {
+				return fmt.Errorf("%v: can't run without transaction, since SingleTransaction is set", migr.LogString())
+			}
+			if m.Template && appliesIn(migr.Directives, m.Env) {
+				if err := migr.render(m.Vars); err != nil {
+					return err
+				}
+			}
+
+			if err := m.beforeMigration(migr); err != nil {
 				return err
 			}
 
-			if migr.Body != nil {
-				m.logVerbosePrintf("Read and execute %v\n", migr.LogString())
-				if err := m.databaseDrv.Run(migr.BufferedBody); err != nil {
+			// remember the clean version to roll back to
+			prevVersion := curVersion
+
+			// StartedBuffering is set before the buffer is written,
+			// so it's safe to read once readDirectives has read from it
+			startTime := migr.StartedBuffering
+
+			// set version with dirty state, unless resuming
+			// a migration which left the database dirty already
+			if !migr.resumed() {
+				if err := m.setVersionIf(ctx, curVersion, curDirty, migr.TargetVersion, true); err != nil {
+					return err
+				}
+				curVersion, curDirty = migr.TargetVersion, true
+				m.emitMigration(EventVersionDirty, migr, 0, nil)
+			}
+
+			m.emitMigration(EventRunStarted, migr, 0, nil)
+			runStart := time.Now()
+			if migr.Body != nil && !appliesIn(migr.Directives, m.Env) {
+				m.logVerbosePrintf("Skipping %v, it only applies in %v\n", migr.LogString(), strings.Join(migr.Directives.Env, ","))
+				if _, err := io.Copy(ioutil.Discard, migr.BufferedBody); err != nil {
+					return err
+				}
+			} else if migr.Body != nil {
+				if err := m.runBody(ctx, migr); err != nil {
+					m.emitMigration(EventRunFinished, migr, time.Since(runStart), err)
+					err = m.afterMigration(migr, err)
+					if errHistory := m.addHistory(migr, startTime, time.Now(), false); errHistory != nil {
+						m.logErr(errHistory)
+					}
+					// the version before a resumed migration isn't known
+					if m.AutoRollback && tx == nil && migr.Direction() == source.Up && !migr.resumed() {
+						return RollbackError{Version: migr.Version, Err: err, RollbackErr: m.rollback(migr, prevVersion)}
+					}
 					return err
 				}
 			}
+			m.emitMigration(EventRunFinished, migr, time.Since(runStart), nil)
+
+			if err := m.afterMigration(migr, nil); err != nil {
+				if errHistory := m.addHistory(migr, startTime, time.Now(), false); errHistory != nil {
+					m.logErr(errHistory)
+				}
+				return err
+			}
 
 			// set clean state
-			if err := m.databaseDrv.SetVersion(migr.TargetVersion, false); err != nil {
+			if err := m.setVersionIf(ctx, curVersion, curDirty, migr.TargetVersion, false); err != nil {
 				return err
 			}
+			curDirty = false
+			m.emitMigration(EventVersionClean, migr, 0, nil)
 
 			endTime := time.Now()
-			readTime := migr.FinishedReading.Sub(migr.StartedBuffering)
-			runTime := endTime.Sub(migr.FinishedReading)
-
-			// log either verbose or normal
-			if m.Log != nil {
-				if m.Log.Verbose() {
-					m.logPrintf("Finished %v (read %v, ran %v)\n", migr.LogString(), readTime, runTime)
-				} else {
-					m.logPrintf("%v (%v)\n", migr.LogString(), readTime+runTime)
-				}
+			if err := m.addHistory(migr, startTime, endTime, true); err != nil {
+				return err
 			}
 
 		default:
 			return fmt.Errorf("unknown type: %T with value: %+v", r, r)
 		}
 	}
-	return nil
+
+	// reading stops silently once ctx is done, so report it here
+	return ctx.Err()
+}
+
+// endTransaction commits tx if err is nil and rolls it back otherwise.
+// It returns err combined with the error of the commit or rollback.
+func endTransaction(tx database.Transactor, err error) error {
+	if err != nil {
+		return appendErr(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// rollback runs the down migration of migr after it failed
+// and restores prevVersion. It isn't canceled with the context
+// of the run, since it cleans up after a failure.
+func (m *Migrate) rollback(migr *Migration, prevVersion int) error {
+	r, identifier, err := m.sourceDrv.ReadDown(migr.Version)
+	if err != nil {
+		return err
+	}
+
+	rb, err := NewMigration(r, identifier, migr.Version, prevVersion)
+	if err != nil {
+		return err
+	}
+	m.logVerbosePrintf("Rolling back %v\n", migr.LogString())
+	go m.buffer(rb)
+	if err := rb.readDirectives(); err != nil {
+		return err
+	}
+	if m.Template {
+		if err := rb.render(m.Vars); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	startTime := time.Now()
+
+	m.emitMigration(EventRunStarted, rb, 0, nil)
+	if err := m.runBody(ctx, rb); err != nil {
+		m.emitMigration(EventRunFinished, rb, time.Since(startTime), err)
+		if errHistory := m.addHistory(rb, startTime, time.Now(), false); errHistory != nil {
+			m.logErr(errHistory)
+		}
+		return err
+	}
+	m.emitMigration(EventRunFinished, rb, time.Since(startTime), nil)
+
+	if err := m.setVersionIf(ctx, migr.TargetVersion, true, prevVersion, false); err != nil {
+		return err
+	}
+	m.emitMigration(EventVersionClean, rb, 0, nil)
+
+	return m.addHistory(rb, startTime, time.Now(), true)
+}
+
+// planMigrations reads *Migration and error from a channel, just like
+// runMigrations, but collects the migrations instead of running them.
+// Each migration body is drained so that its size is known.
+func (m *Migrate) planMigrations(ret <-chan interface{}) ([]*Migration, error) {
+	plan := make([]*Migration, 0)
+	for r := range ret {
+		switch r := r.(type) {
+		case error:
+			return nil, r
+
+		case *Migration:
+			if r.Body != nil {
+				if _, err := io.Copy(ioutil.Discard, r.BufferedBody); err != nil {
+					return nil, err
+				}
+			}
+			plan = append(plan, r)
+
+		default:
+			return nil, fmt.Errorf("unknown type: %T with value: %+v", r, r)
+		}
+	}
+	return plan, nil
 }
 
 // versionExists checks the source if either the up or down migration for
@@ -811,9 +1404,9 @@ func (m *Migrate) versionExists(version uint) (result error) {
 }
 
 // stop returns true if no more migrations should be run against the database
-// because a stop signal was received on the GracefulStop channel.
+// because ctx is done or a stop signal was received on the GracefulStop channel.
 // Calls are cheap and this function is not blocking.
-func (m *Migrate) stop() bool {
+func (m *Migrate) stop(ctx context.Context) bool {
 	if m.isGracefulStop {
 		return true
 	}
@@ -823,6 +1416,9 @@ func (m *Migrate) stop() bool {
 		m.isGracefulStop = true
 		return true
 
+	case <-ctx.Done():
+		return true
+
 	default:
 		return false
 	}
@@ -874,63 +1470,117 @@ func (m *Migrate) newMigration(version uint, targetVersion int) (*Migration, err
 		}
 	}
 
-	if m.PrefetchMigrations > 0 && migr.Body != nil {
-		m.logVerbosePrintf("Start buffering %v\n", migr.LogString())
-	} else {
-		m.logVerbosePrintf("Scheduled %v\n", migr.LogString())
-	}
+	m.emitMigration(EventMigrationScheduled, migr, 0, nil)
 
 	return migr, nil
 }
 
+// buffer buffers migr and emits its progress.
+// Calling this function blocks. Call with goroutine.
+func (m *Migrate) buffer(migr *Migration) {
+	if migr.Body == nil {
+		return
+	}
+
+	m.emitMigration(EventBufferingStarted, migr, 0, nil)
+	if err := migr.Buffer(); err != nil {
+		m.logErr(err)
+		return
+	}
+	m.emitMigration(EventBufferingFinished, migr, migr.FinishedReading.Sub(migr.StartedBuffering), nil)
+}
+
 // lock is a thread safe helper function to lock the database.
 // It should be called as late as possible when running migrations.
-func (m *Migrate) lock() error {
+// The returned context is derived from ctx and is cancelled by unlock,
+// or once the lock is lost if the locker implements
+// database.LockLossNotifier, so the migrations stop at the next safe
+// break point instead of running without the lock. The run then fails
+// with database.ErrLeaseLost, see unlockErr.
+func (m *Migrate) lock(ctx context.Context) (context.Context, error) {
 	m.isLockedMu.Lock()
 	defer m.isLockedMu.Unlock()
 
 	if m.isLocked {
-		return ErrLocked
+		return nil, ErrLocked
 	}
 
-	// create done channel, used in the timeout goroutine
-	done := make(chan bool, 1)
-	defer func() {
-		done <- true
-	}()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// use errchan to signal error back to this context
-	errchan := make(chan error, 2)
+	lockCtx, cancel := context.WithTimeout(ctx, m.LockTimeout)
+	defer cancel()
 
-	// start timeout goroutine
-	timeout := time.After(m.LockTimeout)
-	go func() {
-		for {
+	lockStart := time.Now()
+	if err := m.lockUntil(lockCtx); err != nil {
+		if lockCtx.Err() == nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrLockTimeout
+	}
+
+	m.isLocked = true
+	m.lockedAt = time.Now()
+	m.emit(Event{Type: EventLockAcquired, Duration: m.lockedAt.Sub(lockStart)})
+
+	runCtx, cancel := context.WithCancel(ctx)
+	m.lockCancel = cancel
+	if lost := m.lockLost(); lost != nil {
+		go func() {
 			select {
-			case <-done:
-				return
-			case <-timeout:
-				errchan <- ErrLockTimeout
-				return
+			case <-lost:
+				m.logErr(database.ErrLeaseLost)
+				cancel()
+			case <-runCtx.Done():
 			}
+		}()
+	}
+	return runCtx, nil
+}
+
+// lockUntil acquires the lock, giving up once ctx is done. Drivers
+// implementing database.DriverContext wait only until ctx is done, but
+// other drivers and Lockers may block regardless of ctx, so Lock runs in
+// its own goroutine. A lock it acquires after giving up is released right
+// away, and the next call waits for that first.
+// It must be called with isLockedMu held.
+func (m *Migrate) lockUntil(ctx context.Context) error {
+	if m.abandonedLock != nil {
+		select {
+		case <-m.abandonedLock:
+			m.abandonedLock = nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-	}()
+	}
 
-	// now try to acquire the lock
+	locker := m.locker()
+	errchan := make(chan error, 1)
 	go func() {
-		if err := m.databaseDrv.Lock(); err != nil {
-			errchan <- err
-		} else {
-			errchan <- nil
-		}
+		errchan <- locker.Lock(ctx)
 	}()
 
-	// wait until we either receive ErrLockTimeout or error from Lock operation
-	err := <-errchan
-	if err == nil {
-		m.isLocked = true
+	select {
+	case err := <-errchan:
+		return err
+	case <-ctx.Done():
 	}
-	return err
+
+	abandoned := make(chan struct{})
+	m.abandonedLock = abandoned
+	go func() {
+		defer close(abandoned)
+		if err := <-errchan; err == nil {
+			if err := locker.Unlock(); err != nil {
+				m.logErr(err)
+			}
+		}
+	}()
+	return ctx.Err()
 }
 
 // unlock is a thread safe helper function to unlock the database.
@@ -940,28 +1590,110 @@ func (m *Migrate) unlock() error {
 	m.isLockedMu.Lock()
 	defer m.isLockedMu.Unlock()
 
-	if err := m.databaseDrv.Unlock(); err != nil {
-		// BUG: Can potentially create a deadlock. Add a timeout.
+	if m.lockCancel != nil {
+		m.lockCancel()
+		m.lockCancel = nil
+	}
+
+	if err := m.locker().Unlock(); err != nil {
 		return err
 	}
 
 	m.isLocked = false
+	m.emit(Event{Type: EventLockReleased, Duration: time.Since(m.lockedAt)})
 	return nil
 }
 
+// runDriver runs a migration against the database, passing ctx down to
+// the driver if it implements database.DriverContext.
+func (m *Migrate) runDriver(ctx context.Context, migration io.Reader) error {
+	if d, ok := m.databaseDrv.(database.DriverContext); ok {
+		return d.RunContext(ctx, migration)
+	}
+	return m.databaseDrv.Run(migration)
+}
+
+// setVersion saves version and dirty state, passing ctx down to the
+// driver if it implements database.DriverContext.
+func (m *Migrate) setVersion(ctx context.Context, version int, dirty bool) error {
+	if d, ok := m.databaseDrv.(database.DriverContext); ok {
+		return d.SetVersionContext(ctx, version, dirty)
+	}
+	return m.databaseDrv.SetVersion(version, dirty)
+}
+
+// setVersionIf is like setVersion, but fails with database.ErrVersionConflict
+// if the driver implements database.VersionCASDriver and the database isn't
+// at expectedVersion and expectedDirty anymore, i.e. since another process
+// migrated it concurrently.
+func (m *Migrate) setVersionIf(ctx context.Context, expectedVersion int, expectedDirty bool, version int, dirty bool) error {
+	if d, ok := m.databaseDrv.(database.VersionCASDriver); ok {
+		return d.SetVersionIf(ctx, expectedVersion, expectedDirty, version, dirty)
+	}
+	return m.setVersion(ctx, version, dirty)
+}
+
+// addHistory appends a run of migr to the migration history
+// if the driver implements database.HistoryDriver. startTime and endTime
+// enclose the whole run, including reading the migration from the source.
+func (m *Migrate) addHistory(migr *Migration, startTime, endTime time.Time, success bool) error {
+	d, ok := m.databaseDrv.(database.HistoryDriver)
+	if !ok {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	entry := database.HistoryEntry{
+		Version:       migr.Version,
+		TargetVersion: migr.TargetVersion,
+		Direction:     string(migr.Direction()),
+		Identifier:    migr.Identifier,
+		StartedAt:     startTime,
+		FinishedAt:    endTime,
+		Duration:      endTime.Sub(startTime),
+		AppliedBy:     currentUser(),
+		Hostname:      hostname,
+		Success:       success,
+	}
+
+	// a failed run might not have read the whole body
+	if success {
+		entry.Checksum = migr.Checksum
+	}
+
+	return d.AddHistory(entry)
+}
+
 // unlockErr calls unlock and returns a combined error
 // if a prevErr is not nil.
 func (m *Migrate) unlockErr(prevErr error) error {
+	// a run failing once the lock is lost was most likely cancelled by it,
+	// so it fails with database.ErrLeaseLost, which Unlock reports again
+	leaseLost := prevErr != nil && isClosed(m.lockLost())
+	if leaseLost {
+		if prevErr != context.Canceled {
+			m.logErr(prevErr)
+		}
+		prevErr = database.ErrLeaseLost
+	}
+
 	if err := m.unlock(); err != nil {
+		if leaseLost && err == database.ErrLeaseLost {
+			return prevErr
+		}
 		return multierror.Append(prevErr, err)
 	}
 	return prevErr
 }
 
-// logPrintf writes to m.Log if not nil
-func (m *Migrate) logPrintf(format string, v ...interface{}) {
-	if m.Log != nil {
-		m.Log.Printf(format, v...)
+// isClosed returns whether c is closed, without blocking.
+// It is false for a nil channel.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -972,9 +1704,7 @@ func (m *Migrate) logVerbosePrintf(format string, v ...interface{}) {
 	}
 }
 
-// logErr writes error to m.Log if not nil
+// logErr emits err, which writes it to m.Log if not nil
 func (m *Migrate) logErr(err error) {
-	if m.Log != nil {
-		m.Log.Printf("error: %v", err)
-	}
+	m.emit(Event{Type: EventError, Err: err})
 }
@@ -2,15 +2,25 @@ package migrate
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 )
 
 import (
+	"github.com/solvedata/migrate/v4/database"
 	dStub "github.com/solvedata/migrate/v4/database/stub"
 	"github.com/solvedata/migrate/v4/source"
 	sStub "github.com/solvedata/migrate/v4/source/stub"
@@ -878,6 +888,828 @@ func TestUpAndDown(t *testing.T) {
 	equalDbSeq(t, 1, expectedSequence, dbDrv)
 }
 
+// contextStub is a database stub that implements database.DriverContext and
+// cancels the run after the first migration it has been handed.
+type contextStub struct {
+	*dStub.Stub
+	cancel context.CancelFunc
+}
+
+func (s *contextStub) LockContext(ctx context.Context) error {
+	return s.Lock()
+}
+
+func (s *contextStub) RunContext(ctx context.Context, migration io.Reader) error {
+	s.cancel()
+	return s.Run(migration)
+}
+
+func (s *contextStub) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	return s.SetVersion(version, dirty)
+}
+
+func TestUpContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.databaseDrv = &contextStub{Stub: dbDrv, cancel: cancel}
+
+	if err := m.UpContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	equalDbSeq(t, 0, migrationSequence{mr("CREATE 1")}, dbDrv)
+
+	v, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 || dirty {
+		t.Errorf("expected clean version 1, got %v (dirty: %v)", v, dirty)
+	}
+}
+
+func TestUpContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.UpContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	equalDbSeq(t, 0, migrationSequence{}, dbDrv)
+}
+
+func TestUpGracefulStop(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	m.GracefulStop <- true
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 0, migrationSequence{}, dbDrv)
+}
+
+func TestHistory(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		version       uint
+		targetVersion int
+		direction     string
+	}{
+		{1, 1, "up"},
+		{3, 3, "up"},
+		{4, 4, "up"},
+		{4, 3, "down"},
+	}
+
+	if len(dbDrv.HistoryEntries) != len(expected) {
+		t.Fatalf("expected %v history entries, got %v", len(expected), len(dbDrv.HistoryEntries))
+	}
+	for i, e := range expected {
+		got := dbDrv.HistoryEntries[i]
+		if got.Version != e.version || got.TargetVersion != e.targetVersion || got.Direction != e.direction {
+			t.Errorf("entry %v: expected %+v, got %+v", i, e, got)
+		}
+		if !got.Success {
+			t.Errorf("entry %v: expected success", i)
+		}
+		if got.FinishedAt.Before(got.StartedAt) {
+			t.Errorf("entry %v: finished before it started", i)
+		}
+	}
+}
+
+func TestHistoryFailed(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.databaseDrv = &failingStub{Stub: dbDrv, failOn: []string{"CREATE 3"}}
+
+	if err := m.Migrate(4); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(dbDrv.HistoryEntries) != 2 {
+		t.Fatalf("expected 2 history entries, got %v", len(dbDrv.HistoryEntries))
+	}
+	got := dbDrv.HistoryEntries[1]
+	if got.Version != 3 || got.Success {
+		t.Errorf("expected a failed entry for version 3, got %+v", got)
+	}
+	if got.FinishedAt.Before(got.StartedAt) || got.Duration != got.FinishedAt.Sub(got.StartedAt) {
+		t.Errorf("unexpected timing of the failed entry: %+v", got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	srcDrv.Migrations = sourceStubMigrations
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err := m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("expected no mismatches, got %v", mismatches)
+	}
+
+	// edit version 3 and remove version 4 after they have been applied
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3 AND MORE"})
+
+	mismatches, err = m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 2 {
+		t.Fatalf("expected 2 mismatches, got %v", mismatches)
+	}
+
+	expectedSum, _ := checksum(strings.NewReader("CREATE 3 AND MORE"))
+	if c := mismatches[0]; c.Version != 3 || c.SourceChecksum != expectedSum || c.AppliedChecksum == c.SourceChecksum {
+		t.Errorf("unexpected mismatch for version 3: %+v", c)
+	}
+	if c := mismatches[1]; c.Version != 4 || c.SourceChecksum != "" || c.AppliedChecksum == "" {
+		t.Errorf("unexpected mismatch for version 4: %+v", c)
+	}
+}
+
+func TestVerifyRolledBack(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	srcDrv.Migrations = sourceStubMigrations
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	// version 4 is not applied anymore, so its removal isn't drift
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+
+	mismatches, err := m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("expected no mismatches, got %v", mismatches)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	srcDrv.Migrations = sourceStubMigrations
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MigrationStatus{
+		{Version: 1, Identifier: "1.up.stub", State: StateApplied, Up: true, Down: true},
+		{Version: 3, Identifier: "3.up.stub", State: StateApplied, Up: true},
+		{Version: 4, Identifier: "4.up.stub", State: StateCurrent, Up: true, Down: true},
+		{Version: 5, Identifier: "5.down.stub", State: StatePending, Down: true},
+		{Version: 7, Identifier: "7.up.stub", State: StatePending, Up: true, Down: true},
+	}
+	if !reflect.DeepEqual(expected, statuses) {
+		t.Fatalf("expected %+v, got %+v", expected, statuses)
+	}
+
+	// remove versions 3 and 4 after they have been applied
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 7, Direction: source.Up, Identifier: "CREATE 7"})
+	m.databaseDrv.(*dStub.Stub).IsDirty = true
+
+	statuses, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []MigrationStatus{
+		{Version: 1, Identifier: "1.up.stub", State: StateApplied, Up: true},
+		{Version: 3, Identifier: "3.up.stub", State: StateMissing},
+		{Version: 4, Identifier: "4.up.stub", State: StateCurrent, Dirty: true},
+		{Version: 7, Identifier: "7.up.stub", State: StatePending, Up: true},
+	}
+	if !reflect.DeepEqual(expected, statuses) {
+		t.Fatalf("expected %+v, got %+v", expected, statuses)
+	}
+}
+
+func TestUpOutOfOrder(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// version 2 is merged from another branch after 3 has been applied
+	srcDrv.Migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "CREATE 4"})
+
+	missing, err := m.Missing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != 2 {
+		t.Fatalf("expected missing version 2, got %v", missing)
+	}
+
+	err = m.Up()
+	if e, ok := err.(ErrOutOfOrder); !ok || len(e.Versions) != 1 || e.Versions[0] != 2 {
+		t.Fatalf("expected ErrOutOfOrder for version 2, got %v", err)
+	}
+	equalDbSeq(t, 0, migrationSequence{mr("CREATE 1"), mr("CREATE 3")}, dbDrv)
+
+	m.AllowOutOfOrder = true
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 1, migrationSequence{mr("CREATE 1"), mr("CREATE 3"), mr("CREATE 2"), mr("CREATE 4")}, dbDrv)
+
+	entry := dbDrv.HistoryEntries[2]
+	if entry.Version != 2 || entry.TargetVersion != 3 || entry.Direction != "up" {
+		t.Errorf("unexpected history entry for version 2: %+v", entry)
+	}
+
+	v, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 4 || dirty {
+		t.Errorf("expected clean version 4, got %v (dirty: %v)", v, dirty)
+	}
+
+	missing, err = m.Missing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("expected no missing versions, got %v", missing)
+	}
+
+	if err := m.Up(); err != ErrNoChange {
+		t.Errorf("expected ErrNoChange, got %v", err)
+	}
+}
+
+// hookRecorder records the calls to its hooks and fails
+// the migration hooks for the configured versions.
+type hookRecorder struct {
+	calls                  []string
+	failBeforeMigrationFor uint
+	failAfterMigrationFor  uint
+}
+
+func (h *hookRecorder) BeforeRun() error {
+	h.calls = append(h.calls, "before run")
+	return nil
+}
+
+func (h *hookRecorder) BeforeMigration(migr *Migration) error {
+	h.calls = append(h.calls, fmt.Sprintf("before %v", migr.Version))
+	if migr.Version == h.failBeforeMigrationFor {
+		return errors.New("before migration failed")
+	}
+	return nil
+}
+
+func (h *hookRecorder) AfterMigration(migr *Migration, err error) error {
+	h.calls = append(h.calls, fmt.Sprintf("after %v (%v)", migr.Version, err))
+	if migr.Version == h.failAfterMigrationFor {
+		return errors.New("after migration failed")
+	}
+	return nil
+}
+
+func (h *hookRecorder) AfterRun(err error) error {
+	h.calls = append(h.calls, fmt.Sprintf("after run (%v)", err))
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	tt := []struct {
+		name                   string
+		failBeforeMigrationFor uint
+		failAfterMigrationFor  uint
+		expectErr              string
+		expectVersion          uint
+		expectDirty            bool
+		expectCalls            []string
+		expectSeq              migrationSequence
+	}{
+		{
+			name:          "success",
+			expectVersion: 4,
+			expectCalls: []string{
+				"before run",
+				"before 1", "after 1 (<nil>)",
+				"before 3", "after 3 (<nil>)",
+				"before 4", "after 4 (<nil>)",
+				"after run (<nil>)",
+			},
+			expectSeq: migrationSequence{mr("CREATE 1"), mr("CREATE 3"), mr("CREATE 4")},
+		},
+		{
+			name:                   "before migration fails",
+			failBeforeMigrationFor: 3,
+			expectErr:              "before migration failed",
+			expectVersion:          1,
+			expectCalls: []string{
+				"before run",
+				"before 1", "after 1 (<nil>)",
+				"before 3",
+				"after run (before migration failed)",
+			},
+			expectSeq: migrationSequence{mr("CREATE 1")},
+		},
+		{
+			name:                  "after migration fails",
+			failAfterMigrationFor: 3,
+			expectErr:             "after migration failed",
+			expectVersion:         3,
+			expectDirty:           true,
+			expectCalls: []string{
+				"before run",
+				"before 1", "after 1 (<nil>)",
+				"before 3", "after 3 (<nil>)",
+				"after run (after migration failed)",
+			},
+			expectSeq: migrationSequence{mr("CREATE 1"), mr("CREATE 3")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+			dbDrv := m.databaseDrv.(*dStub.Stub)
+
+			hooks := &hookRecorder{
+				failBeforeMigrationFor: tc.failBeforeMigrationFor,
+				failAfterMigrationFor:  tc.failAfterMigrationFor,
+			}
+			m.Hooks = hooks
+
+			err := m.Migrate(4)
+			if tc.expectErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.expectErr != "" && (err == nil || err.Error() != tc.expectErr) {
+				t.Fatalf("expected error %q, got %v", tc.expectErr, err)
+			}
+
+			if strings.Join(hooks.calls, ", ") != strings.Join(tc.expectCalls, ", ") {
+				t.Errorf("expected calls\n%v\ngot\n%v", tc.expectCalls, hooks.calls)
+			}
+			equalDbSeq(t, 0, tc.expectSeq, dbDrv)
+
+			v, dirty, err := m.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tc.expectVersion || dirty != tc.expectDirty {
+				t.Errorf("expected version %v (dirty: %v), got %v (dirty: %v)", tc.expectVersion, tc.expectDirty, v, dirty)
+			}
+		})
+	}
+}
+
+func TestHooksNoChange(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := &hookRecorder{}
+	m.Hooks = hooks
+	if err := m.Migrate(4); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if len(hooks.calls) != 0 {
+		t.Errorf("expected no calls, got %v", hooks.calls)
+	}
+}
+
+// eventRecorder records the events it observes.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Observe(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// types returns the types of the recorded events, leaving out the
+// ones emitted by the goroutines reading from the source.
+func (r *eventRecorder) types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := make([]string, 0)
+	for _, e := range r.events {
+		switch e.Type {
+		case EventMigrationScheduled, EventBufferingStarted, EventBufferingFinished:
+			continue
+		}
+		types = append(types, fmt.Sprintf("%v %v", e.Type, e.Version))
+	}
+	return types
+}
+
+func TestObserver(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	r := &eventRecorder{}
+	m.Observer = r
+	if err := m.Migrate(3); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"lock_acquired 0",
+		"version_dirty 1", "run_started 1", "run_finished 1", "version_clean 1",
+		"version_dirty 3", "run_started 3", "run_finished 3", "version_clean 3",
+		"lock_released 0",
+	}
+	if got := r.types(); strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected events\n%v\ngot\n%v", expected, got)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.events {
+		if e.Time.IsZero() {
+			t.Errorf("expected time to be set for %v", e.Type)
+		}
+		if e.Type == EventRunFinished && e.Identifier == "" {
+			t.Errorf("expected identifier to be set for %v", e.Type)
+		}
+	}
+}
+
+func TestJSONObserver(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	buf := &syncBuffer{}
+	m.Observer = NewJSONObserver(buf)
+	if err := m.Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 6 {
+		t.Fatalf("expected at least 6 lines, got %v", lines)
+	}
+	for _, line := range lines {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		if e["type"] == string(EventRunFinished) && e["version"] != float64(1) {
+			t.Errorf("expected version 1 in %q", line)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use, since
+// events of the goroutines reading from the source can arrive late.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// failingStub is a database stub that fails to run the given migrations.
+type failingStub struct {
+	*dStub.Stub
+	failOn []string
+}
+
+func (s *failingStub) Run(migration io.Reader) error {
+	b, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	for _, f := range s.failOn {
+		if string(b) == f {
+			return fmt.Errorf("failed to run %v", f)
+		}
+	}
+	return s.Stub.Run(bytes.NewReader(b))
+}
+
+func TestAutoRollback(t *testing.T) {
+	tt := []struct {
+		name          string
+		autoRollback  bool
+		failOn        []string
+		expectRolled  bool
+		expectRbErr   bool
+		expectVersion uint
+		expectDirty   bool
+		expectSeq     migrationSequence
+	}{
+		{
+			name:          "disabled",
+			failOn:        []string{"CREATE 4"},
+			expectVersion: 4,
+			expectDirty:   true,
+			expectSeq:     migrationSequence{mr("CREATE 1"), mr("CREATE 3")},
+		},
+		{
+			name:          "rolled back",
+			autoRollback:  true,
+			failOn:        []string{"CREATE 4"},
+			expectRolled:  true,
+			expectVersion: 3,
+			expectSeq:     migrationSequence{mr("CREATE 1"), mr("CREATE 3"), mr("DROP 4")},
+		},
+		{
+			name:          "no down migration",
+			autoRollback:  true,
+			failOn:        []string{"CREATE 3"},
+			expectRolled:  true,
+			expectRbErr:   true,
+			expectVersion: 3,
+			expectDirty:   true,
+			expectSeq:     migrationSequence{mr("CREATE 1")},
+		},
+		{
+			name:          "down migration fails",
+			autoRollback:  true,
+			failOn:        []string{"CREATE 4", "DROP 4"},
+			expectRolled:  true,
+			expectRbErr:   true,
+			expectVersion: 4,
+			expectDirty:   true,
+			expectSeq:     migrationSequence{mr("CREATE 1"), mr("CREATE 3")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+			dbDrv := m.databaseDrv.(*dStub.Stub)
+			m.databaseDrv = &failingStub{Stub: dbDrv, failOn: tc.failOn}
+			m.AutoRollback = tc.autoRollback
+
+			err := m.Migrate(4)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			rbErr, isRollback := err.(RollbackError)
+			if isRollback != tc.expectRolled {
+				t.Fatalf("expected RollbackError: %v, got %T: %v", tc.expectRolled, err, err)
+			}
+			if isRollback && (rbErr.RollbackErr != nil) != tc.expectRbErr {
+				t.Errorf("expected rollback error: %v, got %v", tc.expectRbErr, rbErr.RollbackErr)
+			}
+			if isRollback && rbErr.Err == nil {
+				t.Error("expected the original error to be reported")
+			}
+
+			equalDbSeq(t, 0, tc.expectSeq, dbDrv)
+
+			v, dirty, err := m.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tc.expectVersion || dirty != tc.expectDirty {
+				t.Errorf("expected version %v (dirty: %v), got %v (dirty: %v)", tc.expectVersion, tc.expectDirty, v, dirty)
+			}
+		})
+	}
+}
+
+func TestSingleTransaction(t *testing.T) {
+	tt := []struct {
+		name          string
+		failOn        []string
+		expectErr     bool
+		expectVersion int
+		expectSeq     migrationSequence
+	}{
+		{
+			name:          "committed",
+			expectVersion: 4,
+			expectSeq:     migrationSequence{mr("CREATE 1"), mr("CREATE 3"), mr("CREATE 4")},
+		},
+		{
+			name:          "rolled back",
+			failOn:        []string{"CREATE 4"},
+			expectErr:     true,
+			expectVersion: database.NilVersion,
+			expectSeq:     migrationSequence{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+			dbDrv := &failingStub{Stub: m.databaseDrv.(*dStub.Stub), failOn: tc.failOn}
+			m.databaseDrv = dbDrv
+			m.SingleTransaction = true
+			m.AutoRollback = true
+
+			err := m.Migrate(4)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error: %v, got %v", tc.expectErr, err)
+			}
+			if _, isRollback := err.(RollbackError); isRollback {
+				t.Error("expected AutoRollback to be skipped")
+			}
+
+			equalDbSeq(t, 0, tc.expectSeq, dbDrv.Stub)
+			if dbDrv.CurrentVersion != tc.expectVersion || dbDrv.IsDirty {
+				t.Errorf("expected clean version %v, got %v (dirty: %v)", tc.expectVersion, dbDrv.CurrentVersion, dbDrv.IsDirty)
+			}
+			if err := dbDrv.Commit(); err != database.ErrNoTx {
+				t.Errorf("expected the transaction to be finished, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSingleTransactionNoTransactor(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.databaseDrv = struct{ database.Driver }{dbDrv}
+	m.SingleTransaction = true
+
+	if err := m.Up(); err != ErrNoTransactor {
+		t.Fatalf("expected ErrNoTransactor, got %v", err)
+	}
+	equalDbSeq(t, 0, migrationSequence{}, dbDrv)
+}
+
+func TestPlan(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	type planEntry struct {
+		version       uint
+		targetVersion int
+		direction     source.Direction
+		bytesRead     int64
+	}
+
+	tt := []struct {
+		name          string
+		startVersion  int
+		plan          func() ([]*Migration, error)
+		expectErr     error
+		expectEntries []planEntry
+	}{
+		{
+			name:         "up",
+			startVersion: 3,
+			plan:         m.PlanUp,
+			expectEntries: []planEntry{
+				{4, 4, source.Up, 8},
+				{5, 5, source.Up, 0},
+				{7, 7, source.Up, 8},
+			},
+		},
+		{
+			name:         "steps",
+			startVersion: 4,
+			plan:         func() ([]*Migration, error) { return m.PlanSteps(-2) },
+			expectEntries: []planEntry{
+				{4, 3, source.Down, 6},
+				{3, 1, source.Down, 0},
+			},
+		},
+		{
+			name:         "migrate",
+			startVersion: -1,
+			plan:         func() ([]*Migration, error) { return m.PlanMigrate(3) },
+			expectEntries: []planEntry{
+				{1, 1, source.Up, 8},
+				{3, 3, source.Up, 8},
+			},
+		},
+		{
+			name:         "down",
+			startVersion: 1,
+			plan:         m.PlanDown,
+			expectEntries: []planEntry{
+				{1, -1, source.Down, 6},
+			},
+		},
+		{
+			name:         "no change",
+			startVersion: 7,
+			plan:         m.PlanUp,
+			expectErr:    ErrNoChange,
+		},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			dbDrv.CurrentVersion = v.startVersion
+
+			plan, err := v.plan()
+			if err != v.expectErr {
+				t.Fatalf("expected err %v, got %v", v.expectErr, err)
+			}
+
+			entries := make([]planEntry, 0, len(plan))
+			for _, migr := range plan {
+				entries = append(entries, planEntry{migr.Version, migr.TargetVersion, migr.Direction(), migr.BytesRead})
+			}
+			if len(entries) != len(v.expectEntries) {
+				t.Fatalf("expected plan %v, got %v", v.expectEntries, entries)
+			}
+			for i := range entries {
+				if entries[i] != v.expectEntries[i] {
+					t.Fatalf("expected plan %v, got %v", v.expectEntries, entries)
+				}
+			}
+
+			// the database must not have been touched
+			if dbDrv.CurrentVersion != v.startVersion {
+				t.Errorf("expected version %v, got %v", v.startVersion, dbDrv.CurrentVersion)
+			}
+			equalDbSeq(t, 0, migrationSequence{}, dbDrv)
+		})
+	}
+}
+
+func TestPlanDirty(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := m.PlanUp()
+	if _, ok := err.(ErrDirty); !ok {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+}
+
 func TestUpDirty(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	dbDrv := m.databaseDrv.(*dStub.Stub)
@@ -1140,7 +1972,7 @@ func TestRead(t *testing.T) {
 
 	for i, v := range tt {
 		ret := make(chan interface{})
-		go m.read(v.from, v.to, ret)
+		go m.read(context.Background(), v.from, v.to, ret)
 		migrations, err := migrationsFromChannel(ret)
 
 		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
@@ -1217,7 +2049,7 @@ func TestReadUp(t *testing.T) {
 
 	for i, v := range tt {
 		ret := make(chan interface{})
-		go m.readUp(v.from, v.limit, ret)
+		go m.readUp(context.Background(), v.from, v.limit, ret)
 		migrations, err := migrationsFromChannel(ret)
 
 		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
@@ -1294,7 +2126,7 @@ func TestReadDown(t *testing.T) {
 
 	for i, v := range tt {
 		ret := make(chan interface{})
-		go m.readDown(v.from, v.limit, ret)
+		go m.readDown(context.Background(), v.from, v.limit, ret)
 		migrations, err := migrationsFromChannel(ret)
 
 		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
@@ -1310,15 +2142,489 @@ func TestReadDown(t *testing.T) {
 
 func TestLock(t *testing.T) {
 	m, _ := New("stub://", "stub://")
-	if err := m.lock(); err != nil {
+	if _, err := m.lock(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := m.lock(); err == nil {
+	if _, err := m.lock(context.Background()); err == nil {
 		t.Fatal("should be locked already")
 	}
 }
 
+// lockerStub is a Locker that records whether it is locked.
+type lockerStub struct {
+	locked bool
+}
+
+func (l *lockerStub) Lock(ctx context.Context) error {
+	l.locked = true
+	return nil
+}
+
+func (l *lockerStub) Unlock() error {
+	l.locked = false
+	return nil
+}
+
+func TestLocker(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	locker := &lockerStub{}
+	m.Locker = locker
+
+	// the database driver must not be used to lock
+	dbDrv.IsLocked = true
+
+	if _, err := m.lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !locker.locked {
+		t.Error("expected the Locker to be locked")
+	}
+	if err := m.unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if locker.locked {
+		t.Error("expected the Locker to be unlocked")
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if locker.locked {
+		t.Error("expected the Locker to be unlocked after Up")
+	}
+	if !dbDrv.IsLocked {
+		t.Error("expected the database driver to be left alone")
+	}
+}
+
+// blockingLocker is a Locker that ignores ctx and waits
+// for a lock held by somebody else until it is released.
+type blockingLocker struct {
+	release  chan struct{}
+	unlocked chan struct{}
+}
+
+func (l *blockingLocker) Lock(ctx context.Context) error {
+	<-l.release
+	return nil
+}
+
+func (l *blockingLocker) Unlock() error {
+	close(l.unlocked)
+	return nil
+}
+
+func TestLockTimeout(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	locker := &blockingLocker{release: make(chan struct{}), unlocked: make(chan struct{})}
+	m.Locker = locker
+	m.LockTimeout = 10 * time.Millisecond
+
+	if _, err := m.lock(context.Background()); err != ErrLockTimeout {
+		t.Fatalf("expected ErrLockTimeout, got %v", err)
+	}
+
+	// the lock acquired after giving up is released
+	close(locker.release)
+	select {
+	case <-locker.unlocked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the lock acquired after the timeout to be released")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.lock(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// the lock is free again for the next attempt
+	m.Locker = &lockerStub{}
+	if _, err := m.lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// losingLocker is a Locker whose lock can be lost while held.
+type losingLocker struct {
+	lockerStub
+	lost chan struct{}
+}
+
+func (l *losingLocker) LockLost() <-chan struct{} {
+	return l.lost
+}
+
+func TestLockLost(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	locker := &losingLocker{lost: make(chan struct{})}
+	m.Locker = locker
+
+	ctx, err := m.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the run not to be cancelled while the lock is held")
+	}
+
+	close(locker.lost)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the run to be cancelled once the lock is lost")
+	}
+	if err := m.unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// leaseStub is a database stub whose lock is lost while running a migration.
+type leaseStub struct {
+	contextStub
+	lost chan struct{}
+}
+
+func (s *leaseStub) RunContext(ctx context.Context, migration io.Reader) error {
+	close(s.lost)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestUpLeaseLost(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	locker := &losingLocker{lost: make(chan struct{})}
+	m.Locker = locker
+	m.databaseDrv = &leaseStub{contextStub: contextStub{Stub: dbDrv}, lost: locker.lost}
+
+	if err := m.Up(); err != database.ErrLeaseLost {
+		t.Fatalf("expected database.ErrLeaseLost, got %v", err)
+	}
+
+	v, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 || !dirty {
+		t.Errorf("expected dirty version 1, got %v (dirty: %v)", v, dirty)
+	}
+}
+
+func TestLockStatus(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	held, _, _, err := m.LockStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held {
+		t.Fatal("expected the lock not to be held")
+	}
+
+	dbDrv.IsLocked = true
+	held, owner, _, err := m.LockStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held || owner != "stub" {
+		t.Fatalf("expected the lock to be held by stub, got %v %q", held, owner)
+	}
+
+	if err := m.ForceUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.IsLocked {
+		t.Error("expected the lock to be released")
+	}
+
+	// a Locker that can't be inspected hides the database driver
+	m.Locker = &lockerStub{}
+	if _, _, _, err := m.LockStatus(); err != ErrNoLockStatus {
+		t.Errorf("expected ErrNoLockStatus, got %v", err)
+	}
+	if err := m.ForceUnlock(); err != ErrNoLockStatus {
+		t.Errorf("expected ErrNoLockStatus, got %v", err)
+	}
+}
+
+// racingStub is a database stub on which another process
+// saves version 7 while the given migration is running.
+type racingStub struct {
+	*dStub.Stub
+	raceOn string
+}
+
+func (s *racingStub) Run(migration io.Reader) error {
+	b, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	if string(b) == s.raceOn {
+		s.Stub.CurrentVersion, s.Stub.IsDirty = 7, false
+	}
+	return s.Stub.Run(bytes.NewReader(b))
+}
+
+func TestVersionConflict(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.databaseDrv = &racingStub{Stub: dbDrv, raceOn: "CREATE 3"}
+
+	err := m.Up()
+	conflict, ok := err.(database.ErrVersionConflict)
+	if !ok {
+		t.Fatalf("expected database.ErrVersionConflict, got %T: %v", err, err)
+	}
+	expected := database.ErrVersionConflict{ExpectedVersion: 3, ExpectedDirty: true, Version: 7}
+	if conflict != expected {
+		t.Errorf("expected %+v, got %+v", expected, conflict)
+	}
+
+	// the version saved by the other process is kept
+	equalDbSeq(t, 0, migrationSequence{mr("CREATE 1"), mr("CREATE 3")}, dbDrv)
+	if v, dirty, _ := m.Version(); v != 7 || dirty {
+		t.Errorf("expected version 7 (dirty: false), got %v (dirty: %v)", v, dirty)
+	}
+}
+
+func TestResume(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE a; CREATE b; CREATE c"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	failing := &failingStub{Stub: dbDrv, failOn: []string{"CREATE b"}}
+	m.databaseDrv = failing
+	m.TrackStatements = true
+
+	if err := m.Up(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if done, total, err := m.Progress(); err != nil || done != 1 || total != 3 {
+		t.Fatalf("expected 1 of 3 statements done, got %v of %v (err: %v)", done, total, err)
+	}
+
+	// the failed statement was fixed, continue with it
+	failing.failOn = nil
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 0, migrationSequence{mr("CREATE a"), mr("CREATE b"), mr("CREATE c"), mr("CREATE 2")}, dbDrv)
+	if v, dirty, _ := m.Version(); v != 2 || dirty {
+		t.Errorf("expected version 2 (dirty: false), got %v (dirty: %v)", v, dirty)
+	}
+	if _, total, _ := m.Progress(); total != 0 {
+		t.Errorf("expected the progress to be reset, got %v statements", total)
+	}
+
+	// a dirty database without progress can't be resumed
+	if err := m.Force(1); err != nil {
+		t.Fatal(err)
+	}
+	dbDrv.IsDirty = true
+	if err := m.Resume(); err != ErrNoProgress {
+		t.Errorf("expected ErrNoProgress, got %v", err)
+	}
+}
+
+// countingLocker is a Locker that counts how often it was locked.
+type countingLocker struct {
+	lockerStub
+	locks int
+}
+
+func (l *countingLocker) Lock(ctx context.Context) error {
+	l.locks++
+	return l.lockerStub.Lock(ctx)
+}
+
+func TestResumeClean(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	locker := &countingLocker{}
+	m.Locker = locker
+
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 0, migrationSequence{mr("CREATE 1"), mr("CREATE 3"), mr("CREATE 4"), mr("CREATE 7")}, dbDrv)
+
+	// a clean database is migrated up without releasing the lock in between
+	if locker.locks != 1 {
+		t.Errorf("expected to lock once, got %v", locker.locks)
+	}
+	if locker.locked {
+		t.Error("expected the lock to be released")
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected database.Directives
+		err      bool
+	}{
+		{header: "", expected: database.Directives{}},
+		{header: "CREATE a;\n-- migrate:no-transaction\n", expected: database.Directives{}},
+		{
+			header:   "-- a comment\n-- migrate:no-transaction\n\n-- migrate:timeout 30m\r\n-- migrate:split-statements\n-- migrate:env prod, staging\nCREATE a;",
+			expected: database.Directives{NoTransaction: true, Timeout: 30 * time.Minute, SplitStatements: true, Env: []string{"prod", "staging"}},
+		},
+		{header: "-- migrate:", err: true},
+		{header: "-- migrate:nope", err: true},
+		{header: "-- migrate:no-transaction please", err: true},
+		{header: "-- migrate:timeout", err: true},
+		{header: "-- migrate:timeout soon", err: true},
+		{header: "-- migrate:timeout -1s", err: true},
+		{header: "-- migrate:env", err: true},
+	}
+
+	for _, tc := range testCases {
+		d, err := parseDirectives([]byte(tc.header))
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected an error for %q", tc.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.header, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.expected, d) {
+			t.Errorf("expected %+v, got %+v for %q", tc.expected, d, tc.header)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:env prod\nCREATE 2"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "-- migrate:timeout 1m\n-- migrate:env staging,prod\nCREATE 3"})
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.Env = "staging"
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// the migration for prod is skipped, the body of the others is run in full
+	equalDbSeq(t, 0, migrationSequence{mr("CREATE 1"), mr("-- migrate:timeout 1m\n-- migrate:env staging,prod\nCREATE 3")}, dbDrv)
+	if v, dirty, _ := m.Version(); v != 3 || dirty {
+		t.Errorf("expected version 3 (dirty: false), got %v (dirty: %v)", v, dirty)
+	}
+
+	srcDrv.Migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "-- migrate:nope\nCREATE 4"})
+	if err := m.Up(); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("expected an unknown directive error, got %v", err)
+	}
+	if v, dirty, _ := m.Version(); v != 3 || dirty {
+		t.Errorf("expected version 3 (dirty: false), got %v (dirty: %v)", v, dirty)
+	}
+}
+
+// directiveStub is a database stub recording the directives of each run.
+type directiveStub struct {
+	*dStub.Stub
+	directives []database.Directives
+}
+
+func (s *directiveStub) RunDirectives(ctx context.Context, migration io.Reader, directives database.Directives) error {
+	s.directives = append(s.directives, directives)
+	return s.Stub.Run(migration)
+}
+
+func TestTrackStatementsDirectives(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:no-transaction\nCREATE a; CREATE b"})
+	dbDrv := &directiveStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+	m.TrackStatements = true
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// every statement is run with the directives of the migration
+	if len(dbDrv.directives) != 2 {
+		t.Fatalf("expected 2 statements run with directives, got %v", len(dbDrv.directives))
+	}
+	for _, d := range dbDrv.directives {
+		if !d.NoTransaction {
+			t.Errorf("expected the no-transaction directive, got %+v", d)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	m, _ := New("stub://", "stub://?x-var-schema=app&x-var-role=reader")
+	srcDrv := m.sourceDrv.(*sStub.Stub)
+	srcDrv.Migrations = source.NewMigrations()
+	srcDrv.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:timeout 1m\nCREATE {{.schema}}.a; GRANT {{$.role}}"})
+	srcDrv.Migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE {{if .tablespace}}{{.tablespace}}{{end}}"})
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.Template = true
+
+	if expected := map[string]string{"schema": "app", "role": "reader"}; !reflect.DeepEqual(expected, m.Vars) {
+		t.Fatalf("expected vars %v, got %v", expected, m.Vars)
+	}
+
+	err := m.Up()
+	if e, ok := err.(ErrMissingVar); !ok || e.Var != "tablespace" || e.Migration != "2/u 2.up.stub" {
+		t.Fatalf("expected a missing tablespace variable, got %v", err)
+	}
+	equalDbSeq(t, 0, migrationSequence{mr("-- migrate:timeout 1m\nCREATE app.a; GRANT reader")}, dbDrv)
+	if v, dirty, _ := m.Version(); v != 1 || dirty {
+		t.Errorf("expected version 1 (dirty: false), got %v (dirty: %v)", v, dirty)
+	}
+
+	m.Vars["tablespace"] = "fast"
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 1, migrationSequence{mr("-- migrate:timeout 1m\nCREATE app.a; GRANT reader"), mr("CREATE fast")}, dbDrv)
+}
+
+func TestMissingVar(t *testing.T) {
+	vars := map[string]string{"schema": "app"}
+	testCases := []struct {
+		tmpl    string
+		missing string
+	}{
+		{tmpl: "CREATE {{.schema}}.a"},
+		{tmpl: "CREATE {{.table}}", missing: "table"},
+		{tmpl: "{{if .schema}}{{$.role}}{{end}}", missing: "role"},
+		// range and with change dot, but not $
+		{tmpl: "{{range .schema}}{{.name}}{{end}}"},
+		{tmpl: "{{with .schema}}{{.name}}{{else}}{{.other}}{{end}}", missing: "other"},
+		{tmpl: "{{with .schema}}{{$.role}}{{end}}", missing: "role"},
+		{tmpl: `{{define "t"}}{{.name}}{{end}}{{template "t" .schema}}`},
+	}
+
+	for _, tc := range testCases {
+		tmpl, err := template.New("").Parse(tc.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, ok := missingVar(tmpl.Tree.Root, vars, true)
+		if ok != (tc.missing != "") || name != tc.missing {
+			t.Errorf("expected %q to be missing, got %q for %q", tc.missing, name, tc.tmpl)
+		}
+	}
+}
+
 func migrationsFromChannel(ret chan interface{}) ([]*Migration, error) {
 	slice := make([]*Migration, 0)
 	for r := range ret {
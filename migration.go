@@ -2,9 +2,14 @@ package migrate
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"time"
+
+	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/source"
 )
 
 // DefaultBufferSize sets the in memory buffer size (in Bytes) for every
@@ -54,6 +59,18 @@ type Migration struct {
 
 	// BytesRead holds the number of Bytes read from the migration source.
 	BytesRead int64
+
+	// Checksum is the hex encoded SHA-256 hash of the migration source.
+	// It is set once the migration source is fully read, see FinishedReading.
+	Checksum string
+
+	// resumeAt is the number of statements that already succeeded when
+	// resuming this migration, out of resumeTotal. See Migrate.Resume.
+	resumeAt    int
+	resumeTotal int
+
+	// Directives are read from the header of the body before it is run.
+	Directives database.Directives
 }
 
 // NewMigration returns a new Migration and sets the body, identifier,
@@ -116,6 +133,20 @@ func (m *Migration) LogString() string {
 	return fmt.Sprintf("%v/%v %v", m.Version, directionStr, m.Identifier)
 }
 
+// resumed returns whether this migration continues a failed run.
+func (m *Migration) resumed() bool {
+	return m.resumeTotal > 0
+}
+
+// Direction returns source.Up or source.Down depending on whether
+// applying this migration moves the version up or down.
+func (m *Migration) Direction() source.Direction {
+	if m.TargetVersion < int(m.Version) {
+		return source.Down
+	}
+	return source.Up
+}
+
 // Buffer buffers Body up to BufferSize.
 // Calling this function blocks. Call with goroutine.
 func (m *Migration) Buffer() error {
@@ -125,7 +156,9 @@ func (m *Migration) Buffer() error {
 
 	m.StartedBuffering = time.Now()
 
-	b := bufio.NewReaderSize(m.Body, int(m.BufferSize))
+	// hash the body while it streams through the buffer
+	h := sha256.New()
+	b := bufio.NewReaderSize(io.TeeReader(m.Body, h), int(m.BufferSize))
 
 	// start reading from body, peek won't move the read pointer though
 	// poor man's solution?
@@ -144,6 +177,7 @@ func (m *Migration) Buffer() error {
 
 	m.FinishedReading = time.Now()
 	m.BytesRead = n
+	m.Checksum = hex.EncodeToString(h.Sum(nil))
 
 	// close bufferWriter so Buffer knows that there is no
 	// more data coming
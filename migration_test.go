@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"strings"
+	"testing"
 )
 
 func ExampleNewMigration() {
@@ -54,3 +55,26 @@ func ExampleNewMigration_nilVersion() {
 	// Output:
 	// 1486686016/d drop_users_table
 }
+
+func TestMigrationChecksum(t *testing.T) {
+	body := ioutil.NopCloser(strings.NewReader("CREATE TABLE users (id int);"))
+	migr, err := NewMigration(body, "create_users_table", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := migr.Buffer(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err := ioutil.ReadAll(migr.BufferedBody); err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256 of the body above
+	expected := "a15ebcab704727eefd822a74c96ecc837377c7f9028269f520d6d24ff372f0f2"
+	if migr.Checksum != expected {
+		t.Errorf("expected checksum %v, got %v", expected, migr.Checksum)
+	}
+}
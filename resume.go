@@ -0,0 +1,156 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/source"
+)
+
+// Resume continues the up migration that left the database dirty at the
+// statement that failed, skipping the statements that succeeded, and then
+// migrates all the way up like Up. The progress must have been recorded with
+// TrackStatements, otherwise ErrNoProgress is returned. A clean database is
+// migrated like Up.
+func (m *Migrate) Resume() error {
+	return m.ResumeContext(context.Background())
+}
+
+// ResumeContext is like Resume, but stops at the next safe break point
+// once ctx is done, like UpContext.
+func (m *Migrate) ResumeContext(ctx context.Context) error {
+	ctx, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	// migrate up without releasing the lock, so no other run slips in
+	if !dirty {
+		return m.unlockErr(m.up(ctx, curVersion))
+	}
+
+	migr, err := m.resumeMigration(curVersion)
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+	go m.readResume(ctx, migr, ret)
+	return m.unlockErr(m.runMigrations(ctx, ret))
+}
+
+// Progress returns how many statements of the migration to the current
+// version succeeded, out of total, as recorded with TrackStatements.
+// total is 0 if nothing was recorded or the database driver doesn't
+// implement database.ProgressDriver.
+func (m *Migrate) Progress() (done, total int, err error) {
+	d, ok := m.databaseDrv.(database.ProgressDriver)
+	if !ok {
+		return 0, 0, nil
+	}
+	return d.Progress()
+}
+
+// resumeMigration returns the up migration to the dirty curVersion,
+// set up to skip the statements that succeeded already.
+func (m *Migrate) resumeMigration(curVersion int) (*Migration, error) {
+	if curVersion < 0 {
+		return nil, ErrNoProgress
+	}
+
+	done, total, err := m.Progress()
+	if err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, ErrNoProgress
+	}
+
+	migr, err := m.newMigration(suint(curVersion), curVersion)
+	if err != nil {
+		return nil, err
+	}
+	migr.resumeAt, migr.resumeTotal = done, total
+	return migr, nil
+}
+
+// readResume sends migr first and then whatever readUp reads
+// starting at its version. It closes ret like readUp does.
+func (m *Migrate) readResume(ctx context.Context, migr *Migration, ret chan<- interface{}) {
+	defer close(ret)
+
+	ret <- migr
+	go m.buffer(migr)
+
+	up := make(chan interface{}, m.PrefetchMigrations)
+	go m.readUp(ctx, migr.TargetVersion, -1, up)
+	for r := range up {
+		// the resumed migration was a change already
+		if r == ErrNoChange {
+			continue
+		}
+		ret <- r
+	}
+}
+
+// runBody runs the body of migr within its timeout directive, if any.
+// A body implementing source.Runner runs itself.
+// Up migrations are run statement by statement if TrackStatements is set
+// or migr is resumed, and the database driver implements
+// database.ProgressDriver, recording the progress before each statement.
+// Each statement is run with the directives of migr.
+func (m *Migrate) runBody(ctx context.Context, migr *Migration) error {
+	if migr.Directives.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, migr.Directives.Timeout)
+		defer cancel()
+	}
+
+	if r, ok := migr.Body.(source.Runner); ok {
+		if _, err := io.Copy(ioutil.Discard, migr.BufferedBody); err != nil {
+			return err
+		}
+		return r.RunMigration(ctx, m.databaseDrv)
+	}
+
+	d, ok := m.databaseDrv.(database.ProgressDriver)
+	if !ok || !migr.resumed() && (!m.TrackStatements || migr.Direction() != source.Up) {
+		return m.runDirectives(ctx, migr.BufferedBody, migr.Directives)
+	}
+
+	body, err := ioutil.ReadAll(migr.BufferedBody)
+	if err != nil {
+		return err
+	}
+	stmts, err := d.SplitStatements(body)
+	if err != nil {
+		return err
+	}
+
+	if migr.resumed() {
+		if migr.resumeTotal != len(stmts) {
+			return fmt.Errorf("can't resume %v: it has %v statements, but %v were recorded; was it changed?",
+				migr.LogString(), len(stmts), migr.resumeTotal)
+		}
+		m.logVerbosePrintf("Resuming %v at statement %v of %v\n", migr.LogString(), migr.resumeAt+1, len(stmts))
+	}
+
+	for i := migr.resumeAt; i < len(stmts); i++ {
+		if err := d.SetProgress(i, len(stmts)); err != nil {
+			return err
+		}
+		if err := m.runDirectives(ctx, bytes.NewReader(stmts[i]), migr.Directives); err != nil {
+			return err
+		}
+	}
+	return d.SetProgress(len(stmts), len(stmts))
+}
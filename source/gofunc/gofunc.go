@@ -0,0 +1,223 @@
+// Package gofunc provides a source driver for migrations written in Go,
+// i.e. backfills or calls to external APIs, optionally mixed with the
+// migrations of another source driver like SQL files.
+package gofunc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/source"
+)
+
+func init() {
+	source.Register("gofunc", &GoFunc{})
+}
+
+var (
+	ErrNoURL     = fmt.Errorf("gofunc migrations are registered in code, use WithInstance")
+	ErrNoFunc    = fmt.Errorf("gofunc migration needs an up or a down func")
+	ErrDuplicate = fmt.Errorf("gofunc migration version registered twice")
+)
+
+// Func is a migration written in Go. d is the database driver of Migrate,
+// use SQL for a Func working with a *sql.DB.
+type Func func(ctx context.Context, d database.Driver) error
+
+// SQL returns a Func that calls f with db, which should be
+// the database the database driver of Migrate is connected to.
+// f runs on its own connection, outside of the transaction of
+// Migrate.SingleTransaction (-single-transaction in the CLI): its changes
+// are committed even if a later migration fails and the others are rolled
+// back, and it doesn't see the uncommitted changes of earlier migrations.
+func SQL(db *sql.DB, f func(ctx context.Context, db *sql.DB) error) Func {
+	return func(ctx context.Context, _ database.Driver) error {
+		return f(ctx, db)
+	}
+}
+
+// Migration is a migration written in Go.
+type Migration struct {
+	// Version of the migration, mixed with the versions of the base source.
+	Version uint
+
+	// Identifier describes the migration, i.e. backfill_users.
+	Identifier string
+
+	// Up and Down migrate the database, either may be nil.
+	Up   Func
+	Down Func
+}
+
+type GoFunc struct {
+	base     source.Driver
+	versions []uint
+	funcs    map[uint]Migration
+}
+
+// Open is not supported, Go migrations can only be passed to WithInstance.
+func (g *GoFunc) Open(url string) (source.Driver, error) {
+	return nil, ErrNoURL
+}
+
+// WithInstance returns a source driver with the given Go migrations.
+// Their versions are mixed with those of base, which may be nil, i.e. a
+// driver for SQL files. A version may have a Go migration for one direction
+// and a migration of base for the other, but not both for the same direction,
+// which returns ErrDuplicate. Closing the returned driver closes base.
+func WithInstance(base source.Driver, migrations ...Migration) (source.Driver, error) {
+	g := &GoFunc{
+		base:  base,
+		funcs: make(map[uint]Migration),
+	}
+
+	for _, m := range migrations {
+		if m.Up == nil && m.Down == nil {
+			return nil, fmt.Errorf("%v: version %v", ErrNoFunc, m.Version)
+		}
+		if _, dup := g.funcs[m.Version]; dup {
+			return nil, fmt.Errorf("%v: version %v", ErrDuplicate, m.Version)
+		}
+		if m.Identifier == "" {
+			m.Identifier = "gofunc"
+		}
+		g.funcs[m.Version] = m
+		g.versions = append(g.versions, m.Version)
+	}
+
+	// list the versions of base, as its Prev and Next
+	// only work for versions that exist in base
+	if base != nil {
+		v, err := base.First()
+		for err == nil {
+			if m, ok := g.funcs[v]; ok {
+				if err := notInBase(base, m); err != nil {
+					return nil, err
+				}
+			} else {
+				g.versions = append(g.versions, v)
+			}
+			v, err = base.Next(v)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	sort.Slice(g.versions, func(i, j int) bool {
+		return g.versions[i] < g.versions[j]
+	})
+	return g, nil
+}
+
+// notInBase returns ErrDuplicate if base has a migration
+// for the version of m and a direction m has a func for.
+func notInBase(base source.Driver, m Migration) error {
+	if m.Up != nil {
+		if err := notRead(m, source.Up, base.ReadUp); err != nil {
+			return err
+		}
+	}
+	if m.Down != nil {
+		if err := notRead(m, source.Down, base.ReadDown); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notRead returns ErrDuplicate unless read fails with os.ErrNotExist
+// for the version of m.
+func notRead(m Migration, direction source.Direction, read func(uint) (io.ReadCloser, string, error)) error {
+	r, identifier, err := read(m.Version)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%v: version %v %v is %v in the base source, too", ErrDuplicate, m.Version, direction, identifier)
+}
+
+func (g *GoFunc) Close() error {
+	if g.base != nil {
+		return g.base.Close()
+	}
+	return nil
+}
+
+func (g *GoFunc) First() (version uint, err error) {
+	if len(g.versions) == 0 {
+		return 0, &os.PathError{Op: "first", Path: "<gofunc>", Err: os.ErrNotExist}
+	}
+	return g.versions[0], nil
+}
+
+func (g *GoFunc) Prev(version uint) (prevVersion uint, err error) {
+	if i := g.find(version); i > 0 {
+		return g.versions[i-1], nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("prev for version %v", version), Path: "<gofunc>", Err: os.ErrNotExist}
+}
+
+func (g *GoFunc) Next(version uint) (nextVersion uint, err error) {
+	if i := g.find(version); i >= 0 && i+1 < len(g.versions) {
+		return g.versions[i+1], nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("next for version %v", version), Path: "<gofunc>", Err: os.ErrNotExist}
+}
+
+// find returns the index of version in versions, or -1.
+func (g *GoFunc) find(version uint) int {
+	i := sort.Search(len(g.versions), func(i int) bool {
+		return g.versions[i] >= version
+	})
+	if i < len(g.versions) && g.versions[i] == version {
+		return i
+	}
+	return -1
+}
+
+func (g *GoFunc) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := g.funcs[version]; ok && m.Up != nil {
+		return &body{Reader: strings.NewReader(""), f: m.Up}, m.Identifier, nil
+	}
+	if g.base != nil {
+		return g.base.ReadUp(version)
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read up version %v", version), Path: "<gofunc>", Err: os.ErrNotExist}
+}
+
+func (g *GoFunc) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := g.funcs[version]; ok && m.Down != nil {
+		return &body{Reader: strings.NewReader(""), f: m.Down}, m.Identifier, nil
+	}
+	if g.base != nil {
+		return g.base.ReadDown(version)
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read down version %v", version), Path: "<gofunc>", Err: os.ErrNotExist}
+}
+
+// body is the empty body of a Go migration, which runs itself.
+type body struct {
+	io.Reader
+	f Func
+}
+
+func (b *body) Close() error {
+	return nil
+}
+
+// RunMigration implements source.Runner.
+func (b *body) RunMigration(ctx context.Context, d database.Driver) error {
+	return b.f(ctx, d)
+}
@@ -0,0 +1,98 @@
+package gofunc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/solvedata/migrate/v4"
+	"github.com/solvedata/migrate/v4/database"
+	dStub "github.com/solvedata/migrate/v4/database/stub"
+	"github.com/solvedata/migrate/v4/source"
+	sStub "github.com/solvedata/migrate/v4/source/stub"
+	st "github.com/solvedata/migrate/v4/source/testing"
+)
+
+func nop(ctx context.Context, d database.Driver) error {
+	return nil
+}
+
+func Test(t *testing.T) {
+	base, err := (&sStub.Stub{}).Open("stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := source.NewMigrations()
+	m.Append(&source.Migration{Version: 1, Direction: source.Up})
+	m.Append(&source.Migration{Version: 1, Direction: source.Down})
+	m.Append(&source.Migration{Version: 5, Direction: source.Down})
+	base.(*sStub.Stub).Migrations = m
+
+	d, err := WithInstance(base,
+		Migration{Version: 3, Up: nop},
+		Migration{Version: 4, Up: nop, Down: nop},
+		Migration{Version: 7, Up: nop, Down: nop},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+}
+
+func TestWithInstance(t *testing.T) {
+	if _, err := WithInstance(nil, Migration{Version: 1}); err == nil {
+		t.Error("expected an error for a migration without funcs")
+	}
+	if _, err := WithInstance(nil, Migration{Version: 1, Up: nop}, Migration{Version: 1, Down: nop}); err == nil {
+		t.Error("expected an error for a version registered twice")
+	}
+
+	base, _ := (&sStub.Stub{}).Open("stub://")
+	base.(*sStub.Stub).Migrations.Append(&source.Migration{Version: 1, Direction: source.Up})
+	if _, err := WithInstance(base, Migration{Version: 1, Up: nop}); err == nil {
+		t.Error("expected an error for an up migration in both sources")
+	}
+	if _, err := WithInstance(base, Migration{Version: 1, Down: nop}); err != nil {
+		t.Errorf("expected a down migration for an up migration of the base source, got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	base, _ := (&sStub.Stub{}).Open("stub://")
+	base.(*sStub.Stub).Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	base.(*sStub.Stub).Migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+
+	var called database.Driver
+	failing := errors.New("backfill failed")
+	srcDrv, err := WithInstance(base,
+		Migration{Version: 2, Identifier: "backfill", Up: func(ctx context.Context, d database.Driver) error {
+			called = d
+			return nil
+		}},
+		Migration{Version: 4, Identifier: "broken", Up: func(ctx context.Context, d database.Driver) error {
+			return failing
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbDrv, _ := (&dStub.Stub{}).Open("stub://")
+
+	m, err := migrate.NewWithInstance("gofunc", srcDrv, "stub", dbDrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != failing {
+		t.Fatalf("expected %v, got %v", failing, err)
+	}
+
+	if called != dbDrv {
+		t.Error("expected the go func to be called with the database driver")
+	}
+	if seq := dbDrv.(*dStub.Stub).MigrationSequence; len(seq) != 2 || seq[0] != "CREATE 1" || seq[1] != "CREATE 3" {
+		t.Errorf("expected the SQL migrations to run, got %v", seq)
+	}
+	if v, dirty, _ := m.Version(); v != 4 || !dirty {
+		t.Errorf("expected version 4 (dirty: true), got %v (dirty: %v)", v, dirty)
+	}
+}
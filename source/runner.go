@@ -0,0 +1,16 @@
+package source
+
+import (
+	"context"
+
+	"github.com/solvedata/migrate/v4/database"
+)
+
+// Runner is an optional interface the body returned by ReadUp or ReadDown
+// can implement to run the migration itself, i.e. a migration written in Go
+// (see package gofunc). Migrate calls RunMigration with its database driver
+// instead of passing the body to the driver's Run, keeping the version
+// bookkeeping the same. The body is still read, and its content checksummed.
+type Runner interface {
+	RunMigration(ctx context.Context, d database.Driver) error
+}
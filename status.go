@@ -0,0 +1,161 @@
+package migrate
+
+import (
+	"os"
+	"sort"
+
+	"github.com/solvedata/migrate/v4/database"
+	"github.com/solvedata/migrate/v4/source"
+)
+
+// MigrationState tells whether a migration version is applied.
+type MigrationState string
+
+const (
+	// StateApplied is a version that has been applied.
+	StateApplied MigrationState = "applied"
+
+	// StatePending is a version that hasn't been applied, yet.
+	StatePending MigrationState = "pending"
+
+	// StateCurrent is the current version of the database,
+	// which may be dirty or missing from the source.
+	StateCurrent MigrationState = "current"
+
+	// StateMissing is a version that has been applied according
+	// to the migration history, but is missing from the source.
+	StateMissing MigrationState = "missing"
+)
+
+// MigrationStatus describes a migration version as returned by Status.
+type MigrationStatus struct {
+	Version    uint           `json:"version"`
+	Identifier string         `json:"identifier"`
+	State      MigrationState `json:"state"`
+
+	// Dirty is true if this is the current version and it is dirty.
+	Dirty bool `json:"dirty"`
+
+	// Up and Down are true if the source has
+	// an up or down migration for this version.
+	Up   bool `json:"up"`
+	Down bool `json:"down"`
+}
+
+// Status returns the state of every version in the source, and of the
+// versions in the database that are missing from the source, ordered by
+// version. Versions below the current one are applied, unless the
+// migration history, if the database driver keeps one, tells otherwise.
+func (m *Migrate) Status() ([]MigrationStatus, error) {
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := m.history()
+	if err != nil {
+		return nil, err
+	}
+	missing, err := m.missingFromHistory(curVersion, entries)
+	if err != nil {
+		return nil, err
+	}
+	notApplied := make(map[uint]bool)
+	for _, v := range missing {
+		notApplied[v] = true
+	}
+
+	statuses := make([]MigrationStatus, 0)
+	inSource := make(map[uint]bool)
+	version, err := m.sourceDrv.First()
+	for err == nil {
+		s, errRead := m.sourceStatus(version)
+		if errRead != nil {
+			return nil, errRead
+		}
+		switch {
+		case int(version) == curVersion:
+			s.State, s.Dirty = StateCurrent, dirty
+		case int(version) < curVersion && !notApplied[version]:
+			s.State = StateApplied
+		default:
+			s.State = StatePending
+		}
+		statuses = append(statuses, s)
+		inSource[version] = true
+
+		version, err = m.sourceDrv.Next(version)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// the last successful run of a version tells if it is applied
+	applied := make(map[uint]database.HistoryEntry)
+	for _, e := range entries {
+		if e.Success {
+			applied[e.Version] = e
+		}
+	}
+	for v, e := range applied {
+		if !inSource[v] && e.Direction == string(source.Up) && int(v) != curVersion {
+			statuses = append(statuses, MigrationStatus{Version: v, Identifier: e.Identifier, State: StateMissing})
+		}
+	}
+	if curVersion != database.NilVersion && !inSource[suint(curVersion)] {
+		s := MigrationStatus{Version: suint(curVersion), State: StateCurrent, Dirty: dirty}
+		if e, ok := applied[s.Version]; ok {
+			s.Identifier = e.Identifier
+		}
+		statuses = append(statuses, s)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// sourceStatus returns the status of version with the
+// identifier and the directions the source has for it.
+func (m *Migrate) sourceStatus(version uint) (MigrationStatus, error) {
+	s := MigrationStatus{Version: version}
+
+	r, identifier, err := m.sourceDrv.ReadUp(version)
+	if err == nil {
+		s.Up, s.Identifier = true, identifier
+		if err := r.Close(); err != nil {
+			return s, err
+		}
+	} else if !os.IsNotExist(err) {
+		return s, err
+	}
+
+	r, identifier, err = m.sourceDrv.ReadDown(version)
+	if err == nil {
+		s.Down = true
+		if s.Identifier == "" {
+			s.Identifier = identifier
+		}
+		if err := r.Close(); err != nil {
+			return s, err
+		}
+	} else if !os.IsNotExist(err) {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// history returns the entries of the migration history, or none
+// if the database driver doesn't keep a history.
+func (m *Migrate) history() ([]database.HistoryEntry, error) {
+	d, ok := m.databaseDrv.(database.HistoryDriver)
+	if !ok {
+		return nil, nil
+	}
+
+	entries, err := d.History()
+	if err == database.ErrNoHistory {
+		return nil, nil
+	}
+	return entries, err
+}
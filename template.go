@@ -0,0 +1,140 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	nurl "net/url"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// varQueryPrefix starts the query parameters of a database URL that
+// set template variables, i.e. x-var-schema=app.
+const varQueryPrefix = "x-var-"
+
+// ErrMissingVar is returned if a migration template
+// refers to a variable that isn't set in Vars.
+type ErrMissingVar struct {
+	// Migration is the migration the template belongs to, as in LogString.
+	Migration string
+
+	// Var is the name of the missing variable.
+	Var string
+}
+
+// Error implements error.
+func (e ErrMissingVar) Error() string {
+	return fmt.Sprintf("%v: missing template variable %q", e.Migration, e.Var)
+}
+
+// VarsFromURL returns the template variables set with x-var-* query
+// parameters in rawURL, i.e. {"schema": "app"} for x-var-schema=app.
+// Database drivers remove them with FilterCustomQuery.
+func VarsFromURL(rawURL string) (map[string]string, error) {
+	u, err := nurl.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
+	for k, v := range u.Query() {
+		if strings.HasPrefix(k, varQueryPrefix) && len(k) > len(varQueryPrefix) && len(v) > 0 {
+			vars[strings.TrimPrefix(k, varQueryPrefix)] = v[len(v)-1]
+		}
+	}
+	return vars, nil
+}
+
+// render executes the body of the migration as a text/template with vars
+// and replaces BufferedBody with the result. All variables the template
+// refers to must be set, otherwise ErrMissingVar is returned.
+// Calling this function blocks until the body has been buffered.
+func (m *Migration) render(vars map[string]string) error {
+	if m.BufferedBody == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(m.BufferedBody)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(m.LogString()).Option("missingkey=error").Parse(string(body))
+	if err != nil {
+		return err
+	}
+	// only the main template is known to be executed with vars as dot,
+	// missingkey=error still catches the others once executed
+	if tmpl.Tree != nil {
+		if name, ok := missingVar(tmpl.Tree.Root, vars, true); ok {
+			return ErrMissingVar{Migration: m.LogString(), Var: name}
+		}
+	}
+
+	var rendered bytes.Buffer
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	if err := tmpl.Execute(&rendered, vars); err != nil {
+		return err
+	}
+	m.BufferedBody = &rendered
+	return nil
+}
+
+// missingVar returns the name of the first variable node refers to,
+// as in {{.name}} or {{$.name}}, that isn't set in vars. Fields of dot
+// are only variables if top is set, since range and with change dot.
+func missingVar(node parse.Node, vars map[string]string, top bool) (string, bool) {
+	var children []parse.Node
+	// body is run with another dot than node
+	var body parse.Node
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			children = n.Nodes
+		}
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		children, body = []parse.Node{n.Pipe, n.ElseList}, n.List
+	case *parse.WithNode:
+		children, body = []parse.Node{n.Pipe, n.ElseList}, n.List
+	case *parse.TemplateNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				children = append(children, cmd)
+			}
+		}
+	case *parse.CommandNode:
+		children = n.Args
+	case *parse.ChainNode:
+		children = []parse.Node{n.Node}
+	case *parse.FieldNode:
+		if _, ok := vars[n.Ident[0]]; top && !ok {
+			return n.Ident[0], true
+		}
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			if _, ok := vars[n.Ident[1]]; !ok {
+				return n.Ident[1], true
+			}
+		}
+	}
+
+	for _, child := range children {
+		if name, ok := missingVar(child, vars, top); ok {
+			return name, ok
+		}
+	}
+	if body != nil {
+		return missingVar(body, vars, false)
+	}
+	return "", false
+}
@@ -1,8 +1,13 @@
 package migrate
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	nurl "net/url"
+	"os"
+	"os/user"
 	"strings"
 )
 
@@ -48,6 +53,25 @@ func suint(n int) uint {
 	return uint(n)
 }
 
+// currentUser returns the name of the user running this process,
+// falling back to $USER if it can't be looked up.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// checksum returns the hex encoded SHA-256 hash of everything read from r,
+// matching Migration.Checksum.
+func checksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // FilterCustomQuery filters all query values starting with `x-`
 func FilterCustomQuery(u *nurl.URL) *nurl.URL {
 	ux := *u